@@ -0,0 +1,442 @@
+package ch03
+
+import (
+    "context"
+    "errors"
+    "net"
+    "os"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+
+var ErrPoolClosed = errors.New("pool closed")
+
+
+// ConnPool keeps connections to each address open between uses, so clients
+// making many short exchanges pay for the handshake once. Checking out a
+// connection reuses the most recently returned idle one, after making sure
+// the peer is still there, and dials otherwise. With an IdleTimeout, the pool
+// closes expired idle connections in the background until it is closed.
+type ConnPool struct {
+    Network string // the network to dial; empty means tcp
+    Dialer net.Dialer
+
+    // Dial, if set, dials new connections instead of Dialer, such as a
+    // RetryDialer's or a happy eyeballs Dialer's DialContext.
+    Dial func(ctx context.Context, network, address string) (net.Conn, error)
+
+    MaxIdle int // idle connections kept per address; 0 means 2
+    MaxOpen int // connections open per address, idle or in use; 0 means no limit
+    IdleTimeout time.Duration // idle connections older than this are closed; 0 means never
+
+    // Check, if set, is the heartbeat format checked-out connections must
+    // answer: the pool sends a ping and expects the pong within CheckTimeout.
+    // Otherwise it only makes sure the peer has not closed the connection.
+    Check PingFormat
+    CheckTimeout time.Duration // 0 means 1 second
+    CheckAfter time.Duration // connections idle for less are not checked; 0 means always check
+
+    mu sync.Mutex
+    addresses map[string]*addressPool
+    closed bool
+    reaping chan struct{} // closed to stop the reaper, if it runs
+    seq uint32 // the last heartbeat sequence number
+
+    dials, reused, waits, evicted, failedChecks int64
+}
+
+
+// PoolStats are a ConnPool's counters across all addresses.
+type PoolStats struct {
+    Open int // connections open, idle or in use
+    Idle int
+    Dials int64
+    Reused int64 // checkouts served by an idle connection
+    Waits int64 // checkouts that had to wait for MaxOpen
+    Evicted int64 // idle connections closed for exceeding IdleTimeout
+    FailedChecks int64 // idle connections closed for failing the checkout check
+}
+
+
+type addressPool struct {
+    open int
+    idle []idleConn // the most recently returned last
+    released chan struct{} // closed, and replaced, whenever a connection comes back or closes
+}
+
+type idleConn struct {
+    conn net.Conn
+    since time.Time
+}
+
+
+// Get checks out a connection to address, waiting for one to free up while
+// MaxOpen are open. Close the connection to return it.
+func (pool *ConnPool) Get(ctx context.Context, address string) (*PooledConn, error) {
+    waited := false
+
+    for {
+        pool.mu.Lock()
+        if pool.closed {
+            pool.mu.Unlock()
+            return nil, ErrPoolClosed
+        }
+
+        if pool.IdleTimeout > 0 && pool.reaping == nil {
+            pool.reaping = make(chan struct{})
+            go pool.reap(pool.reaping)
+        }
+
+        ap := pool.address(address)
+        pool.evict(ap)
+
+        if n := len(ap.idle); n > 0 {
+            idle := ap.idle[n - 1]
+            ap.idle = ap.idle[:n - 1]
+            pool.mu.Unlock()
+
+            if pool.healthy(idle) {
+                atomic.AddInt64(&pool.reused, 1)
+                return &PooledConn{Conn: idle.conn, pool: pool, address: address}, nil
+            }
+
+            atomic.AddInt64(&pool.failedChecks, 1)
+            pool.release(address, idle.conn)
+            continue
+        }
+
+        if pool.MaxOpen <= 0 || ap.open < pool.MaxOpen {
+            ap.open++
+            pool.mu.Unlock()
+
+            return pool.dial(ctx, address)
+        }
+
+        released := ap.released
+        pool.mu.Unlock()
+
+        if !waited {
+            waited = true
+            atomic.AddInt64(&pool.waits, 1)
+        }
+
+        select {
+        case <-ctx.Done():
+            return nil, ctx.Err()
+        case <-released:
+        }
+    }
+}
+
+// Stats returns the pool's counters. Idle connections past IdleTimeout are
+// evicted first, so they are not counted as open.
+func (pool *ConnPool) Stats() PoolStats {
+    pool.mu.Lock()
+    defer pool.mu.Unlock()
+
+    for _, ap := range pool.addresses {
+        pool.evict(ap)
+    }
+
+    stats := PoolStats{
+        Dials: atomic.LoadInt64(&pool.dials),
+        Reused: atomic.LoadInt64(&pool.reused),
+        Waits: atomic.LoadInt64(&pool.waits),
+        Evicted: atomic.LoadInt64(&pool.evicted),
+        FailedChecks: atomic.LoadInt64(&pool.failedChecks),
+    }
+
+    for _, ap := range pool.addresses {
+        stats.Open += ap.open
+        stats.Idle += len(ap.idle)
+    }
+
+    return stats
+}
+
+// Close closes the idle connections, and the others as they come back.
+func (pool *ConnPool) Close() error {
+    pool.mu.Lock()
+    if pool.closed {
+        pool.mu.Unlock()
+        return nil
+    }
+    pool.closed = true
+
+    if pool.reaping != nil {
+        close(pool.reaping)
+    }
+
+    var idle []net.Conn
+    for _, ap := range pool.addresses {
+        for _, i := range ap.idle {
+            idle = append(idle, i.conn)
+        }
+        ap.open -= len(ap.idle)
+        ap.idle = nil
+        ap.signal()
+    }
+    pool.mu.Unlock()
+
+    for _, conn := range idle {
+        _ = conn.Close()
+    }
+
+    return nil
+}
+
+
+// address returns the pool of address. The caller must hold pool.mu.
+func (pool *ConnPool) address(address string) *addressPool {
+    if pool.addresses == nil {
+        pool.addresses = make(map[string]*addressPool)
+    }
+
+    ap := pool.addresses[address]
+    if ap == nil {
+        ap = &addressPool{released: make(chan struct{})}
+        pool.addresses[address] = ap
+    }
+
+    return ap
+}
+
+// evict closes the idle connections of ap that idled past IdleTimeout. The
+// caller must hold pool.mu.
+func (pool *ConnPool) evict(ap *addressPool) {
+    if pool.IdleTimeout <= 0 {
+        return
+    }
+
+    cutoff := time.Now().Add(-pool.IdleTimeout)
+    kept := ap.idle[:0]
+
+    for _, idle := range ap.idle {
+        if idle.since.After(cutoff) {
+            kept = append(kept, idle)
+            continue
+        }
+
+        _ = idle.conn.Close()
+        ap.open--
+        atomic.AddInt64(&pool.evicted, 1)
+    }
+
+    if len(kept) < len(ap.idle) {
+        ap.signal()
+    }
+    ap.idle = kept
+}
+
+// reap evicts idle connections as they expire, so they do not hold sockets
+// open until the next checkout of their address, until stop is closed.
+func (pool *ConnPool) reap(stop <-chan struct{}) {
+    ticker := time.NewTicker(max(pool.IdleTimeout / 2, time.Millisecond))
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-stop:
+            return
+        case <-ticker.C:
+        }
+
+        pool.mu.Lock()
+        for _, ap := range pool.addresses {
+            pool.evict(ap)
+        }
+        pool.mu.Unlock()
+    }
+}
+
+func (pool *ConnPool) dial(ctx context.Context, address string) (*PooledConn, error) {
+    network := pool.Network
+    if network == "" {
+        network = "tcp"
+    }
+
+    dial := pool.Dialer.DialContext
+    if pool.Dial != nil {
+        dial = pool.Dial
+    }
+
+    atomic.AddInt64(&pool.dials, 1)
+
+    conn, err := dial(ctx, network, address)
+    if err != nil {
+        pool.release(address, nil)
+        return nil, err
+    }
+
+    return &PooledConn{Conn: conn, pool: pool, address: address}, nil
+}
+
+// put takes back a checked-out connection, closing it if it broke or too
+// many are idle.
+func (pool *ConnPool) put(address string, conn net.Conn, broken bool) {
+    pool.mu.Lock()
+
+    ap := pool.address(address)
+
+    maxIdle := pool.MaxIdle
+    if maxIdle <= 0 {
+        maxIdle = 2
+    }
+
+    if broken || pool.closed || len(ap.idle) >= maxIdle {
+        pool.mu.Unlock()
+        pool.release(address, conn)
+        return
+    }
+
+    ap.idle = append(ap.idle, idleConn{conn: conn, since: time.Now()})
+    ap.signal()
+    pool.mu.Unlock()
+}
+
+// release closes conn, if any, and frees its place among the open ones.
+func (pool *ConnPool) release(address string, conn net.Conn) {
+    if conn != nil {
+        _ = conn.Close()
+    }
+
+    pool.mu.Lock()
+    defer pool.mu.Unlock()
+
+    ap := pool.address(address)
+    ap.open--
+    ap.signal()
+}
+
+// healthy reports whether the peer of an idle connection is still there.
+func (pool *ConnPool) healthy(idle idleConn) bool {
+    if pool.CheckAfter > 0 && time.Since(idle.since) < pool.CheckAfter {
+        return true
+    }
+
+    conn := idle.conn
+    defer func() {
+        _ = conn.SetDeadline(time.Time{})
+    }()
+
+    if pool.Check == nil {
+        // Nothing should arrive on an idle connection, least of all EOF.
+        if waiting, ok := peekIdle(conn); ok {
+            return !waiting
+        }
+
+        _ = conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+        n, err := conn.Read(make([]byte, 1))
+
+        return n == 0 && errors.Is(err, os.ErrDeadlineExceeded)
+    }
+
+    timeout := pool.CheckTimeout
+    if timeout <= 0 {
+        timeout = time.Second
+    }
+    _ = conn.SetDeadline(time.Now().Add(timeout))
+
+    pool.mu.Lock()
+    pool.seq++
+    seq := pool.seq
+    pool.mu.Unlock()
+
+    if _, err := conn.Write(pool.Check.Ping(seq)); err != nil {
+        return false
+    }
+
+    // Read until the pong is complete. Anything else means the connection
+    // is out of step.
+    buf := make([]byte, 0, 64)
+    for len(buf) < cap(buf) {
+        n, err := conn.Read(buf[len(buf):cap(buf)])
+        buf = buf[:len(buf) + n]
+
+        if pongSeq, size := pool.Check.ParsePong(buf); size > 0 {
+            return size == len(buf) && pongSeq == seq
+        }
+
+        if err != nil {
+            return false
+        }
+    }
+
+    return false
+}
+
+
+// signal wakes the checkouts waiting for a connection. The caller must hold
+// the pool's lock.
+func (ap *addressPool) signal() {
+    close(ap.released)
+    ap.released = make(chan struct{})
+}
+
+
+// PooledConn is a connection checked out of a ConnPool. Closing it returns
+// it to the pool, unless a read or write failed, since the stream may be out
+// of step, or Discard was called.
+type PooledConn struct {
+    net.Conn
+
+    pool *ConnPool
+    address string
+    broken atomic.Bool
+    once sync.Once
+}
+
+func (c *PooledConn) Read(b []byte) (int, error) {
+    n, err := c.Conn.Read(b)
+    if err != nil {
+        c.broken.Store(true)
+    }
+
+    return n, err
+}
+
+func (c *PooledConn) Write(b []byte) (int, error) {
+    n, err := c.Conn.Write(b)
+    if err != nil {
+        c.broken.Store(true)
+    }
+
+    return n, err
+}
+
+// Close returns the connection to the pool. The connection must not be used
+// afterward.
+func (c *PooledConn) Close() error {
+    c.once.Do(func() {
+        _ = c.Conn.SetDeadline(time.Time{})
+        c.pool.put(c.address, c.Conn, c.broken.Load())
+    })
+
+    return nil
+}
+
+// Discard closes the connection for good instead of returning it.
+func (c *PooledConn) Discard() error {
+    c.broken.Store(true)
+
+    return c.Close()
+}
+
+// CloseWrite half-closes the connection if it supports it. The stream is
+// over then, so the connection is discarded rather than returned.
+func (c *PooledConn) CloseWrite() error {
+    c.broken.Store(true)
+
+    if halfCloser, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+        return halfCloser.CloseWrite()
+    }
+
+    return nil
+}
+
+// NetConn returns the pooled connection.
+func (c *PooledConn) NetConn() net.Conn {
+    return c.Conn
+}
@@ -0,0 +1,12 @@
+//go:build !darwin && !linux
+
+package ch03
+
+import "net"
+
+
+// peekIdle cannot peek at sockets here, so the pool waits briefly for a read
+// instead.
+func peekIdle(net.Conn) (waiting, ok bool) {
+    return false, false
+}
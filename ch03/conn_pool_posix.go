@@ -0,0 +1,44 @@
+//go:build darwin || linux
+
+package ch03
+
+import (
+    "net"
+    "syscall"
+)
+
+
+// peekIdle reports whether anything, data or EOF, waits on an idle
+// connection, by peeking at the socket without blocking. It returns false
+// for ok if conn has no socket to peek at.
+func peekIdle(conn net.Conn) (waiting, ok bool) {
+    if wrapper, isWrapper := conn.(interface{ NetConn() net.Conn }); isWrapper {
+        conn = wrapper.NetConn()
+    }
+
+    sc, isSyscallConn := conn.(syscall.Conn)
+    if !isSyscallConn {
+        return false, false
+    }
+
+    raw, err := sc.SyscallConn()
+    if err != nil {
+        return false, false
+    }
+
+    var peekErr error
+
+    err = raw.Control(func(fd uintptr) {
+        _, _, peekErr = syscall.Recvfrom(int(fd), make([]byte, 1), syscall.MSG_PEEK | syscall.MSG_DONTWAIT)
+    })
+    if err != nil {
+        return false, false
+    }
+
+    if peekErr == syscall.EAGAIN || peekErr == syscall.EWOULDBLOCK {
+        return false, true
+    }
+
+    // Anything else is data, EOF, or an error such as a reset.
+    return true, true
+}
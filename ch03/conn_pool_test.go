@@ -0,0 +1,279 @@
+package ch03
+
+import (
+    "context"
+    "errors"
+    "io"
+    "net"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/bgabor666/gnp/internal/testserver"
+)
+
+
+// echoOnce writes msg on a checked-out connection and reads back the echo.
+func echoOnce(t *testing.T, pool *ConnPool, address, msg string) {
+    conn, err := pool.Get(context.Background(), address)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+
+    if _, err = conn.Write([]byte(msg)); err != nil {
+        t.Fatal(err)
+    }
+
+    buf := make([]byte, len(msg))
+    if _, err = io.ReadFull(conn, buf); err != nil {
+        t.Fatal(err)
+    }
+
+    if string(buf) != msg {
+        t.Fatalf("expected %q; actual %q", msg, buf)
+    }
+}
+
+
+func TestConnPoolReuse(t *testing.T) {
+    server, accepted := testserver.Counting(t, func(c net.Conn) { _, _ = io.Copy(c, c) })
+    address := server.Addr().String()
+
+    pool := &ConnPool{}
+    defer pool.Close()
+
+    for i := 0; i < 5; i++ {
+        echoOnce(t, pool, address, "hello")
+    }
+
+    stats := pool.Stats()
+    if n := atomic.LoadInt32(accepted); n != 1 || stats.Dials != 1 || stats.Reused != 4 {
+        t.Errorf("expected a single connection reused 4 times; accepted %d, stats %+v", n, stats)
+    }
+
+    if stats.Open != 1 || stats.Idle != 1 {
+        t.Errorf("expected 1 open idle connection; actual %+v", stats)
+    }
+}
+
+
+func TestConnPoolMaxOpen(t *testing.T) {
+    server, _ := testserver.Counting(t, func(c net.Conn) { _, _ = io.Copy(c, c) })
+    address := server.Addr().String()
+
+    pool := &ConnPool{MaxOpen: 1}
+    defer pool.Close()
+
+    first, err := pool.Get(context.Background(), address)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+    defer cancel()
+
+    if _, err = pool.Get(ctx, address); !errors.Is(err, context.DeadlineExceeded) {
+        t.Fatalf("expected to wait in vain; actual %v", err)
+    }
+
+    // Returning the first connection hands it to the waiting checkout.
+    got := make(chan *PooledConn)
+    go func() {
+        conn, err := pool.Get(context.Background(), address)
+        if err != nil {
+            t.Error(err)
+        }
+        got <- conn
+    }()
+
+    time.Sleep(20 * time.Millisecond)
+    _ = first.Close()
+
+    second := <-got
+    if second == nil {
+        t.FailNow()
+    }
+    defer second.Close()
+
+    if second.Conn != first.Conn {
+        t.Error("expected the returned connection")
+    }
+
+    if stats := pool.Stats(); stats.Dials != 1 || stats.Waits != 2 {
+        t.Errorf("expected 1 dial and 2 waits; actual %+v", stats)
+    }
+}
+
+
+func TestConnPoolEviction(t *testing.T) {
+    closing := make(chan struct{})
+    server, _ := testserver.Counting(t, func(c net.Conn) {
+        buf := make([]byte, 1024)
+        for {
+            n, err := c.Read(buf)
+            if err != nil {
+                return
+            }
+            if _, err = c.Write(buf[:n]); err != nil {
+                return
+            }
+            if string(buf[:n]) == "bye" {
+                close(closing)
+                return
+            }
+        }
+    })
+    address := server.Addr().String()
+
+    pool := &ConnPool{IdleTimeout: 50 * time.Millisecond}
+    defer pool.Close()
+
+    // The server hangs up on an idle connection, which fails the check.
+    echoOnce(t, pool, address, "bye")
+    <-closing
+    time.Sleep(20 * time.Millisecond)
+    echoOnce(t, pool, address, "hello")
+
+    // The replacement idles past IdleTimeout.
+    time.Sleep(100 * time.Millisecond)
+    echoOnce(t, pool, address, "hello")
+
+    if stats := pool.Stats(); stats.Dials != 3 || stats.FailedChecks != 1 || stats.Evicted != 1 {
+        t.Errorf("expected 3 dials, 1 failed check and 1 eviction; actual %+v", stats)
+    }
+}
+
+
+func TestConnPoolBroken(t *testing.T) {
+    server, _ := testserver.Counting(t, func(c net.Conn) { _, _ = io.Copy(c, c) })
+    address := server.Addr().String()
+
+    pool := &ConnPool{}
+    defer pool.Close()
+
+    conn, err := pool.Get(context.Background(), address)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // A timed-out read may leave a reply in flight, so the connection goes.
+    _ = conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+    if _, err = conn.Read(make([]byte, 1)); err == nil {
+        t.Fatal("expected a timeout")
+    }
+    _ = conn.Close()
+
+    if stats := pool.Stats(); stats.Open != 0 || stats.Idle != 0 {
+        t.Errorf("expected no open connections; actual %+v", stats)
+    }
+}
+
+
+func TestConnPoolHeartbeatCheck(t *testing.T) {
+    // The server answers heartbeats and echoes everything else.
+    answering, _ := testserver.Counting(t, func(c net.Conn) {
+        tracker := &PingTracker{Format: TLVPingFormat{}}
+        buf := make([]byte, 1024)
+        for {
+            n, err := c.Read(buf)
+            if err != nil {
+                return
+            }
+
+            replies, handled := tracker.Receive(buf[:n])
+            replies = append(replies, buf[handled:n]...)
+            if _, err = c.Write(replies); err != nil {
+                return
+            }
+        }
+    })
+
+    // This one ignores heartbeats.
+    silent, _ := testserver.Counting(t, func(c net.Conn) { _, _ = io.Copy(io.Discard, c) })
+
+    pool := &ConnPool{Check: TLVPingFormat{}, CheckTimeout: 50 * time.Millisecond}
+    defer pool.Close()
+
+    for i := 0; i < 3; i++ {
+        echoOnce(t, pool, answering.Addr().String(), "hello")
+    }
+
+    if stats := pool.Stats(); stats.Dials != 1 || stats.FailedChecks != 0 {
+        t.Errorf("expected the connection to pass its checks; actual %+v", stats)
+    }
+
+    for i := 0; i < 2; i++ {
+        conn, err := pool.Get(context.Background(), silent.Addr().String())
+        if err != nil {
+            t.Fatal(err)
+        }
+        _ = conn.Close()
+    }
+
+    if stats := pool.Stats(); stats.Dials != 3 || stats.FailedChecks != 1 {
+        t.Errorf("expected the silent connection to fail its check; actual %+v", stats)
+    }
+}
+
+
+func TestConnPoolReaper(t *testing.T) {
+    hungUp := make(chan struct{})
+    server, _ := testserver.Counting(t, func(c net.Conn) {
+        _, _ = io.Copy(c, c)
+        close(hungUp)
+    })
+    address := server.Addr().String()
+
+    pool := &ConnPool{IdleTimeout: 50 * time.Millisecond}
+    defer pool.Close()
+
+    echoOnce(t, pool, address, "hello")
+
+    // The idle connection closes without another checkout.
+    select {
+    case <-hungUp:
+    case <-time.After(time.Second):
+        t.Fatal("expected the idle connection to be reaped")
+    }
+
+    if stats := pool.Stats(); stats.Open != 0 || stats.Idle != 0 || stats.Evicted != 1 {
+        t.Errorf("expected 1 eviction and no open connections; actual %+v", stats)
+    }
+}
+
+
+func TestPeekIdle(t *testing.T) {
+    server, _ := testserver.Counting(t, func(c net.Conn) { _, _ = io.Copy(c, c) })
+
+    conn, err := net.Dial("tcp", server.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+
+    waiting, ok := peekIdle(conn)
+    if !ok {
+        t.Skip("sockets cannot be peeked at here")
+    }
+    if waiting {
+        t.Fatal("expected nothing waiting on a quiet connection")
+    }
+
+    // An echo waits unread, and peeking leaves it there.
+    if _, err = conn.Write([]byte("x")); err != nil {
+        t.Fatal(err)
+    }
+    for deadline := time.Now().Add(time.Second); !waiting && time.Now().Before(deadline); {
+        time.Sleep(time.Millisecond)
+        waiting, _ = peekIdle(conn)
+    }
+    if !waiting {
+        t.Fatal("expected the echo to be waiting")
+    }
+
+    buf := make([]byte, 1)
+    if _, err = io.ReadFull(conn, buf); err != nil || buf[0] != 'x' {
+        t.Errorf("expected to read the echo; actual %q, %v", buf, err)
+    }
+}
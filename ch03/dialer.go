@@ -0,0 +1,306 @@
+package ch03
+
+import (
+    "context"
+    "fmt"
+    "net"
+    "strings"
+    "time"
+)
+
+
+// Defaults recommended by RFC 8305.
+const (
+    defaultResolutionDelay = 50 * time.Millisecond
+    defaultAttemptDelay = 250 * time.Millisecond
+)
+
+
+// Dialer connects to a host name the happy eyeballs way (RFC 8305): it
+// resolves both A and AAAA records, interleaves the addresses starting with
+// IPv6, and races connections to them, starting the next attempt whenever the
+// previous one fails or AttemptDelay passes. The first connection wins and
+// the other attempts are canceled.
+type Dialer struct {
+    Base net.Dialer // dials every attempt; its Timeout applies per attempt
+    ResolutionDelay time.Duration // how long to wait for AAAA records once A records arrive; 0 means 50ms
+    AttemptDelay time.Duration // the head start of each attempt over the next; 0 means 250ms
+
+    // LookupIP, if set, replaces net.DefaultResolver.LookupIP.
+    LookupIP func(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+
+// Attempt is one connection attempt of a Dialer.
+type Attempt struct {
+    Address string
+    Start time.Duration // since the dial began
+    Err error // nil for the winner
+}
+
+
+// DialReport tells which address a Dialer connected to and how every attempt
+// went, in the order they started.
+type DialReport struct {
+    Winner string
+    Attempts []Attempt
+}
+
+
+// DialedConn is the connection a Dialer returns, along with the report of
+// how it came about.
+type DialedConn struct {
+    net.Conn
+    Report DialReport
+}
+
+// NetConn returns the connection the winning attempt dialed.
+func (c *DialedConn) NetConn() net.Conn {
+    return c.Conn
+}
+
+// CloseWrite half-closes the connection if it supports it.
+func (c *DialedConn) CloseWrite() error {
+    if halfCloser, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+        return halfCloser.CloseWrite()
+    }
+
+    return nil
+}
+
+
+// DialError is returned when every attempt failed. Its attempts are those of
+// the report.
+type DialError struct {
+    Attempts []Attempt
+}
+
+func (err *DialError) Error() string {
+    messages := make([]string, 0, len(err.Attempts))
+    for _, attempt := range err.Attempts {
+        messages = append(messages, attempt.Err.Error())
+    }
+
+    return fmt.Sprintf("all %d attempts failed: %s", len(err.Attempts), strings.Join(messages, "; "))
+}
+
+// Unwrap returns the error of every attempt, for errors.Is and errors.As.
+func (err *DialError) Unwrap() []error {
+    errs := make([]error, 0, len(err.Attempts))
+    for _, attempt := range err.Attempts {
+        errs = append(errs, attempt.Err)
+    }
+
+    return errs
+}
+
+
+// DialContext connects to address on the tcp, tcp4 or tcp6 network, like
+// net.Dialer's, so it fits wherever one does. The connection is a *DialedConn
+// carrying the report. If every attempt failed, the error is a *DialError.
+func (dialer Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+    var report DialReport
+
+    host, port, err := net.SplitHostPort(address)
+    if err != nil {
+        return nil, err
+    }
+
+    ips, err := dialer.resolve(ctx, network, host)
+    if err != nil {
+        return nil, err
+    }
+
+    attemptDelay := dialer.AttemptDelay
+    if attemptDelay <= 0 {
+        attemptDelay = defaultAttemptDelay
+    }
+
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+
+    type result struct {
+        attempt int
+        connection net.Conn
+        err error
+    }
+
+    // Buffered so attempts never block on a dial that already returned.
+    results := make(chan result, len(ips))
+    start := time.Now()
+    pending := 0
+
+    var nextAttempt <-chan time.Time
+
+    launch := func() {
+        i := len(report.Attempts)
+        address := net.JoinHostPort(ips[i].String(), port)
+
+        report.Attempts = append(report.Attempts, Attempt{Address: address, Start: time.Since(start)})
+        pending++
+
+        go func() {
+            connection, err := dialer.Base.DialContext(ctx, network, address)
+            results <- result{attempt: i, connection: connection, err: err}
+        }()
+
+        nextAttempt = nil
+        if len(report.Attempts) < len(ips) {
+            nextAttempt = time.After(attemptDelay)
+        }
+    }
+
+    launch()
+
+    var (
+        winner net.Conn
+        won int
+    )
+
+    for winner == nil && pending > 0 {
+        select {
+        case <-nextAttempt:
+            launch()
+        case r := <-results:
+            pending--
+            report.Attempts[r.attempt].Err = r.err
+
+            if r.err == nil {
+                winner, won = r.connection, r.attempt
+                report.Winner = report.Attempts[r.attempt].Address
+                break
+            }
+
+            // Don't wait out the delay after a failure.
+            if ctx.Err() == nil && len(report.Attempts) < len(ips) {
+                launch()
+            }
+        }
+    }
+
+    if winner == nil {
+        return nil, &DialError{Attempts: report.Attempts}
+    }
+
+    // The deferred cancel stops the attempts still in flight, and any that
+    // connect anyway are closed.
+    for i := range report.Attempts {
+        if i != won && report.Attempts[i].Err == nil {
+            report.Attempts[i].Err = context.Canceled
+        }
+    }
+
+    go func(pending int) {
+        for ; pending > 0; pending-- {
+            if r := <-results; r.connection != nil {
+                _ = r.connection.Close()
+            }
+        }
+    }(pending)
+
+    return &DialedConn{Conn: winner, Report: report}, nil
+}
+
+
+// resolve returns the addresses of host in the order to try them.
+func (dialer Dialer) resolve(ctx context.Context, network, host string) ([]net.IP, error) {
+    if ip := net.ParseIP(host); ip != nil {
+        return []net.IP{ip}, nil
+    }
+
+    var families []string
+
+    switch network {
+    case "tcp":
+        families = []string{"ip6", "ip4"}
+    case "tcp4":
+        families = []string{"ip4"}
+    case "tcp6":
+        families = []string{"ip6"}
+    default:
+        return nil, net.UnknownNetworkError(network)
+    }
+
+    lookupIP := dialer.LookupIP
+    if lookupIP == nil {
+        lookupIP = net.DefaultResolver.LookupIP
+    }
+
+    resolutionDelay := dialer.ResolutionDelay
+    if resolutionDelay <= 0 {
+        resolutionDelay = defaultResolutionDelay
+    }
+
+    type lookup struct {
+        family string
+        ips []net.IP
+        err error
+    }
+
+    // Buffered so a lookup we stop waiting for can still finish.
+    lookups := make(chan lookup, len(families))
+
+    for _, family := range families {
+        go func(family string) {
+            ips, err := lookupIP(ctx, family, host)
+            lookups <- lookup{family: family, ips: ips, err: err}
+        }(family)
+    }
+
+    var (
+        v6, v4 []net.IP
+        errs []error
+        // Fires once A records arrive while AAAA records are outstanding.
+        resolutionTimeout <-chan time.Time
+    )
+
+WAIT:
+    for remaining := len(families); remaining > 0; remaining-- {
+        select {
+        case l := <-lookups:
+            if l.err != nil {
+                errs = append(errs, l.err)
+                continue
+            }
+
+            if l.family == "ip6" {
+                v6 = l.ips
+            } else {
+                v4 = l.ips
+                if remaining > 1 {
+                    resolutionTimeout = time.After(resolutionDelay)
+                }
+            }
+        case <-resolutionTimeout:
+            break WAIT
+        }
+    }
+
+    ips := interleave(v6, v4)
+    if len(ips) == 0 {
+        if len(errs) > 0 {
+            return nil, errs[0]
+        }
+
+        return nil, &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+    }
+
+    return ips, nil
+}
+
+
+// interleave alternates IPv6 and IPv4 addresses, starting with IPv6.
+func interleave(v6, v4 []net.IP) []net.IP {
+    ips := make([]net.IP, 0, len(v6) + len(v4))
+
+    for i := 0; i < len(v6) || i < len(v4); i++ {
+        if i < len(v6) {
+            ips = append(ips, v6[i])
+        }
+        if i < len(v4) {
+            ips = append(ips, v4[i])
+        }
+    }
+
+    return ips
+}
@@ -0,0 +1,180 @@
+package ch03
+
+import (
+    "context"
+    "errors"
+    "net"
+    "reflect"
+    "strings"
+    "syscall"
+    "testing"
+    "time"
+
+    "github.com/bgabor666/gnp/internal/testserver"
+)
+
+
+// staticLookup resolves every host to the given addresses per family, after
+// the given delays.
+func staticLookup(addresses map[string][]string, delays map[string]time.Duration) func(context.Context, string, string) ([]net.IP, error) {
+    return func(ctx context.Context, family, host string) ([]net.IP, error) {
+        select {
+        case <-ctx.Done():
+            return nil, ctx.Err()
+        case <-time.After(delays[family]):
+        }
+
+        var ips []net.IP
+        for _, address := range addresses[family] {
+            ips = append(ips, net.ParseIP(address))
+        }
+
+        if len(ips) == 0 {
+            return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+        }
+
+        return ips, nil
+    }
+}
+
+
+func TestInterleave(t *testing.T) {
+    parse := func(addresses ...string) []net.IP {
+        var ips []net.IP
+        for _, address := range addresses {
+            ips = append(ips, net.ParseIP(address))
+        }
+        return ips
+    }
+
+    actual := interleave(parse("::1", "::2", "::3"), parse("10.0.0.1"))
+    expected := parse("::1", "10.0.0.1", "::2", "::3")
+
+    if !reflect.DeepEqual(expected, actual) {
+        t.Errorf("expected %v; actual %v", expected, actual)
+    }
+}
+
+
+func TestDialerStaggered(t *testing.T) {
+    listener, _ := testserver.Counting(t, func(net.Conn) {})
+
+    _, port, _ := net.SplitHostPort(listener.Addr().String())
+
+    dialer := Dialer{
+        Base: net.Dialer{
+            // Stall the first address, as if its SYN went unanswered.
+            Control: func(_, address string, _ syscall.RawConn) error {
+                if strings.HasPrefix(address, "127.0.0.2:") {
+                    time.Sleep(200 * time.Millisecond)
+                    return errors.New("stalled")
+                }
+                return nil
+            },
+        },
+        AttemptDelay: 50 * time.Millisecond,
+        LookupIP: staticLookup(map[string][]string{"ip4": {"127.0.0.2", "127.0.0.1"}}, nil),
+    }
+
+    begin := time.Now()
+    connection, err := dialer.DialContext(context.Background(), "tcp", net.JoinHostPort("example", port))
+    if err != nil {
+        t.Fatal(err)
+    }
+    _ = connection.Close()
+
+    report := connection.(*DialedConn).Report
+
+    t.Logf("%+v", report)
+
+    if expected := net.JoinHostPort("127.0.0.1", port); report.Winner != expected {
+        t.Errorf("expected winner %s; actual %s", expected, report.Winner)
+    }
+
+    if len(report.Attempts) != 2 || report.Attempts[0].Err == nil || report.Attempts[1].Err != nil {
+        t.Fatalf("unexpected attempts: %+v", report.Attempts)
+    }
+
+    if start := report.Attempts[1].Start; start < 50 * time.Millisecond || start >= 200 * time.Millisecond {
+        t.Errorf("expected the second attempt to start after the attempt delay; actual %s", start)
+    }
+
+    if elapsed := time.Since(begin); elapsed >= 200 * time.Millisecond {
+        t.Errorf("expected the dial to return without waiting for the stalled attempt; took %s", elapsed)
+    }
+}
+
+
+func TestDialerFailFast(t *testing.T) {
+    // Grab two ports nothing listens on.
+    var addresses []string
+    for i := 0; i < 2; i++ {
+        listener, err := net.Listen("tcp", "127.0.0.1:")
+        if err != nil {
+            t.Fatal(err)
+        }
+        addresses = append(addresses, listener.Addr().String())
+        _ = listener.Close()
+    }
+
+    dialer := Dialer{AttemptDelay: time.Hour}
+
+    begin := time.Now()
+    _, err := dialer.DialContext(context.Background(), "tcp", addresses[0])
+    if err == nil {
+        t.Fatal("expected an error")
+    }
+
+    var dialErr *DialError
+    if !errors.As(err, &dialErr) || len(dialErr.Attempts) != 1 {
+        t.Fatalf("unexpected error: %v", err)
+    }
+
+    if !errors.Is(err, syscall.ECONNREFUSED) {
+        t.Errorf("expected a refused connection; actual %v", err)
+    }
+
+    // With two addresses, a refused attempt starts the next one at once.
+    _, port, _ := net.SplitHostPort(addresses[1])
+    dialer.LookupIP = staticLookup(map[string][]string{"ip6": {"::1"}, "ip4": {"127.0.0.1"}}, nil)
+
+    _, err = dialer.DialContext(context.Background(), "tcp", net.JoinHostPort("example", port))
+    if !errors.As(err, &dialErr) || len(dialErr.Attempts) != 2 {
+        t.Fatalf("expected two failed attempts; actual: %v", err)
+    }
+
+    if elapsed := time.Since(begin); elapsed > time.Second {
+        t.Errorf("expected failures to skip the attempt delay; took %s", elapsed)
+    }
+}
+
+
+func TestDialerResolutionDelay(t *testing.T) {
+    dialer := Dialer{
+        ResolutionDelay: 20 * time.Millisecond,
+        LookupIP: staticLookup(
+            map[string][]string{"ip6": {"::1"}, "ip4": {"127.0.0.1"}},
+            map[string]time.Duration{"ip6": 300 * time.Millisecond},
+        ),
+    }
+
+    begin := time.Now()
+    ips, err := dialer.resolve(context.Background(), "tcp", "example")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // The slow AAAA answer is not worth waiting for.
+    if len(ips) != 1 || !ips[0].Equal(net.ParseIP("127.0.0.1")) {
+        t.Errorf("expected only 127.0.0.1; actual %v", ips)
+    }
+
+    if elapsed := time.Since(begin); elapsed >= 300 * time.Millisecond {
+        t.Errorf("waited %s for AAAA records", elapsed)
+    }
+
+    ips, err = dialer.resolve(context.Background(), "tcp6", "example")
+    if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("::1")) {
+        t.Errorf("expected only ::1; actual %v: %v", ips, err)
+    }
+}
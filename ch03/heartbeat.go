@@ -0,0 +1,358 @@
+package ch03
+
+import (
+    "bufio"
+    "context"
+    "encoding/binary"
+    "net"
+    "sync"
+    "time"
+)
+
+
+// Heartbeat connection structure, repeated for every message
+//
+// # 1 byte # 2 bytes # n bytes #
+// #############################
+// # Kind   # Size    # Body    #
+// #############################
+//
+// Data messages carry what the application wrote, and heartbeat messages a
+// ping or pong in the Heartbeat's format, so application data can never be
+// mistaken for a heartbeat.
+
+const (
+    heartbeatData byte = iota + 1
+    heartbeatPing // a ping or a pong
+
+    heartbeatHeaderSize = 3
+    maxHeartbeatBody = 1 << 16 - 1
+)
+
+
+// Liveness is what a HeartbeatConn believes about its peer.
+type Liveness uint8
+
+const (
+    Alive Liveness = iota
+    Suspect // missed at least one heartbeat
+    Dead // missed MaxMissed heartbeats in a row; the connection is closed
+)
+
+func (liveness Liveness) String() string {
+    switch liveness {
+    case Alive:
+        return "alive"
+    case Suspect:
+        return "suspect"
+    default:
+        return "dead"
+    }
+}
+
+
+// Heartbeat configures the heartbeat of connections it wraps. While a
+// connection is idle, a PingTracker pings every Interval, and the peer must
+// send something within Timeout of each ping. Any traffic counts, not just
+// the pong.
+type Heartbeat struct {
+    Interval time.Duration // the idle time before a ping; 0 means 30 seconds
+    Timeout time.Duration // the time to wait for traffic after a ping; 0 means Interval
+    MaxMissed int // consecutive missed heartbeats before closing; 0 means 3
+    Format PingFormat // the encoding of pings and pongs; nil means LiteralPingFormat
+
+    // Adapt, if set, picks the next ping interval from the measured round
+    // trip times. See PingTracker.
+    Adapt func(stats RTTStats) time.Duration
+
+    // OnChange, if set, is called whenever the peer's liveness changes. It
+    // runs with the connection's state locked, so it must not block or call
+    // Liveness.
+    OnChange func(liveness Liveness)
+}
+
+
+// HeartbeatConn is a net.Conn kept alive by a Heartbeat. It frames whatever
+// goes over the connection, so both peers must use one. Incoming traffic
+// only counts once read, so keep reading from it. Heartbeat messages are
+// handled by Read: it answers pings, times pongs, and hides both.
+type HeartbeatConn struct {
+    net.Conn
+
+    heartbeat Heartbeat
+    tracker *PingTracker
+    ctx context.Context
+    cancel context.CancelFunc
+    reset chan time.Duration
+
+    readMu sync.Mutex // one Read at a time
+    reader *bufio.Reader
+    unread []byte // the rest of the last data message
+
+    writeMu sync.Mutex // one message at a time
+
+    mu sync.Mutex
+    liveness Liveness
+    missed int
+    lastTraffic time.Time
+    readDeadline time.Time // the caller's
+}
+
+
+// Wrap starts the heartbeat of conn. It stops when ctx is canceled, the
+// connection is closed, or the peer is declared dead.
+func (heartbeat Heartbeat) Wrap(ctx context.Context, conn net.Conn) *HeartbeatConn {
+    if heartbeat.Interval <= 0 {
+        heartbeat.Interval = defaultPingInterval
+    }
+    if heartbeat.Timeout <= 0 {
+        heartbeat.Timeout = heartbeat.Interval
+    }
+    if heartbeat.MaxMissed <= 0 {
+        heartbeat.MaxMissed = 3
+    }
+
+    ctx, cancel := context.WithCancel(ctx)
+
+    c := &HeartbeatConn{
+        Conn: conn,
+        heartbeat: heartbeat,
+        tracker: &PingTracker{Format: heartbeat.Format, Adapt: heartbeat.Adapt},
+        ctx: ctx,
+        cancel: cancel,
+        reset: make(chan time.Duration, 1),
+        reader: bufio.NewReaderSize(conn, heartbeatHeaderSize + maxHeartbeatBody),
+        lastTraffic: time.Now(),
+    }
+
+    _ = c.extendDeadline()
+
+    c.reset <- heartbeat.Interval
+    go c.tracker.Run(ctx, pingWriter{c}, c.reset)
+
+    return c
+}
+
+
+// Read returns the data the peer wrote, handling the heartbeat messages in
+// between, and records any traffic as a sign of life.
+func (c *HeartbeatConn) Read(b []byte) (int, error) {
+    c.readMu.Lock()
+    defer c.readMu.Unlock()
+
+    for len(c.unread) == 0 {
+        kind, body, err := c.readMessage()
+        if err != nil {
+            return 0, err
+        }
+
+        c.traffic()
+
+        if kind == heartbeatData {
+            c.unread = body
+            continue
+        }
+
+        if replies, _ := c.tracker.Receive(body); len(replies) > 0 {
+            _ = c.writeMessage(heartbeatPing, replies)
+        }
+    }
+
+    n := copy(b, c.unread)
+    c.unread = c.unread[n:]
+
+    return n, nil
+}
+
+// Write sends b as one or more data messages. Heartbeats never land in the
+// middle of one.
+func (c *HeartbeatConn) Write(b []byte) (int, error) {
+    written := 0
+
+    for len(b) > 0 {
+        size := min(len(b), maxHeartbeatBody)
+
+        if err := c.writeMessage(heartbeatData, b[:size]); err != nil {
+            return written, err
+        }
+
+        written += size
+        b = b[size:]
+    }
+
+    return written, nil
+}
+
+func (c *HeartbeatConn) SetDeadline(t time.Time) error {
+    if err := c.Conn.SetWriteDeadline(t); err != nil {
+        return err
+    }
+
+    return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the caller's read deadline. The heartbeat keeps its own
+// deadline for stalled connections, and reads time out at the earlier one.
+func (c *HeartbeatConn) SetReadDeadline(t time.Time) error {
+    c.mu.Lock()
+    c.readDeadline = t
+    c.mu.Unlock()
+
+    return c.extendDeadline()
+}
+
+// Close stops the heartbeat and closes the connection.
+func (c *HeartbeatConn) Close() error {
+    c.cancel()
+
+    return c.Conn.Close()
+}
+
+// Stats returns the round trip times of the heartbeats so far.
+func (c *HeartbeatConn) Stats() RTTStats {
+    return c.tracker.Stats()
+}
+
+// Liveness returns what the heartbeat currently believes about the peer.
+func (c *HeartbeatConn) Liveness() Liveness {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    return c.liveness
+}
+
+func (c *HeartbeatConn) traffic() {
+    c.mu.Lock()
+    c.lastTraffic = time.Now()
+    c.missed = 0
+    if c.liveness == Suspect {
+        c.change(Alive)
+    }
+    c.mu.Unlock()
+
+    _ = c.extendDeadline()
+
+    // No need to ping while the peer is talking.
+    select {
+    case c.reset <- 0:
+    default:
+    }
+}
+
+// extendDeadline lets reads block until the peer has missed every heartbeat,
+// in case the connection stalls before the missed pongs close it, or until
+// the caller's read deadline if that comes first.
+func (c *HeartbeatConn) extendDeadline() error {
+    heartbeat := c.heartbeat
+    window := time.Duration(heartbeat.MaxMissed) * (heartbeat.Interval + heartbeat.Timeout)
+    deadline := time.Now().Add(window)
+
+    c.mu.Lock()
+    if !c.readDeadline.IsZero() && c.readDeadline.Before(deadline) {
+        deadline = c.readDeadline
+    }
+    c.mu.Unlock()
+
+    return c.Conn.SetReadDeadline(deadline)
+}
+
+// readMessage returns the next complete message. A message is only consumed
+// once all of it arrived, so a read that times out partway leaves the stream
+// in step.
+func (c *HeartbeatConn) readMessage() (byte, []byte, error) {
+    header, err := c.reader.Peek(heartbeatHeaderSize)
+    if err != nil {
+        return 0, nil, err
+    }
+
+    size := heartbeatHeaderSize + int(binary.BigEndian.Uint16(header[1:]))
+
+    message, err := c.reader.Peek(size)
+    if err != nil {
+        return 0, nil, err
+    }
+
+    kind, body := message[0], append([]byte(nil), message[heartbeatHeaderSize:]...)
+    _, _ = c.reader.Discard(size)
+
+    return kind, body, nil
+}
+
+func (c *HeartbeatConn) writeMessage(kind byte, body []byte) error {
+    message := make([]byte, heartbeatHeaderSize, heartbeatHeaderSize + len(body))
+    message[0] = kind
+    binary.BigEndian.PutUint16(message[1:], uint16(len(body)))
+    message = append(message, body...)
+
+    c.writeMu.Lock()
+    defer c.writeMu.Unlock()
+
+    _, err := c.Conn.Write(message)
+
+    return err
+}
+
+// check counts a missed heartbeat if nothing arrived since the ping sent at
+// sent.
+func (c *HeartbeatConn) check(sent time.Time) {
+    if c.ctx.Err() != nil {
+        return
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if c.liveness == Dead || c.lastTraffic.After(sent) {
+        return
+    }
+
+    c.missed++
+
+    switch {
+    case c.missed >= c.heartbeat.MaxMissed:
+        c.die()
+    case c.liveness == Alive:
+        c.change(Suspect)
+    }
+}
+
+// die closes the connection. The caller must hold c.mu.
+func (c *HeartbeatConn) die() {
+    c.change(Dead)
+    _ = c.Close()
+}
+
+// change records and reports the new liveness. The caller must hold c.mu.
+func (c *HeartbeatConn) change(liveness Liveness) {
+    c.liveness = liveness
+
+    if c.heartbeat.OnChange != nil {
+        c.heartbeat.OnChange(liveness)
+    }
+}
+
+
+// pingWriter is what the Pinger writes to. It schedules a check for each
+// ping and gives up on the peer if a ping cannot be written.
+type pingWriter struct {
+    c *HeartbeatConn
+}
+
+func (writer pingWriter) Write(p []byte) (int, error) {
+    sent := time.Now()
+
+    err := writer.c.writeMessage(heartbeatPing, p)
+    if err != nil {
+        writer.c.mu.Lock()
+        if writer.c.liveness != Dead && writer.c.ctx.Err() == nil {
+            writer.c.die()
+        }
+        writer.c.mu.Unlock()
+
+        return 0, err
+    }
+
+    time.AfterFunc(writer.c.heartbeat.Timeout, func() { writer.c.check(sent) })
+
+    return len(p), nil
+}
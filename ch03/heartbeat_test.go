@@ -0,0 +1,236 @@
+package ch03
+
+import (
+    "context"
+    "errors"
+    "io"
+    "net"
+    "testing"
+    "time"
+)
+
+
+// connPair returns both ends of a TCP connection.
+func connPair(t *testing.T) (net.Conn, net.Conn) {
+    listener, err := net.Listen("tcp", "127.0.0.1:")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer listener.Close()
+
+    client, err := net.Dial("tcp", listener.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    server, err := listener.Accept()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    t.Cleanup(func() {
+        _ = client.Close()
+        _ = server.Close()
+    })
+
+    return client, server
+}
+
+
+func TestHeartbeatAlive(t *testing.T) {
+    client, server := connPair(t)
+
+    changes := make(chan Liveness, 10)
+    heartbeat := Heartbeat{
+        Interval: 50 * time.Millisecond,
+        MaxMissed: 2,
+        OnChange: func(liveness Liveness) { changes <- liveness },
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    // Both sides ping and answer each other's pings while idle.
+    for _, conn := range []net.Conn{client, server} {
+        c := heartbeat.Wrap(ctx, conn)
+        go func() { _, _ = io.Copy(io.Discard, c) }()
+    }
+
+    time.Sleep(500 * time.Millisecond)
+
+    select {
+    case liveness := <-changes:
+        t.Fatalf("unexpected change to %s", liveness)
+    default:
+    }
+}
+
+
+func TestHeartbeatDead(t *testing.T) {
+    _, server := connPair(t)
+
+    changes := make(chan Liveness, 10)
+    heartbeat := Heartbeat{
+        Interval: 50 * time.Millisecond,
+        MaxMissed: 3,
+        OnChange: func(liveness Liveness) { changes <- liveness },
+    }
+
+    begin := time.Now()
+    c := heartbeat.Wrap(context.Background(), server)
+
+    // The client never answers, so Read fails once the heartbeat gives up.
+    _, err := c.Read(make([]byte, 1024))
+    if err == nil {
+        t.Fatal("expected an error")
+    }
+    t.Logf("dead after %s: %v", time.Since(begin).Round(10 * time.Millisecond), err)
+
+    for _, expected := range []Liveness{Suspect, Dead} {
+        if actual := <-changes; actual != expected {
+            t.Errorf("expected %s; actual %s", expected, actual)
+        }
+    }
+
+    if c.Liveness() != Dead {
+        t.Errorf("expected %s; actual %s", Dead, c.Liveness())
+    }
+}
+
+
+func TestHeartbeatTraffic(t *testing.T) {
+    client, server := connPair(t)
+
+    heartbeat := Heartbeat{Interval: 50 * time.Millisecond, MaxMissed: 1}
+    c := heartbeat.Wrap(context.Background(), server)
+    defer c.Close()
+
+    // The client frames its data but never reads, so it never pongs.
+    client = Heartbeat{Interval: time.Hour}.Wrap(context.Background(), client)
+
+    // Data keeps the connection alive without any pongs.
+    go func() {
+        for i := 0; i < 10; i++ {
+            if _, err := client.Write([]byte("data")); err != nil {
+                return
+            }
+            time.Sleep(30 * time.Millisecond)
+        }
+    }()
+
+    buf := make([]byte, 4)
+    for i := 0; i < 10; i++ {
+        _, err := io.ReadFull(c, buf)
+        if err != nil {
+            t.Fatalf("%d: %v", i, err)
+        }
+
+        if string(buf) != "data" {
+            t.Fatalf("%d: expected %q; actual %q", i, "data", buf)
+        }
+    }
+}
+
+
+func TestHeartbeatDataLooksLikePing(t *testing.T) {
+    client, server := connPair(t)
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    heartbeat := Heartbeat{Interval: 20 * time.Millisecond}
+    c, s := heartbeat.Wrap(ctx, client), heartbeat.Wrap(ctx, server)
+    go func() { _, _ = io.Copy(io.Discard, c) }()
+
+    // Heartbeats go both ways while the data does.
+    for i := 0; i < 5; i++ {
+        time.Sleep(30 * time.Millisecond)
+
+        if _, err := c.Write([]byte("pingpong")); err != nil {
+            t.Fatal(err)
+        }
+
+        buf := make([]byte, 8)
+        if _, err := io.ReadFull(s, buf); err != nil {
+            t.Fatal(err)
+        }
+        if string(buf) != "pingpong" {
+            t.Fatalf("%d: expected %q; actual %q", i, "pingpong", buf)
+        }
+    }
+
+    if stats := s.Stats(); stats.Count == 0 {
+        t.Errorf("expected pongs alongside the data; actual %+v", stats)
+    }
+}
+
+
+func TestHeartbeatConcurrentWrites(t *testing.T) {
+    client, server := connPair(t)
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    // Ping as often as possible while the client writes.
+    heartbeat := Heartbeat{Interval: time.Millisecond, Timeout: time.Second}
+    c, s := heartbeat.Wrap(ctx, client), heartbeat.Wrap(ctx, server)
+    go func() { _, _ = io.Copy(io.Discard, c) }()
+
+    expected := make([]byte, 0, 3000)
+    done := make(chan error, 1)
+    go func() {
+        for i := 0; i < 1000; i++ {
+            // Three writes per message, like a ch04 frame.
+            for _, part := range [][]byte{{'<'}, {byte('a' + i % 26)}, {'>'}} {
+                if _, err := c.Write(part); err != nil {
+                    done <- err
+                    return
+                }
+            }
+            time.Sleep(50 * time.Microsecond)
+        }
+        done <- nil
+    }()
+    for i := 0; i < 1000; i++ {
+        expected = append(expected, '<', byte('a' + i % 26), '>')
+    }
+
+    actual := make([]byte, len(expected))
+    if _, err := io.ReadFull(s, actual); err != nil {
+        t.Fatal(err)
+    }
+    if err := <-done; err != nil {
+        t.Fatal(err)
+    }
+
+    if string(actual) != string(expected) {
+        t.Error("heartbeats interleaved with the data")
+    }
+    if stats := c.Stats(); stats.Count == 0 {
+        t.Errorf("expected heartbeats alongside the data; actual %+v", stats)
+    }
+}
+
+
+func TestHeartbeatReadDeadline(t *testing.T) {
+    _, server := connPair(t)
+
+    heartbeat := Heartbeat{Interval: time.Second}
+    c := heartbeat.Wrap(context.Background(), server)
+    defer c.Close()
+
+    _ = c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+    start := time.Now()
+    _, err := c.Read(make([]byte, 1))
+
+    var netErr net.Error
+    if !errors.As(err, &netErr) || !netErr.Timeout() {
+        t.Fatalf("expected a timeout; actual: %v", err)
+    }
+
+    // The heartbeat's own deadline is seconds away.
+    if elapsed := time.Since(start); elapsed > 500 * time.Millisecond {
+        t.Errorf("expected the caller's deadline to hold; took %s", elapsed)
+    }
+}
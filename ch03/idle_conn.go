@@ -0,0 +1,174 @@
+package ch03
+
+import (
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "sync"
+    "time"
+)
+
+
+var (
+    ErrIdleTimeout = errors.New("idle timeout")
+    ErrLifetimeExceeded = errors.New("connection lifetime exceeded")
+)
+
+
+// IdleTimeout configures the deadlines of connections it wraps, so nobody has
+// to push them forward by hand after every read and write.
+type IdleTimeout struct {
+    Read time.Duration // the longest a Read may wait; 0 means no limit
+    Write time.Duration // the longest a Write may block; 0 means no limit
+    Lifetime time.Duration // the longest the connection may stay open; 0 means no limit
+}
+
+
+// IdleConn is a net.Conn whose deadlines roll forward with every Read and
+// Write. When a read or write window, or the lifetime, runs out, it closes
+// the connection and returns an error wrapping ErrIdleTimeout or
+// ErrLifetimeExceeded, as well as os.ErrDeadlineExceeded. Deadlines set on it
+// still apply, and time out as usual.
+type IdleConn struct {
+    net.Conn
+
+    timeout IdleTimeout
+    expires time.Time // zero without a lifetime
+
+    mu sync.Mutex
+    readDeadline, writeDeadline time.Time // set by the caller
+    readIdle, writeIdle time.Time // the current idle deadlines
+}
+
+
+// Wrap applies the timeouts to conn. The lifetime starts now.
+func (timeout IdleTimeout) Wrap(conn net.Conn) *IdleConn {
+    c := &IdleConn{Conn: conn, timeout: timeout}
+
+    if timeout.Lifetime > 0 {
+        c.expires = time.Now().Add(timeout.Lifetime)
+        _ = conn.SetDeadline(c.expires)
+    }
+
+    return c
+}
+
+
+func (c *IdleConn) Read(b []byte) (int, error) {
+    c.mu.Lock()
+    if c.timeout.Read > 0 {
+        c.readIdle = time.Now().Add(c.timeout.Read)
+    }
+    err := c.Conn.SetReadDeadline(earliest(c.readDeadline, c.readIdle, c.expires))
+    c.mu.Unlock()
+
+    if err != nil {
+        return 0, err
+    }
+
+    n, err := c.Conn.Read(b)
+
+    return n, c.check(err, &c.readDeadline)
+}
+
+func (c *IdleConn) Write(b []byte) (int, error) {
+    c.mu.Lock()
+    if c.timeout.Write > 0 {
+        c.writeIdle = time.Now().Add(c.timeout.Write)
+    }
+    err := c.Conn.SetWriteDeadline(earliest(c.writeDeadline, c.writeIdle, c.expires))
+    c.mu.Unlock()
+
+    if err != nil {
+        return 0, err
+    }
+
+    n, err := c.Conn.Write(b)
+
+    return n, c.check(err, &c.writeDeadline)
+}
+
+func (c *IdleConn) SetDeadline(t time.Time) error {
+    err := c.SetReadDeadline(t)
+    if err != nil {
+        return err
+    }
+
+    return c.SetWriteDeadline(t)
+}
+
+func (c *IdleConn) SetReadDeadline(t time.Time) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    c.readDeadline = t
+
+    return c.Conn.SetReadDeadline(earliest(t, c.readIdle, c.expires))
+}
+
+func (c *IdleConn) SetWriteDeadline(t time.Time) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    c.writeDeadline = t
+
+    return c.Conn.SetWriteDeadline(earliest(t, c.writeIdle, c.expires))
+}
+
+// CloseWrite half-closes the wrapped connection if it supports it.
+func (c *IdleConn) CloseWrite() error {
+    if halfCloser, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+        return halfCloser.CloseWrite()
+    }
+
+    return nil
+}
+
+// NetConn returns the wrapped connection.
+func (c *IdleConn) NetConn() net.Conn {
+    return c.Conn
+}
+
+// check tells apart which deadline err is due to, given the caller's own, and
+// closes the connection if it was not the caller's.
+func (c *IdleConn) check(err error, deadline *time.Time) error {
+    if !errors.Is(err, os.ErrDeadlineExceeded) {
+        return err
+    }
+
+    now := time.Now()
+
+    c.mu.Lock()
+    caller := *deadline
+    c.mu.Unlock()
+
+    var reason error
+
+    switch {
+    case !c.expires.IsZero() && !now.Before(c.expires):
+        reason = ErrLifetimeExceeded
+    case !caller.IsZero() && !now.Before(caller):
+        return err
+    default:
+        reason = ErrIdleTimeout
+    }
+
+    _ = c.Conn.Close()
+
+    return fmt.Errorf("%w: %w", reason, err)
+}
+
+
+// earliest returns the earliest of the non-zero times, or zero if all are.
+func earliest(times ...time.Time) time.Time {
+    var min time.Time
+
+    for _, t := range times {
+        if !t.IsZero() && (min.IsZero() || t.Before(min)) {
+            min = t
+        }
+    }
+
+    return min
+}
@@ -0,0 +1,124 @@
+package ch03
+
+import (
+    "errors"
+    "io"
+    "os"
+    "testing"
+    "time"
+)
+
+
+func TestIdleConnRead(t *testing.T) {
+    client, server := connPair(t)
+    c := IdleTimeout{Read: 100 * time.Millisecond}.Wrap(server)
+
+    // Each write pushes the deadline forward, though together they outlast it.
+    go func() {
+        for i := 0; i < 5; i++ {
+            time.Sleep(50 * time.Millisecond)
+            _, _ = client.Write([]byte("x"))
+        }
+    }()
+
+    buf := make([]byte, 1)
+    for i := 0; i < 5; i++ {
+        if _, err := c.Read(buf); err != nil {
+            t.Fatalf("%d: %v", i, err)
+        }
+    }
+
+    begin := time.Now()
+    _, err := c.Read(buf)
+    if !errors.Is(err, ErrIdleTimeout) || !errors.Is(err, os.ErrDeadlineExceeded) {
+        t.Fatalf("expected an idle timeout; actual %v", err)
+    }
+
+    if elapsed := time.Since(begin); elapsed < 100 * time.Millisecond || elapsed > time.Second {
+        t.Errorf("expected to time out after 100ms; actual %s", elapsed)
+    }
+
+    // The idle connection was closed.
+    if _, err = client.Read(buf); err != io.EOF {
+        t.Errorf("expected EOF; actual %v", err)
+    }
+}
+
+
+func TestIdleConnLifetime(t *testing.T) {
+    client, server := connPair(t)
+    c := IdleTimeout{Read: time.Second, Lifetime: 150 * time.Millisecond}.Wrap(server)
+
+    done := make(chan struct{})
+    defer close(done)
+
+    go func() {
+        for {
+            select {
+            case <-done:
+                return
+            case <-time.After(20 * time.Millisecond):
+                _, _ = client.Write([]byte("x"))
+            }
+        }
+    }()
+
+    begin := time.Now()
+    buf := make([]byte, 1)
+
+    var err error
+    for err == nil {
+        _, err = c.Read(buf)
+    }
+
+    if !errors.Is(err, ErrLifetimeExceeded) {
+        t.Fatalf("expected %v; actual %v", ErrLifetimeExceeded, err)
+    }
+
+    if elapsed := time.Since(begin); elapsed < 150 * time.Millisecond || elapsed > time.Second {
+        t.Errorf("expected the connection to last 150ms; actual %s", elapsed)
+    }
+}
+
+
+func TestIdleConnCallerDeadline(t *testing.T) {
+    client, server := connPair(t)
+    c := IdleTimeout{Read: time.Second}.Wrap(server)
+
+    err := c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    _, err = c.Read(make([]byte, 1))
+    if !errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, ErrIdleTimeout) {
+        t.Fatalf("expected the caller's deadline to pass; actual %v", err)
+    }
+
+    // The connection stays open after the caller's own deadline.
+    _ = c.SetReadDeadline(time.Time{})
+
+    go func() { _, _ = client.Write([]byte("x")) }()
+
+    if _, err = c.Read(make([]byte, 1)); err != nil {
+        t.Fatal(err)
+    }
+}
+
+
+func TestIdleConnWrite(t *testing.T) {
+    _, server := connPair(t)
+    c := IdleTimeout{Write: 100 * time.Millisecond}.Wrap(server)
+
+    // The client never reads, so writes block once the buffers fill up.
+    buf := make([]byte, 1 << 20)
+
+    var err error
+    for i := 0; err == nil && i < 1000; i++ {
+        _, err = c.Write(buf)
+    }
+
+    if !errors.Is(err, ErrIdleTimeout) {
+        t.Fatalf("expected an idle timeout; actual %v", err)
+    }
+}
@@ -3,16 +3,78 @@ package ch03
 import (
     "context"
     "io"
+    "sync"
     "time"
 )
 
 
 const defaultPingInterval = 30 * time.Second
 
+// maxPendingPings is how many pings a PingTracker waits on. Older ones count
+// as lost, so a peer that never answers costs nothing more.
+const maxPendingPings = 64
 
+
+// Pinger writes "ping" to writer every interval until ctx is canceled or a
+// write fails. A duration sent on reset restarts the timer, and a positive
+// one also becomes the new interval. The first interval is taken from reset
+// if one is waiting there; otherwise it is 30 seconds.
 func Pinger(ctx context.Context, writer io.Writer, reset <-chan time.Duration) {
+    new(PingTracker).Run(ctx, writer, reset)
+}
+
+
+// RTTStats summarizes the round trip times of the pings a PingTracker sent.
+// Smoothed and Variation follow TCP's estimator in RFC 6298.
+type RTTStats struct {
+    Count int // pongs received
+    Lost int // pings superseded by a later pong, or by maxPendingPings later pings, before theirs arrived
+    Last time.Duration
+    Min time.Duration
+    Max time.Duration
+    Smoothed time.Duration
+    Variation time.Duration
+}
+
+// Timeout returns how long to wait for a pong before calling it missed, the
+// way TCP computes its retransmission timeout, or 0 before the first pong.
+func (stats RTTStats) Timeout() time.Duration {
+    if stats.Count == 0 {
+        return 0
+    }
+
+    return stats.Smoothed + 4 * stats.Variation
+}
+
+
+// PingTracker is a Pinger that numbers its pings and times the matching
+// pongs. Feed every message from the peer to Receive.
+type PingTracker struct {
+    Format PingFormat // the encoding of pings and pongs; nil means LiteralPingFormat
+
+    // Adapt, if set, is called with the updated stats after every pong and
+    // returns the next ping interval, or 0 to keep the current one.
+    Adapt func(stats RTTStats) time.Duration
+
+    mu sync.Mutex
+    seq uint32
+    sent map[uint32]time.Time // pings awaiting their pong
+    stats RTTStats
+    adapted chan time.Duration
+}
+
+
+// Run pings like Pinger, numbering each ping, until ctx is canceled or a
+// write fails. Only one Run may be active at a time.
+func (tracker *PingTracker) Run(ctx context.Context, writer io.Writer, reset <-chan time.Duration) {
+    adapted := make(chan time.Duration, 1)
+
+    tracker.mu.Lock()
+    tracker.adapted = adapted
+    tracker.mu.Unlock()
+
     var interval time.Duration
-    
+
     select {
     case <-ctx.Done():
         return
@@ -26,11 +88,9 @@ func Pinger(ctx context.Context, writer io.Writer, reset <-chan time.Duration) {
     }
 
     timer := time.NewTimer(interval)
-    defer func() {
-        if !timer.Stop() {
-            <-timer.C
-        }
-    }()
+    // Draining here would block forever after a failed write, since that
+    // already received from timer.C.
+    defer timer.Stop()
 
     for {
         select {
@@ -43,9 +103,13 @@ func Pinger(ctx context.Context, writer io.Writer, reset <-chan time.Duration) {
             if newInterval > 0 {
                 interval = newInterval
             }
+        case interval = <-adapted:
+            if !timer.Stop() {
+                <-timer.C
+            }
         case <-timer.C:
-            if _, err := writer.Write([]byte("ping")); err != nil {
-                // Track and act on consecutive timeouts here
+            if _, err := writer.Write(tracker.ping()); err != nil {
+                // HeartbeatConn acts on failed pings and missed pongs.
                 return
             }
         }
@@ -53,3 +117,149 @@ func Pinger(ctx context.Context, writer io.Writer, reset <-chan time.Duration) {
         _ = timer.Reset(interval)
     }
 }
+
+func (tracker *PingTracker) format() PingFormat {
+    if tracker.Format == nil {
+        return LiteralPingFormat{}
+    }
+
+    return tracker.Format
+}
+
+func (tracker *PingTracker) ping() []byte {
+    tracker.mu.Lock()
+    defer tracker.mu.Unlock()
+
+    tracker.seq++
+    if tracker.sent == nil {
+        tracker.sent = make(map[uint32]time.Time)
+    }
+    tracker.sent[tracker.seq] = time.Now()
+
+    if oldest := tracker.seq - maxPendingPings; tracker.seq > maxPendingPings {
+        if _, ok := tracker.sent[oldest]; ok {
+            delete(tracker.sent, oldest)
+            tracker.stats.Lost++
+        }
+    }
+
+    return tracker.format().Ping(tracker.seq)
+}
+
+
+// Receive handles the pings and pongs at the start of b, which may hold
+// several. It records the round trip time of each pong and returns the pongs
+// answering the pings, along with the number of bytes handled. Whatever
+// follows is other traffic.
+func (tracker *PingTracker) Receive(b []byte) (replies []byte, n int) {
+    format := tracker.format()
+    received := time.Now()
+
+    for n < len(b) {
+        if seq, size := format.ParsePing(b[n:]); size > 0 {
+            replies = append(replies, format.Pong(seq)...)
+            n += size
+            continue
+        }
+
+        seq, size := format.ParsePong(b[n:])
+        if size == 0 {
+            break
+        }
+
+        tracker.pong(seq, received)
+        n += size
+    }
+
+    return replies, n
+}
+
+func (tracker *PingTracker) pong(seq uint32, received time.Time) {
+    tracker.mu.Lock()
+
+    if seq == 0 {
+        // The format carries no sequence number, so assume the latest ping.
+        seq = tracker.seq
+    }
+
+    sent, ok := tracker.sent[seq]
+    if !ok {
+        // A duplicate, or a pong for a ping already counted as lost.
+        tracker.mu.Unlock()
+        return
+    }
+
+    // Pongs arrive in order, so earlier pings still waiting were lost.
+    for s := range tracker.sent {
+        if s < seq {
+            tracker.stats.Lost++
+        }
+        if s <= seq {
+            delete(tracker.sent, s)
+        }
+    }
+
+    tracker.stats.add(received.Sub(sent))
+
+    stats, adapted := tracker.stats, tracker.adapted
+    tracker.mu.Unlock()
+
+    // Adapt may take its time, or call Stats, so it runs unlocked.
+    if tracker.Adapt == nil || adapted == nil {
+        return
+    }
+
+    interval := tracker.Adapt(stats)
+    if interval <= 0 {
+        return
+    }
+
+    // Replace an adapted interval Run has yet to pick up.
+    for {
+        select {
+        case adapted <- interval:
+            return
+        default:
+        }
+
+        select {
+        case <-adapted:
+        default:
+        }
+    }
+}
+
+// Stats returns the round trip times measured so far.
+func (tracker *PingTracker) Stats() RTTStats {
+    tracker.mu.Lock()
+    defer tracker.mu.Unlock()
+
+    return tracker.stats
+}
+
+
+func (stats *RTTStats) add(rtt time.Duration) {
+    stats.Count++
+    stats.Last = rtt
+
+    if stats.Count == 1 {
+        stats.Min, stats.Max = rtt, rtt
+        stats.Smoothed, stats.Variation = rtt, rtt / 2
+        return
+    }
+
+    if rtt < stats.Min {
+        stats.Min = rtt
+    }
+    if rtt > stats.Max {
+        stats.Max = rtt
+    }
+
+    // RTTVAR = 3/4 RTTVAR + 1/4 |SRTT - R'|, then SRTT = 7/8 SRTT + 1/8 R'
+    delta := stats.Smoothed - rtt
+    if delta < 0 {
+        delta = -delta
+    }
+    stats.Variation = (3 * stats.Variation + delta) / 4
+    stats.Smoothed = (7 * stats.Smoothed + rtt) / 8
+}
@@ -0,0 +1,75 @@
+package ch03
+
+import (
+    "bytes"
+    "encoding/binary"
+)
+
+
+// PingFormat encodes the pings a PingTracker sends and the pongs that answer
+// them. Sequence numbers start at 1; a format that cannot carry them parses
+// every message as sequence number 0. The parse methods look for a message at
+// the start of b and return its length, or 0 if there is none.
+type PingFormat interface {
+    Ping(seq uint32) []byte
+    Pong(seq uint32) []byte
+    ParsePing(b []byte) (seq uint32, n int)
+    ParsePong(b []byte) (seq uint32, n int)
+}
+
+
+// LiteralPingFormat is the bare "ping" and "pong" Pinger has always sent.
+type LiteralPingFormat struct{}
+
+func (LiteralPingFormat) Ping(uint32) []byte { return []byte("ping") }
+func (LiteralPingFormat) Pong(uint32) []byte { return []byte("pong") }
+
+func (LiteralPingFormat) ParsePing(b []byte) (uint32, int) { return 0, parseLiteral("ping", b) }
+func (LiteralPingFormat) ParsePong(b []byte) (uint32, int) { return 0, parseLiteral("pong", b) }
+
+func parseLiteral(kind string, b []byte) int {
+    if !bytes.HasPrefix(b, []byte(kind)) {
+        return 0
+    }
+
+    return len(kind)
+}
+
+
+// The binary type ID of ch04's TLV encoding.
+const tlvBinaryType = 1
+
+// TLVPingFormat sends each ping as a ch04 Binary frame holding "ping" and the
+// big-endian sequence number, and expects the same frame with "pong" back,
+// so heartbeats can share a connection with other TLV payloads.
+type TLVPingFormat struct{}
+
+func (TLVPingFormat) Ping(seq uint32) []byte { return tlvHeartbeat("ping", seq) }
+func (TLVPingFormat) Pong(seq uint32) []byte { return tlvHeartbeat("pong", seq) }
+
+func (TLVPingFormat) ParsePing(b []byte) (uint32, int) { return parseTLVHeartbeat("ping", b) }
+func (TLVPingFormat) ParsePong(b []byte) (uint32, int) { return parseTLVHeartbeat("pong", b) }
+
+// The size of a TLV heartbeat: type, 4-byte payload length, then the 8-byte
+// payload of kind and sequence number.
+const tlvHeartbeatSize = 1 + 4 + 8
+
+func tlvHeartbeat(kind string, seq uint32) []byte {
+    frame := make([]byte, tlvHeartbeatSize)
+
+    frame[0] = tlvBinaryType
+    binary.BigEndian.PutUint32(frame[1:5], 8)
+    copy(frame[5:9], kind)
+    binary.BigEndian.PutUint32(frame[9:], seq)
+
+    return frame
+}
+
+func parseTLVHeartbeat(kind string, b []byte) (uint32, int) {
+    if len(b) < tlvHeartbeatSize || b[0] != tlvBinaryType || binary.BigEndian.Uint32(b[1:5]) != 8 ||
+        !bytes.Equal(b[5:9], []byte(kind)) {
+        return 0, 0
+    }
+
+    return binary.BigEndian.Uint32(b[9:tlvHeartbeatSize]), tlvHeartbeatSize
+}
@@ -0,0 +1,216 @@
+package ch03
+
+import (
+    "bytes"
+    "context"
+    "io"
+    "net"
+    "testing"
+    "time"
+)
+
+
+func TestTLVPingFormat(t *testing.T) {
+    var format TLVPingFormat
+
+    ping := format.Ping(258)
+    expected := []byte{1, 0, 0, 0, 8, 'p', 'i', 'n', 'g', 0, 0, 1, 2}
+    if !bytes.Equal(expected, ping) {
+        t.Fatalf("expected %v; actual %v", expected, ping)
+    }
+
+    if seq, n := format.ParsePing(ping); n != len(ping) || seq != 258 {
+        t.Errorf("expected ping 258; actual %d, %d bytes", seq, n)
+    }
+
+    if _, n := format.ParsePong(ping); n != 0 {
+        t.Error("parsed a ping as a pong")
+    }
+
+    if _, n := format.ParsePing(ping[:len(ping) - 1]); n != 0 {
+        t.Error("parsed a truncated ping")
+    }
+
+    if seq, n := format.ParsePong(format.Pong(7)); n != len(ping) || seq != 7 {
+        t.Errorf("expected pong 7; actual %d, %d bytes", seq, n)
+    }
+}
+
+
+// answer reads pings from reader and feeds the pongs back to tracker after
+// delay, as if they crossed the network.
+func answer(reader io.Reader, format PingFormat, tracker *PingTracker, delay time.Duration) {
+    buf := make([]byte, 1024)
+
+    for {
+        n, err := reader.Read(buf)
+        if err != nil {
+            return
+        }
+
+        seq, size := format.ParsePing(buf[:n])
+        if size == 0 {
+            return
+        }
+
+        time.Sleep(delay)
+        tracker.Receive(format.Pong(seq))
+    }
+}
+
+
+func TestPingTrackerRTT(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    reader, writer := io.Pipe()
+    defer reader.Close()
+
+    tracker := &PingTracker{Format: TLVPingFormat{}}
+    reset := make(chan time.Duration, 1)
+    reset <- 10 * time.Millisecond
+
+    go tracker.Run(ctx, writer, reset)
+    go answer(reader, TLVPingFormat{}, tracker, 20 * time.Millisecond)
+
+    time.Sleep(300 * time.Millisecond)
+
+    stats := tracker.Stats()
+    t.Logf("%+v", stats)
+
+    if stats.Count < 3 || stats.Lost != 0 {
+        t.Errorf("expected at least 3 pongs and none lost; actual %+v", stats)
+    }
+
+    if stats.Min < 20 * time.Millisecond || stats.Smoothed < stats.Min || stats.Timeout() <= stats.Smoothed {
+        t.Errorf("unexpected stats: %+v", stats)
+    }
+}
+
+
+func TestPingTrackerLost(t *testing.T) {
+    tracker := &PingTracker{Format: TLVPingFormat{}}
+    for i := 0; i < 3; i++ {
+        _ = tracker.ping()
+    }
+
+    // A late pong for a ping already counted as lost changes nothing.
+    msg := append(TLVPingFormat{}.Pong(3), TLVPingFormat{}.Pong(1)...)
+    msg = append(msg, TLVPingFormat{}.Ping(9)...)
+    msg = append(msg, "data"...)
+
+    replies, n := tracker.Receive(msg)
+    if n != len(msg) - 4 {
+        t.Errorf("expected to handle %d bytes; actual %d", len(msg) - 4, n)
+    }
+
+    if !bytes.Equal(TLVPingFormat{}.Pong(9), replies) {
+        t.Errorf("expected pong 9; actual %v", replies)
+    }
+
+    if stats := tracker.Stats(); stats.Count != 1 || stats.Lost != 2 {
+        t.Errorf("expected 1 pong and 2 lost; actual %+v", stats)
+    }
+}
+
+
+func TestPingTrackerUnanswered(t *testing.T) {
+    tracker := new(PingTracker)
+    for i := 0; i < 1000; i++ {
+        _ = tracker.ping()
+    }
+
+    if len(tracker.sent) != maxPendingPings {
+        t.Errorf("expected %d pending pings; actual %d", maxPendingPings, len(tracker.sent))
+    }
+
+    if stats := tracker.Stats(); stats.Lost != 1000 - maxPendingPings {
+        t.Errorf("expected %d lost; actual %+v", 1000 - maxPendingPings, stats)
+    }
+}
+
+
+func TestPingTrackerAdaptUnlocked(t *testing.T) {
+    tracker := new(PingTracker)
+    tracker.adapted = make(chan time.Duration, 1)
+    tracker.Adapt = func(RTTStats) time.Duration {
+        // Deadlocks if Adapt runs with the tracker locked.
+        return tracker.Stats().Last + time.Second
+    }
+
+    _ = tracker.ping()
+    tracker.Receive([]byte("pong"))
+
+    select {
+    case interval := <-tracker.adapted:
+        if interval <= 0 {
+            t.Errorf("expected a positive interval; actual %s", interval)
+        }
+    default:
+        t.Error("expected an adapted interval")
+    }
+}
+
+
+func TestPingTrackerAdapt(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    reader, writer := io.Pipe()
+    defer reader.Close()
+
+    tracker := &PingTracker{
+        Adapt: func(RTTStats) time.Duration {
+            // Back off for good after the first pong.
+            return time.Hour
+        },
+    }
+
+    reset := make(chan time.Duration, 1)
+    reset <- 10 * time.Millisecond
+    go tracker.Run(ctx, writer, reset)
+
+    go func() {
+        buf := make([]byte, 4)
+        for {
+            if _, err := reader.Read(buf); err != nil {
+                return
+            }
+            tracker.Receive([]byte("pong"))
+        }
+    }()
+
+    time.Sleep(200 * time.Millisecond)
+
+    if stats := tracker.Stats(); stats.Count != 1 {
+        t.Errorf("expected 1 pong after adapting the interval; actual %+v", stats)
+    }
+}
+
+
+func TestHeartbeatTLVStats(t *testing.T) {
+    client, server := connPair(t)
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    heartbeat := Heartbeat{Interval: 20 * time.Millisecond, Format: TLVPingFormat{}}
+
+    var conns []*HeartbeatConn
+    for _, conn := range []net.Conn{client, server} {
+        c := heartbeat.Wrap(ctx, conn)
+        conns = append(conns, c)
+        go func() { _, _ = io.Copy(io.Discard, c) }()
+    }
+
+    time.Sleep(200 * time.Millisecond)
+
+    for i, c := range conns {
+        stats := c.Stats()
+        t.Logf("%d: %+v", i, stats)
+
+        if stats.Count == 0 || c.Liveness() != Alive {
+            t.Errorf("%d: expected an alive peer with measured RTTs; actual %s, %+v", i, c.Liveness(), stats)
+        }
+    }
+}
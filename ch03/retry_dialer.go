@@ -0,0 +1,212 @@
+package ch03
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "math/rand"
+    "net"
+    "sync"
+    "time"
+
+    "github.com/bgabor666/gnp/neterr"
+)
+
+
+var ErrCircuitOpen = errors.New("circuit open")
+
+
+// RetryDialer dials with retries and a circuit breaker per address. Dials
+// failing with a retryable error (see neterr.Retryable), such as a refused
+// connection or a timeout, are retried after an exponentially growing,
+// jittered delay. After FailureThreshold failures in a row, the address's
+// circuit opens and dials fail fast with ErrCircuitOpen for OpenDuration.
+// Then a single trial dial is let through: its success closes the circuit,
+// and its failure opens it again.
+type RetryDialer struct {
+    Base net.Dialer // dials every attempt; its Timeout applies per attempt
+    MaxAttempts int // attempts per dial; 0 means 5
+    BaseDelay time.Duration // the delay before the first retry; 0 means 100ms
+    MaxDelay time.Duration // the cap on the delay between retries; 0 means 10 seconds
+    FailureThreshold int // consecutive failed attempts that open the circuit; 0 means 5
+    OpenDuration time.Duration // how long an open circuit fails fast; 0 means 30 seconds
+
+    // OnAttempt, if set, is called after every attempt with its number,
+    // starting at 1, and outcome.
+    OnAttempt func(address string, attempt int, err error)
+
+    // OnCircuit, if set, is called whenever the circuit of address opens or
+    // closes. It runs with the breakers locked, so it must not call Open.
+    OnCircuit func(address string, open bool)
+
+    mu sync.Mutex
+    breakers map[string]*breaker
+}
+
+
+type breaker struct {
+    failures int // consecutive failed attempts
+    openUntil time.Time // zero while the circuit is closed
+    trial bool // a trial dial of a half-open circuit is in flight
+}
+
+
+// DialContext dials address, retrying until a dial succeeds, fails with an
+// error that is not retryable, MaxAttempts is reached, or ctx is done. It
+// returns the last attempt's error.
+func (dialer *RetryDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+    maxAttempts := dialer.MaxAttempts
+    if maxAttempts <= 0 {
+        maxAttempts = 5
+    }
+
+    for attempt := 1; ; attempt++ {
+        if !dialer.allow(address) {
+            return nil, fmt.Errorf("dial %s: %w", address, ErrCircuitOpen)
+        }
+
+        connection, err := dialer.Base.DialContext(ctx, network, address)
+
+        if err != nil && ctx.Err() != nil {
+            // Giving up is not the address's fault.
+            dialer.release(address)
+        } else {
+            dialer.record(address, err)
+        }
+
+        if dialer.OnAttempt != nil {
+            dialer.OnAttempt(address, attempt, err)
+        }
+
+        if err == nil {
+            return connection, nil
+        }
+
+        if ctx.Err() != nil || attempt >= maxAttempts || !neterr.Retryable(err) {
+            return nil, err
+        }
+
+        select {
+        case <-ctx.Done():
+            return nil, err
+        case <-time.After(dialer.backoff(attempt)):
+        }
+    }
+}
+
+// Open reports whether the circuit of address is open.
+func (dialer *RetryDialer) Open(address string) bool {
+    dialer.mu.Lock()
+    defer dialer.mu.Unlock()
+
+    b := dialer.breakers[address]
+
+    return b != nil && !b.openUntil.IsZero() && time.Now().Before(b.openUntil)
+}
+
+
+// backoff returns the delay after the given failed attempt: the base delay
+// doubled for every earlier attempt, capped, with the upper half jittered so
+// clients that failed together spread out.
+func (dialer *RetryDialer) backoff(attempt int) time.Duration {
+    baseDelay := dialer.BaseDelay
+    if baseDelay <= 0 {
+        baseDelay = 100 * time.Millisecond
+    }
+
+    maxDelay := dialer.MaxDelay
+    if maxDelay <= 0 {
+        maxDelay = 10 * time.Second
+    }
+
+    delay := baseDelay
+    for i := 1; i < attempt && delay < maxDelay; i++ {
+        delay *= 2
+    }
+    if delay > maxDelay {
+        delay = maxDelay
+    }
+
+    half := delay / 2
+
+    return half + time.Duration(rand.Int63n(int64(delay - half) + 1))
+}
+
+// allow reports whether address may be dialed, letting one trial dial through
+// once an open circuit's time is up.
+func (dialer *RetryDialer) allow(address string) bool {
+    dialer.mu.Lock()
+    defer dialer.mu.Unlock()
+
+    b := dialer.breakers[address]
+
+    switch {
+    case b == nil || b.openUntil.IsZero():
+        return true
+    case time.Now().Before(b.openUntil) || b.trial:
+        return false
+    default:
+        b.trial = true
+        return true
+    }
+}
+
+// release lets another trial dial through after one was abandoned.
+func (dialer *RetryDialer) release(address string) {
+    dialer.mu.Lock()
+    defer dialer.mu.Unlock()
+
+    if b := dialer.breakers[address]; b != nil {
+        b.trial = false
+    }
+}
+
+func (dialer *RetryDialer) record(address string, err error) {
+    dialer.mu.Lock()
+    defer dialer.mu.Unlock()
+
+    if dialer.breakers == nil {
+        dialer.breakers = make(map[string]*breaker)
+    }
+
+    b := dialer.breakers[address]
+    if b == nil {
+        b = new(breaker)
+        dialer.breakers[address] = b
+    }
+
+    wasOpen := !b.openUntil.IsZero()
+
+    if err == nil {
+        *b = breaker{}
+
+        if wasOpen && dialer.OnCircuit != nil {
+            dialer.OnCircuit(address, false)
+        }
+
+        return
+    }
+
+    b.failures++
+
+    threshold := dialer.FailureThreshold
+    if threshold <= 0 {
+        threshold = 5
+    }
+
+    if !b.trial && b.failures < threshold {
+        return
+    }
+
+    openDuration := dialer.OpenDuration
+    if openDuration <= 0 {
+        openDuration = 30 * time.Second
+    }
+
+    b.openUntil = time.Now().Add(openDuration)
+    b.trial = false
+
+    if !wasOpen && dialer.OnCircuit != nil {
+        dialer.OnCircuit(address, true)
+    }
+}
@@ -0,0 +1,150 @@
+package ch03
+
+import (
+    "context"
+    "errors"
+    "net"
+    "syscall"
+    "testing"
+    "time"
+)
+
+
+// closedAddress returns an address nothing listens on.
+func closedAddress(t *testing.T) string {
+    listener, err := net.Listen("tcp", "127.0.0.1:")
+    if err != nil {
+        t.Fatal(err)
+    }
+    _ = listener.Close()
+
+    return listener.Addr().String()
+}
+
+
+func TestRetryDialerBackoff(t *testing.T) {
+    dialer := RetryDialer{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+
+    for attempt, ceiling := range map[int]time.Duration{
+        1: 100 * time.Millisecond,
+        2: 200 * time.Millisecond,
+        4: 800 * time.Millisecond,
+        5: time.Second,
+        100: time.Second,
+    } {
+        for i := 0; i < 10; i++ {
+            if delay := dialer.backoff(attempt); delay < ceiling / 2 || delay > ceiling {
+                t.Errorf("attempt %d: expected a delay in [%s, %s]; actual %s", attempt, ceiling / 2, ceiling, delay)
+            }
+        }
+    }
+}
+
+
+func TestRetryDialerRetries(t *testing.T) {
+    address := closedAddress(t)
+
+    var attempts []int
+    dialer := RetryDialer{
+        MaxAttempts: 3,
+        BaseDelay: 10 * time.Millisecond,
+        FailureThreshold: 10,
+        OnAttempt: func(_ string, attempt int, err error) {
+            attempts = append(attempts, attempt)
+        },
+    }
+
+    begin := time.Now()
+    _, err := dialer.DialContext(context.Background(), "tcp", address)
+    if !errors.Is(err, syscall.ECONNREFUSED) {
+        t.Fatalf("expected a refused connection; actual %v", err)
+    }
+
+    if len(attempts) != 3 {
+        t.Errorf("expected 3 attempts; actual %v", attempts)
+    }
+
+    // Two backoffs of at least 5 and 10 milliseconds.
+    if elapsed := time.Since(begin); elapsed < 15 * time.Millisecond {
+        t.Errorf("expected backoff between attempts; took %s", elapsed)
+    }
+
+    // A listener that shows up between attempts is reached.
+    listener, err := net.Listen("tcp", address)
+    if err != nil {
+        t.Skip(err)
+    }
+    defer listener.Close()
+
+    connection, err := dialer.DialContext(context.Background(), "tcp", address)
+    if err != nil {
+        t.Fatal(err)
+    }
+    _ = connection.Close()
+}
+
+
+func TestRetryDialerCircuitBreaker(t *testing.T) {
+    address := closedAddress(t)
+
+    var circuit []bool
+    dialer := RetryDialer{
+        MaxAttempts: 1,
+        FailureThreshold: 2,
+        OpenDuration: 100 * time.Millisecond,
+        OnCircuit: func(_ string, open bool) { circuit = append(circuit, open) },
+    }
+
+    for i := 0; i < 2; i++ {
+        if _, err := dialer.DialContext(context.Background(), "tcp", address); !errors.Is(err, syscall.ECONNREFUSED) {
+            t.Fatalf("%d: expected a refused connection; actual %v", i, err)
+        }
+    }
+
+    if !dialer.Open(address) {
+        t.Fatal("expected an open circuit")
+    }
+
+    if _, err := dialer.DialContext(context.Background(), "tcp", address); !errors.Is(err, ErrCircuitOpen) {
+        t.Fatalf("expected %v; actual %v", ErrCircuitOpen, err)
+    }
+
+    // Once the circuit's time is up, a successful trial closes it.
+    listener, err := net.Listen("tcp", address)
+    if err != nil {
+        t.Skip(err)
+    }
+    defer listener.Close()
+
+    time.Sleep(100 * time.Millisecond)
+
+    connection, err := dialer.DialContext(context.Background(), "tcp", address)
+    if err != nil {
+        t.Fatal(err)
+    }
+    _ = connection.Close()
+
+    if dialer.Open(address) || len(circuit) != 2 || !circuit[0] || circuit[1] {
+        t.Errorf("expected the circuit to open and close; actual %v", circuit)
+    }
+}
+
+
+func TestRetryDialerCancel(t *testing.T) {
+    dialer := RetryDialer{BaseDelay: time.Hour, FailureThreshold: 1}
+
+    ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+    defer cancel()
+
+    address := closedAddress(t)
+
+    begin := time.Now()
+    _, err := dialer.DialContext(ctx, "tcp", address)
+    if err == nil {
+        t.Fatal("expected an error")
+    }
+
+    if elapsed := time.Since(begin); elapsed > time.Second {
+        t.Errorf("expected the dial to stop with its context; took %s", elapsed)
+    }
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "math/rand/v2"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+
+var ErrInjectedReset = errors.New("injected connection reset")
+
+
+// Faults describes the network a Chaos middleware simulates. The zero value
+// injects nothing.
+type Faults struct {
+    Latency time.Duration // the delay added to every chunk
+    Jitter time.Duration // the maximum random deviation from Latency
+    Bandwidth int // the bytes per second each direction may carry; 0 means unlimited
+    ResetProbability float64 // the chance each chunk resets the session
+    HangProbability float64 // the chance each chunk leaves the session open but silent for good, without passing on either side's close
+    CorruptRate float64 // the fraction of bytes altered in transit
+}
+
+
+// Chaos injects faults into proxied sessions. Set takes effect on the next
+// chunk of every session, so tests can break a network partway through.
+//
+//  chaos := NewChaos(1)
+//  server := ProxyServer{Upstream: upstream, Middleware: []Middleware{chaos.Middleware()}}
+//  ...
+//  chaos.Set(Faults{ResetProbability: 1})
+type Chaos struct {
+    mu sync.Mutex
+    faults Faults
+    random *rand.Rand
+}
+
+// NewChaos returns a Chaos that injects nothing until Set is called. The seed
+// makes the random faults reproducible.
+func NewChaos(seed uint64) *Chaos {
+    return &Chaos{random: rand.New(rand.NewPCG(seed, seed))}
+}
+
+func (chaos *Chaos) Set(faults Faults) {
+    chaos.mu.Lock()
+    chaos.faults = faults
+    chaos.mu.Unlock()
+}
+
+func (chaos *Chaos) Faults() Faults {
+    chaos.mu.Lock()
+    defer chaos.mu.Unlock()
+
+    return chaos.faults
+}
+
+func (chaos *Chaos) Middleware() Middleware {
+    return func(ctx context.Context) Interceptor {
+        return &chaosSession{ctx: ctx, chaos: chaos}
+    }
+}
+
+
+type chaosSession struct {
+    ctx context.Context
+    chaos *Chaos
+    hung atomic.Bool // both directions stop once either hangs
+}
+
+func (session *chaosSession) Intercept(sender Sender, data []byte) ([]byte, error) {
+    if session.hung.Load() {
+        return nil, nil
+    }
+
+    chaos := session.chaos
+    chaos.mu.Lock()
+
+    faults := chaos.faults
+
+    reset := chaos.random.Float64() < faults.ResetProbability
+    hang := chaos.random.Float64() < faults.HangProbability
+
+    delay := faults.Latency
+    if faults.Jitter > 0 {
+        delay += time.Duration(chaos.random.Int64N(int64(2 * faults.Jitter + 1))) - faults.Jitter
+    }
+
+    if faults.CorruptRate > 0 {
+        // Leave the caller's buffer alone.
+        data = append([]byte(nil), data...)
+        for i := range data {
+            if chaos.random.Float64() < faults.CorruptRate {
+                data[i] ^= byte(1 + chaos.random.IntN(255))
+            }
+        }
+    }
+
+    chaos.mu.Unlock()
+
+    switch {
+    case reset:
+        return nil, ErrInjectedReset
+    case hang:
+        session.hung.Store(true)
+        return nil, nil
+    }
+
+    if faults.Bandwidth > 0 {
+        delay += time.Duration(len(data)) * time.Second / time.Duration(faults.Bandwidth)
+    }
+
+    if err := sleep(session.ctx, delay); err != nil {
+        return nil, err
+    }
+
+    return data, nil
+}
+
+// Flush holds back the end of a hung sender's stream, so the proxy never
+// half-closes the other side and the session stays half-open until it ends.
+func (session *chaosSession) Flush(Sender) ([]byte, error) {
+    if !session.hung.Load() {
+        return nil, nil
+    }
+
+    <-session.ctx.Done()
+
+    return nil, session.ctx.Err()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "io"
+    "net"
+    "syscall"
+    "testing"
+    "time"
+
+    "github.com/bgabor666/gnp/internal/testserver"
+)
+
+
+func startChaosProxy(t *testing.T, ctx context.Context, chaos *Chaos) (net.Conn, <-chan proxySession) {
+    upstream, _ := testserver.Counting(t, func(c net.Conn) { _, _ = io.Copy(c, c) })
+
+    addr, sessions, _ := startProxyServer(t, ctx, ProxyServer{
+        Upstream: upstream.Addr().String(),
+        Middleware: []Middleware{chaos.Middleware()},
+    })
+
+    client, err := net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { _ = client.Close() })
+
+    return client, sessions
+}
+
+
+func roundTrip(client net.Conn, msg []byte) ([]byte, error) {
+    _, err := client.Write(msg)
+    if err != nil {
+        return nil, err
+    }
+
+    reply := make([]byte, len(msg))
+    _, err = io.ReadFull(client, reply)
+
+    return reply, err
+}
+
+
+func TestChaosLatency(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    chaos := NewChaos(1)
+    chaos.Set(Faults{Latency: 100 * time.Millisecond, Jitter: 20 * time.Millisecond})
+    client, _ := startChaosProxy(t, ctx, chaos)
+
+    start := time.Now()
+    _, err := roundTrip(client, []byte("ping"))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Latency applies on the way up and on the way back.
+    if elapsed := time.Since(start); elapsed < 160 * time.Millisecond {
+        t.Errorf("expected at least 160ms; actual %s", elapsed)
+    }
+}
+
+
+func TestChaosResetPartway(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    chaos := NewChaos(1)
+    client, sessions := startChaosProxy(t, ctx, chaos)
+
+    reply, err := roundTrip(client, []byte("ping"))
+    if err != nil || string(reply) != "ping" {
+        t.Fatalf("expected a healthy network; actual %q, %v", reply, err)
+    }
+
+    chaos.Set(Faults{ResetProbability: 1})
+
+    _, err = roundTrip(client, []byte("ping"))
+    if !errors.Is(err, syscall.ECONNRESET) {
+        t.Errorf("expected connection reset; actual: %v", err)
+    }
+
+    if s := <-sessions; !errors.Is(s.err, ErrInjectedReset) {
+        t.Errorf("expected ErrInjectedReset; actual: %v", s.err)
+    }
+}
+
+
+func TestChaosCorruption(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    chaos := NewChaos(1)
+    chaos.Set(Faults{CorruptRate: 1})
+    client, _ := startChaosProxy(t, ctx, chaos)
+
+    msg := []byte("Clear is better than clever.")
+    reply, err := roundTrip(client, msg)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Corrupting twice could restore a byte, so only expect a difference.
+    if bytes.Equal(msg, reply) {
+        t.Error("expected corrupted reply")
+    }
+}
+
+
+func TestChaosHang(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    chaos := NewChaos(1)
+    chaos.Set(Faults{HangProbability: 1})
+    client, _ := startChaosProxy(t, ctx, chaos)
+
+    _ = client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+
+    _, err := roundTrip(client, []byte("ping"))
+
+    var netErr net.Error
+    if !errors.As(err, &netErr) || !netErr.Timeout() {
+        t.Fatalf("expected the session to hang; actual: %v", err)
+    }
+
+    // Lifting the fault does not revive a hung session.
+    chaos.Set(Faults{})
+    _ = client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+
+    _, err = roundTrip(client, []byte("ping"))
+    if !errors.As(err, &netErr) || !netErr.Timeout() {
+        t.Fatalf("expected the session to stay hung; actual: %v", err)
+    }
+
+    // Nor does a close get through: the upstream never sees the client
+    // finish, so it never finishes either.
+    _ = client.(*net.TCPConn).CloseWrite()
+    _ = client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+
+    _, err = client.Read(make([]byte, 1))
+    if !errors.As(err, &netErr) || !netErr.Timeout() {
+        t.Fatalf("expected the session to stay half-open; actual: %v", err)
+    }
+}
+
+
+func TestChaosBandwidth(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    chaos := NewChaos(1)
+    chaos.Set(Faults{Bandwidth: 10 << 10})
+    client, _ := startChaosProxy(t, ctx, chaos)
+
+    start := time.Now()
+    _, err := roundTrip(client, make([]byte, 2 << 10))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // 2 KB at 10 KB/s takes 200ms each way.
+    if elapsed := time.Since(start); elapsed < 350 * time.Millisecond {
+        t.Errorf("expected at least 350ms; actual %s", elapsed)
+    }
+}
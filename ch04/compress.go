@@ -0,0 +1,145 @@
+package main
+
+import (
+    "bytes"
+    "compress/flate"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+)
+
+
+// Compressed payload structure
+//
+// # 1 byte # 4 bytes # 4 bytes           # n bytes         #
+// ##########################################################
+// # Type   # Size    # Uncompressed size # Flate(Payload)  #
+// ##########################################################
+//
+// Size covers the uncompressed size and the flate stream. The decoder checks
+// the uncompressed size against its limit before inflating anything and never
+// inflates past it, which defuses decompression bombs.
+
+var errCompressedSize = errors.New("compressed payload does not match its declared size")
+
+
+// Compressed flate-compresses the body of the wrapped Binary or String on the
+// wire. Decoding yields the wrapped type, so readers need no changes.
+type Compressed struct {
+    Payload Payload
+}
+
+// Compress wraps payload in Compressed if its body is larger than threshold
+// bytes. Small bodies are returned as is since flate would only grow them.
+func Compress(payload Payload, threshold int) Payload {
+    if len(payload.Bytes()) <= threshold {
+        return payload
+    }
+
+    return &Compressed{Payload: payload}
+}
+
+func (m *Compressed) Bytes() []byte { return m.Payload.Bytes() }
+func (m *Compressed) String() string { return m.Payload.String() }
+
+func (m *Compressed) WriteTo(writer io.Writer) (int64, error) {
+    payloadType, err := compressedType(m.Payload)
+    if err != nil {
+        return 0, err
+    }
+
+    body := m.Payload.Bytes()
+
+    buf := new(bytes.Buffer)
+    // Reserve the 1-byte type, 4-byte size and 4-byte uncompressed size.
+    buf.Write(make([]byte, 9))
+
+    compressor, err := flate.NewWriter(buf, flate.DefaultCompression)
+    if err != nil {
+        return 0, err
+    }
+
+    _, err = compressor.Write(body)
+    if err != nil {
+        return 0, err
+    }
+
+    err = compressor.Close()
+    if err != nil {
+        return 0, err
+    }
+
+    frame := buf.Bytes()
+    frame[0] = payloadType
+    binary.BigEndian.PutUint32(frame[1:5], uint32(len(frame) - 5))
+    binary.BigEndian.PutUint32(frame[5:9], uint32(len(body)))
+
+    n, err := writer.Write(frame)
+
+    return int64(n), err
+}
+
+func (m *Compressed) ReadFrom(reader io.Reader) (int64, error) {
+    decoder := NewDecoder(reader, DecoderOptions{})
+
+    payload, err := decoder.Decode()
+    if err != nil {
+        return int64(decoder.BytesRead()), err
+    }
+
+    m.Payload = payload
+
+    return int64(decoder.BytesRead()), nil
+}
+
+
+func compressedType(payload Payload) (uint8, error) {
+    switch payload.(type) {
+    case *Binary:
+        return FlateBinaryType, nil
+    case *String:
+        return FlateStringType, nil
+    default:
+        return 0, errors.New("only Binary and String payloads can be compressed")
+    }
+}
+
+
+// inflate decompresses a compressed payload's body, refusing to produce more
+// than the decoder's maximum payload size.
+func (decoder *Decoder) inflate(payloadType uint8, body []byte) ([]byte, error) {
+    if len(body) < 4 {
+        return nil, fmt.Errorf("%w: %v", ErrCorruptFrame, errCompressedSize)
+    }
+
+    size := binary.BigEndian.Uint32(body[:4])
+    if size > decoder.options.MaxPayloadSize {
+        return nil, &PayloadSizeError{
+            Type: payloadType,
+            Length: size,
+            Limit: decoder.options.MaxPayloadSize,
+        }
+    }
+
+    decompressor := flate.NewReader(bytes.NewReader(body[4:]))
+    defer decompressor.Close()
+
+    buf := decoder.get(size)
+
+    _, err := io.ReadFull(decompressor, buf)
+    if err == nil {
+        // The stream must end exactly at the declared size.
+        var extra [1]byte
+        if n, _ := decompressor.Read(extra[:]); n > 0 {
+            err = errCompressedSize
+        }
+    }
+
+    if err != nil {
+        decoder.put(buf)
+        return nil, fmt.Errorf("%w: %v", ErrCorruptFrame, err)
+    }
+
+    return buf, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+    "bytes"
+    "compress/flate"
+    "encoding/binary"
+    "errors"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+
+func TestCompressedPayloads(t *testing.T) {
+    binary1 := Binary(strings.Repeat("Clear is better than clever. ", 100))
+    string1 := String(strings.Repeat("Errors are values. ", 100))
+    string2 := String("Don't panic.")
+    payloads := []Payload{&binary1, &string1, &string2}
+
+    buf := new(bytes.Buffer)
+    for _, payload := range payloads {
+        _, err := Compress(payload, 64).WriteTo(buf)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    if raw := len(binary1) + len(string1) + len(string2); buf.Len() >= raw {
+        t.Errorf("expected fewer than %d bytes on the wire; actual %d", raw, buf.Len())
+    }
+
+    for i, expected := range payloads {
+        actual, err := decode(buf)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        if !reflect.DeepEqual(expected, actual) {
+            t.Errorf("%d: value mismatch: %.20q != %.20q", i, expected, actual)
+        }
+    }
+}
+
+
+// compressedFrame builds a compressed Binary frame declaring size bytes of
+// uncompressed payload for the given body.
+func compressedFrame(t *testing.T, size uint32, body []byte) []byte {
+    deflated := new(bytes.Buffer)
+    compressor, err := flate.NewWriter(deflated, flate.BestCompression)
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, _ = compressor.Write(body)
+    _ = compressor.Close()
+
+    frame := new(bytes.Buffer)
+    _ = frame.WriteByte(FlateBinaryType)
+    _ = binary.Write(frame, binary.BigEndian, uint32(4 + deflated.Len()))
+    _ = binary.Write(frame, binary.BigEndian, size)
+    _, _ = deflated.WriteTo(frame)
+
+    return frame.Bytes()
+}
+
+
+func TestDecompressionBomb(t *testing.T) {
+    // 1 MB of zeros deflates to about a kilobyte.
+    bomb := make([]byte, 1<<20)
+
+    // Lying about the uncompressed size must not inflate past it.
+    _, err := decode(bytes.NewReader(compressedFrame(t, 16, bomb)))
+    if !errors.Is(err, ErrCorruptFrame) {
+        t.Errorf("expected ErrCorruptFrame; actual: %v", err)
+    }
+
+    // An honest size above the limit is rejected before inflating.
+    decoder := NewDecoder(bytes.NewReader(compressedFrame(t, 1<<20, bomb)),
+        DecoderOptions{MaxPayloadSize: 1<<16})
+
+    _, err = decoder.Decode()
+
+    var sizeErr *PayloadSizeError
+    if !errors.As(err, &sizeErr) || sizeErr.Type != FlateBinaryType || sizeErr.Length != 1<<20 {
+        t.Errorf("expected *PayloadSizeError; actual: %v", err)
+    }
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "io"
+    "math/bits"
+    "sync"
+)
+
+
+var ErrMaxTotalSize = errors.New("maximum total size exceeded")
+
+
+// PayloadSizeError reports a frame whose declared length exceeds the
+// decoder's maximum frame size.
+type PayloadSizeError struct {
+    Type uint8
+    Length uint32
+    Limit uint32
+}
+
+func (e *PayloadSizeError) Error() string {
+    return fmt.Sprintf("%v: type %d declared %d bytes (limit %d)",
+        ErrMaxPayloadSize, e.Type, e.Length, e.Limit)
+}
+
+func (e *PayloadSizeError) Unwrap() error { return ErrMaxPayloadSize }
+
+
+// TotalSizeError reports a frame that would push the number of bytes read
+// from a connection past the decoder's budget.
+type TotalSizeError struct {
+    Type uint8
+    Length uint32
+    Read uint64 // bytes consumed before this frame
+    Limit uint64
+}
+
+func (e *TotalSizeError) Error() string {
+    return fmt.Sprintf("%v: type %d declared %d bytes after %d of %d bytes",
+        ErrMaxTotalSize, e.Type, e.Length, e.Read, e.Limit)
+}
+
+func (e *TotalSizeError) Unwrap() error { return ErrMaxTotalSize }
+
+
+// Allocator hands out payload buffers and takes them back once the caller
+// is done with a decoded payload.
+type Allocator interface {
+    Get(size uint32) []byte
+    Put(buf []byte)
+}
+
+
+// PoolAllocator recycles payload buffers through a sync.Pool per power of
+// two size class, so a buffer taken from a pool always fits the request.
+type PoolAllocator struct {
+    pools [33]sync.Pool
+}
+
+func (allocator *PoolAllocator) Get(size uint32) []byte {
+    class := bits.Len32(size - 1)
+    if size == 0 {
+        class = 0
+    }
+
+    if buf, ok := allocator.pools[class].Get().(*[]byte); ok {
+        return (*buf)[:size]
+    }
+
+    return make([]byte, size, uint64(1) << class)
+}
+
+// Put files buf under the largest class its capacity covers.
+func (allocator *PoolAllocator) Put(buf []byte) {
+    if cap(buf) == 0 {
+        return
+    }
+
+    class := bits.Len64(uint64(cap(buf))) - 1
+    buf = buf[:0]
+    allocator.pools[class].Put(&buf)
+}
+
+
+type DecoderOptions struct {
+    MaxPayloadSize uint32 // the largest accepted frame payload; 0 means MaxPayloadSize
+    MaxTotalSize uint64 // the bytes allowed over the decoder's lifetime; 0 means unlimited
+    Allocator Allocator // the source of payload buffers; nil means make
+}
+
+
+// Decoder reads payloads from a single connection while enforcing its limits.
+type Decoder struct {
+    reader io.Reader
+    options DecoderOptions
+    read uint64
+    peerVersion uint8
+}
+
+func NewDecoder(reader io.Reader, options DecoderOptions) *Decoder {
+    if options.MaxPayloadSize == 0 {
+        options.MaxPayloadSize = MaxPayloadSize
+    }
+
+    return &Decoder{reader: reader, options: options}
+}
+
+// BytesRead returns the number of bytes the decoder consumed so far.
+func (decoder *Decoder) BytesRead() uint64 { return decoder.read }
+
+func (decoder *Decoder) Decode() (Payload, error) {
+    var (
+        headerBuf [11]byte
+        version uint8
+    )
+
+    // 1-byte type or frame magic
+    header := headerBuf[:1]
+    err := decoder.readFull(header)
+    if err != nil {
+        return nil, err
+    }
+
+    // Versioned frames prefix the legacy header with the magic and version,
+    // and follow it with the header checksum.
+    if header[0] == FrameMagic {
+        header = headerBuf[:2]
+        err = decoder.readFull(header[1:])
+        if err != nil {
+            return nil, unexpectedEOF(err)
+        }
+
+        version = header[1]
+        if version != FrameVersion1 {
+            return nil, fmt.Errorf("%w: %w", ErrCorruptFrame, &VersionError{Version: version})
+        }
+
+        header = headerBuf[:versionedHeaderSize]
+        err = decoder.readFull(header[2:])
+        if err != nil {
+            return nil, unexpectedEOF(err)
+        }
+
+        // Check the length before trusting it to read the payload.
+        checksum := crc32.Checksum(header[1:7], castagnoli)
+        if checksum != binary.BigEndian.Uint32(header[7:]) {
+            return nil, fmt.Errorf("%w: header checksum mismatch", ErrCorruptFrame)
+        }
+    } else {
+        // 4-byte size
+        header = headerBuf[:5]
+        err = decoder.readFull(header[1:])
+        if err != nil {
+            return nil, unexpectedEOF(err)
+        }
+    }
+
+    fields := header
+    if version > 0 {
+        fields = header[2:7]
+    }
+
+    payloadType := fields[0]
+    payloadSize := binary.BigEndian.Uint32(fields[1:])
+
+    if payloadType < BinaryType || payloadType > FlateStringType {
+        if version > 0 {
+            return nil, fmt.Errorf("%w: unknown type %d", ErrCorruptFrame, payloadType)
+        }
+        return nil, errors.New("unknown type")
+    }
+
+    if payloadSize > decoder.options.MaxPayloadSize {
+        err = &PayloadSizeError{
+            Type: payloadType,
+            Length: payloadSize,
+            Limit: decoder.options.MaxPayloadSize,
+        }
+        if version > 0 {
+            err = fmt.Errorf("%w: %w", ErrCorruptFrame, err)
+        }
+
+        return nil, err
+    }
+
+    frameSize := uint64(payloadSize)
+    if version > 0 {
+        frameSize += crcSize
+    }
+
+    if limit := decoder.options.MaxTotalSize; limit > 0 && decoder.read + frameSize > limit {
+        return nil, &TotalSizeError{
+            Type: payloadType,
+            Length: payloadSize,
+            Read: decoder.read - uint64(len(header)),
+            Limit: limit,
+        }
+    }
+
+    buf := decoder.get(payloadSize)
+
+    err = decoder.readFull(buf)
+    if err != nil {
+        decoder.put(buf)
+        return nil, unexpectedEOF(err)
+    }
+
+    if version > 0 {
+        var trailer [crcSize]byte
+
+        err = decoder.readFull(trailer[:])
+        if err != nil {
+            decoder.put(buf)
+            return nil, unexpectedEOF(err)
+        }
+
+        // The magic byte is not covered since it selected this branch.
+        checksum := crc32.Update(crc32.Checksum(header[1:], castagnoli), castagnoli, buf)
+        if checksum != binary.BigEndian.Uint32(trailer[:]) {
+            decoder.put(buf)
+            return nil, fmt.Errorf("%w: checksum mismatch for type %d of %d bytes",
+                ErrCorruptFrame, payloadType, payloadSize)
+        }
+
+        if version > decoder.peerVersion {
+            decoder.peerVersion = version
+        }
+    }
+
+    if payloadType == FlateBinaryType || payloadType == FlateStringType {
+        compressed := buf
+
+        buf, err = decoder.inflate(payloadType, compressed)
+        decoder.put(compressed)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    switch payloadType {
+    case BinaryType, FlateBinaryType:
+        payload := Binary(buf)
+        return &payload, nil
+    default:
+        payload := String(buf)
+        decoder.put(buf)
+        return &payload, nil
+    }
+}
+
+// PeerVersion returns the highest frame version received so far, or 0 if
+// the peer only sent legacy frames. Reply with an Encoder of this version to
+// stay compatible with the peer.
+func (decoder *Decoder) PeerVersion() uint8 { return decoder.peerVersion }
+
+// Release hands the payload's buffer back to the decoder's allocator.
+// The payload must not be used afterwards.
+func (decoder *Decoder) Release(payload Payload) {
+    if binaryPayload, ok := payload.(*Binary); ok {
+        decoder.put(*binaryPayload)
+        *binaryPayload = nil
+    }
+}
+
+func (decoder *Decoder) get(size uint32) []byte {
+    if decoder.options.Allocator == nil {
+        return make([]byte, size)
+    }
+
+    return decoder.options.Allocator.Get(size)
+}
+
+func (decoder *Decoder) put(buf []byte) {
+    if decoder.options.Allocator != nil {
+        decoder.options.Allocator.Put(buf)
+    }
+}
+
+func (decoder *Decoder) readFull(buf []byte) error {
+    n, err := io.ReadFull(decoder.reader, buf)
+    decoder.read += uint64(n)
+
+    return err
+}
+
+
+// unexpectedEOF reports a stream ending partway through a frame.
+func unexpectedEOF(err error) error {
+    if err == io.EOF {
+        return io.ErrUnexpectedEOF
+    }
+
+    return err
+}
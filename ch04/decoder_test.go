@@ -0,0 +1,133 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "io"
+    "testing"
+)
+
+
+func TestDecoderMaxPayloadSize(t *testing.T) {
+    buf := new(bytes.Buffer)
+    _, err := String("Errors are values.").WriteTo(buf)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    decoder := NewDecoder(buf, DecoderOptions{MaxPayloadSize: 8})
+
+    _, err = decoder.Decode()
+    if !errors.Is(err, ErrMaxPayloadSize) {
+        t.Fatalf("expected ErrMaxPayloadSize; actual: %v", err)
+    }
+
+    var sizeErr *PayloadSizeError
+    if !errors.As(err, &sizeErr) {
+        t.Fatalf("expected *PayloadSizeError; actual: %T", err)
+    }
+
+    if sizeErr.Type != StringType || sizeErr.Length != 18 || sizeErr.Limit != 8 {
+        t.Errorf("unexpected error details: %+v", sizeErr)
+    }
+}
+
+
+func TestDecoderMaxTotalSize(t *testing.T) {
+    binary1 := Binary("Don't panic.")
+    buf := new(bytes.Buffer)
+    for _, payload := range []Payload{&binary1, &binary1} {
+        _, err := payload.WriteTo(buf)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    // Enough for the first frame (5 + 12 bytes) but not for the second.
+    decoder := NewDecoder(buf, DecoderOptions{MaxTotalSize: 30})
+
+    _, err := decoder.Decode()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    _, err = decoder.Decode()
+    if !errors.Is(err, ErrMaxTotalSize) {
+        t.Fatalf("expected ErrMaxTotalSize; actual: %v", err)
+    }
+
+    var totalErr *TotalSizeError
+    if !errors.As(err, &totalErr) {
+        t.Fatalf("expected *TotalSizeError; actual: %T", err)
+    }
+
+    if totalErr.Type != BinaryType || totalErr.Length != 12 || totalErr.Read != 17 {
+        t.Errorf("unexpected error details: %+v", totalErr)
+    }
+}
+
+
+func TestDecoderAllocator(t *testing.T) {
+    buf := new(bytes.Buffer)
+    binary1 := Binary("Clear is better than clever.")
+    string1 := String("A little copying is better than a little dependency.")
+    expected := []Payload{&binary1, &string1}
+    for _, payload := range expected {
+        _, err := payload.WriteTo(buf)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    decoder := NewDecoder(buf, DecoderOptions{Allocator: new(PoolAllocator)})
+
+    for i := 0; ; i++ {
+        actual, err := decoder.Decode()
+        if err != nil {
+            if err != io.EOF {
+                t.Fatal(err)
+            }
+            break
+        }
+
+        if !bytes.Equal(expected[i].Bytes(), actual.Bytes()) {
+            t.Errorf("%d: expected %q; actual %q", i, expected[i], actual)
+        }
+
+        decoder.Release(actual)
+    }
+}
+
+
+func TestDecoderTruncatedPayload(t *testing.T) {
+    buf := new(bytes.Buffer)
+    _ = buf.WriteByte(BinaryType)
+    _ = binary.Write(buf, binary.BigEndian, uint32(10))
+    _, _ = buf.WriteString("short")
+
+    _, err := NewDecoder(buf, DecoderOptions{}).Decode()
+    if err != io.ErrUnexpectedEOF {
+        t.Fatalf("expected io.ErrUnexpectedEOF; actual: %v", err)
+    }
+}
+
+
+func TestPoolAllocatorSizeClasses(t *testing.T) {
+    allocator := new(PoolAllocator)
+
+    small := allocator.Get(100)
+    if len(small) != 100 || cap(small) != 128 {
+        t.Fatalf("expected length 100 and capacity 128; actual %d and %d", len(small), cap(small))
+    }
+    allocator.Put(small)
+
+    // A larger request must not be handed the small buffer.
+    if large := allocator.Get(1000); len(large) != 1000 || cap(large) < 1000 {
+        t.Fatalf("expected length 1000; actual %d of capacity %d", len(large), cap(large))
+    }
+
+    if empty := allocator.Get(0); len(empty) != 0 {
+        t.Fatalf("expected an empty buffer; actual length %d", len(empty))
+    }
+}
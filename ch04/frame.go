@@ -0,0 +1,98 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "io"
+)
+
+
+// Versioned frame structure
+//
+// # 1 byte # 1 byte  # 1 byte # 4 bytes # 4 bytes       # n bytes # 4 bytes #
+// ##########################################################################
+// # Magic  # Version # Type   # Size    # Header CRC32C # Payload # CRC32C  #
+// ##########################################################################
+//
+// The header checksum covers the version, type and size, so a Decoder notices
+// a corrupt size before it waits for a payload of that size. The trailing
+// checksum covers everything after the magic byte. Legacy frames start with
+// the type byte, which never collides with the magic byte, so a Decoder
+// accepts both on the same stream.
+
+const (
+    FrameMagic uint8 = 0xA5
+
+    // FrameVersion1 is the first checksummed frame format. Version 0 denotes
+    // the legacy type and size header.
+    FrameVersion1 uint8 = 1
+
+    crcSize = 4
+
+    // versionedHeaderSize is the length of a versioned frame up to its payload.
+    versionedHeaderSize = 2 + 5 + crcSize
+)
+
+
+var (
+    ErrCorruptFrame = errors.New("corrupt frame")
+
+    castagnoli = crc32.MakeTable(crc32.Castagnoli)
+)
+
+
+// VersionError reports a frame version this package cannot read or write.
+// Decoders return it wrapped in ErrCorruptFrame, since a version byte they
+// do not know may as well be a damaged one.
+type VersionError struct {
+    Version uint8
+}
+
+func (e *VersionError) Error() string {
+    return fmt.Sprintf("unsupported frame version %d", e.Version)
+}
+
+
+// Encoder writes payloads in a fixed frame version.
+type Encoder struct {
+    writer io.Writer
+    version uint8
+}
+
+// NewEncoder returns an Encoder writing frames of the given version. Version 0
+// writes legacy frames, understood by every peer.
+func NewEncoder(writer io.Writer, version uint8) (*Encoder, error) {
+    if version > FrameVersion1 {
+        return nil, &VersionError{Version: version}
+    }
+
+    return &Encoder{writer: writer, version: version}, nil
+}
+
+func (encoder *Encoder) Encode(payload Payload) error {
+    if encoder.version == 0 {
+        _, err := payload.WriteTo(encoder.writer)
+        return err
+    }
+
+    legacy := new(bytes.Buffer)
+    _, err := payload.WriteTo(legacy)
+    if err != nil {
+        return err
+    }
+
+    frame := make([]byte, 0, versionedHeaderSize + legacy.Len() - 5 + crcSize)
+    frame = append(frame, FrameMagic, encoder.version)
+    frame = append(frame, legacy.Bytes()[:5]...)
+    frame = binary.BigEndian.AppendUint32(frame, crc32.Checksum(frame[1:], castagnoli))
+    frame = append(frame, legacy.Bytes()[5:]...)
+    frame = binary.BigEndian.AppendUint32(frame, crc32.Checksum(frame[1:], castagnoli))
+
+    // A single write keeps the frame intact on connections shared by goroutines.
+    _, err = encoder.writer.Write(frame)
+
+    return err
+}
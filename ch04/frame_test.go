@@ -0,0 +1,141 @@
+package main
+
+import (
+    "bytes"
+    "errors"
+    "io"
+    "reflect"
+    "testing"
+)
+
+
+func TestEncoderMixedVersions(t *testing.T) {
+    binary1 := Binary("Clear is better than clever.")
+    string1 := String("Errors are values.")
+    payloads := []Payload{&binary1, &string1, &binary1}
+
+    buf := new(bytes.Buffer)
+    for i, payload := range payloads {
+        // Alternate between legacy and versioned frames on the same stream.
+        encoder, err := NewEncoder(buf, uint8(i % 2))
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        err = encoder.Encode(payload)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    decoder := NewDecoder(buf, DecoderOptions{})
+
+    for i, expected := range payloads {
+        actual, err := decoder.Decode()
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        if !reflect.DeepEqual(expected, actual) {
+            t.Errorf("%d: value mismatch: %v != %v", i, expected, actual)
+        }
+    }
+
+    if v := decoder.PeerVersion(); v != FrameVersion1 {
+        t.Errorf("expected peer version %d; actual %d", FrameVersion1, v)
+    }
+}
+
+
+func TestDecoderCorruptFrame(t *testing.T) {
+    string1 := String("Don't communicate by sharing memory, share memory by communicating.")
+
+    buf := new(bytes.Buffer)
+    encoder, err := NewEncoder(buf, FrameVersion1)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = encoder.Encode(&string1)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    frame := buf.Bytes()
+    // Flip a bit in the middle of the payload.
+    frame[len(frame) / 2] ^= 0x01
+
+    _, err = NewDecoder(bytes.NewReader(frame), DecoderOptions{}).Decode()
+    if !errors.Is(err, ErrCorruptFrame) {
+        t.Fatalf("expected ErrCorruptFrame; actual: %v", err)
+    }
+}
+
+
+func TestDecoderUnsupportedVersion(t *testing.T) {
+    frame := []byte{FrameMagic, FrameVersion1 + 1, BinaryType, 0, 0, 0, 0, 0, 0, 0, 0}
+
+    _, err := NewDecoder(bytes.NewReader(frame), DecoderOptions{}).Decode()
+
+    var versionErr *VersionError
+    if !errors.As(err, &versionErr) || versionErr.Version != FrameVersion1 + 1 {
+        t.Fatalf("expected *VersionError; actual: %v", err)
+    }
+    if !errors.Is(err, ErrCorruptFrame) {
+        t.Fatalf("expected ErrCorruptFrame; actual: %v", err)
+    }
+}
+
+
+func TestDecoderCorruptLength(t *testing.T) {
+    binary1 := Binary("Clear is better than clever.")
+
+    buf := new(bytes.Buffer)
+    encoder, err := NewEncoder(buf, FrameVersion1)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = encoder.Encode(&binary1)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    frame := buf.Bytes()
+    // Grow the size to well under the maximum payload size, so that
+    // trusting it would block on a payload that never arrives.
+    frame[4] ^= 0x01
+
+    // The pipe stays open, so a read past the frame would block forever.
+    reader, writer := io.Pipe()
+    defer writer.Close()
+    go func() { _, _ = writer.Write(frame) }()
+
+    _, err = NewDecoder(reader, DecoderOptions{}).Decode()
+    if !errors.Is(err, ErrCorruptFrame) {
+        t.Fatalf("expected ErrCorruptFrame; actual: %v", err)
+    }
+}
+
+
+func TestDecoderVersionedPayloadSize(t *testing.T) {
+    binary1 := Binary("Clear is better than clever.")
+
+    buf := new(bytes.Buffer)
+    encoder, err := NewEncoder(buf, FrameVersion1)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = encoder.Encode(&binary1)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    _, err = NewDecoder(buf, DecoderOptions{MaxPayloadSize: 8}).Decode()
+
+    var sizeErr *PayloadSizeError
+    if !errors.As(err, &sizeErr) || !errors.Is(err, ErrCorruptFrame) {
+        t.Fatalf("expected *PayloadSizeError wrapped in ErrCorruptFrame; actual: %v", err)
+    }
+}
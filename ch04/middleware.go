@@ -0,0 +1,300 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "regexp"
+    "time"
+)
+
+
+var ErrBlocked = errors.New("blocked by proxy")
+
+
+// Interceptor inspects and rewrites the traffic of one proxied session. The
+// proxy calls it with every chunk read from sender and forwards whatever it
+// returns. An error ends the session. Both directions run concurrently, so
+// state must be kept per sender or synchronized.
+type Interceptor interface {
+    Intercept(sender Sender, data []byte) ([]byte, error)
+}
+
+// Flusher is implemented by interceptors that hold back data, such as
+// partial frames. The proxy calls Flush once sender finishes writing.
+type Flusher interface {
+    Flush(sender Sender) ([]byte, error)
+}
+
+type InterceptorFunc func(sender Sender, data []byte) ([]byte, error)
+
+func (f InterceptorFunc) Intercept(sender Sender, data []byte) ([]byte, error) {
+    return f(sender, data)
+}
+
+
+// Middleware returns the Interceptor for a new session, so interceptors may
+// keep per-session state. ctx is done once the session ends, so interceptors
+// that wait should give up along with it.
+type Middleware func(ctx context.Context) Interceptor
+
+
+// sleep waits for d, or returns ctx's error if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) error {
+    if d <= 0 {
+        return nil
+    }
+
+    timer := time.NewTimer(d)
+    defer timer.Stop()
+
+    select {
+    case <-timer.C:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+
+// chain runs the data from one sender through each interceptor in order.
+type chain struct {
+    sender Sender
+    interceptors []Interceptor
+}
+
+func (c chain) intercept(data []byte) ([]byte, error) {
+    return c.from(0, data)
+}
+
+func (c chain) from(i int, data []byte) ([]byte, error) {
+    var err error
+
+    for ; i < len(c.interceptors) && len(data) > 0; i++ {
+        data, err = c.interceptors[i].Intercept(c.sender, data)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    return data, nil
+}
+
+// flush drains the interceptors in order, passing what each releases through
+// the rest of the chain.
+func (c chain) flush() ([]byte, error) {
+    var out []byte
+
+    for i, interceptor := range c.interceptors {
+        flusher, ok := interceptor.(Flusher)
+        if !ok {
+            continue
+        }
+
+        released, err := flusher.Flush(c.sender)
+        if err != nil {
+            return out, err
+        }
+
+        released, err = c.from(i + 1, released)
+        if err != nil {
+            return out, err
+        }
+
+        out = append(out, released...)
+    }
+
+    return out, nil
+}
+
+
+// Log writes all traffic to monitor, prefixed by its sender.
+func Log(monitor *Monitor) Middleware {
+    interceptor := InterceptorFunc(func(sender Sender, data []byte) ([]byte, error) {
+        monitor.Printf("%s: %s", sender, data)
+        return data, nil
+    })
+
+    return func(context.Context) Interceptor { return interceptor }
+}
+
+
+// RateLimit caps the traffic in each direction of a session at
+// bytesPerSecond by delaying chunks that arrive too early.
+func RateLimit(bytesPerSecond int) Middleware {
+    if bytesPerSecond <= 0 {
+        return func(context.Context) Interceptor {
+            return InterceptorFunc(func(_ Sender, data []byte) ([]byte, error) { return data, nil })
+        }
+    }
+
+    return func(ctx context.Context) Interceptor {
+        var (
+            start [2]time.Time
+            sent [2]int64
+        )
+
+        return InterceptorFunc(func(sender Sender, data []byte) ([]byte, error) {
+            if start[sender].IsZero() {
+                start[sender] = time.Now()
+            }
+
+            sent[sender] += int64(len(data))
+
+            // The time the bytes sent so far are due at the allowed rate.
+            due := start[sender].Add(transferTime(sent[sender], bytesPerSecond))
+            if err := sleep(ctx, time.Until(due)); err != nil {
+                return nil, err
+            }
+
+            return data, nil
+        })
+    }
+}
+
+
+// transferTime returns how long sent bytes take at bytesPerSecond. It counts
+// whole seconds apart from the rest, since sent times a second in
+// nanoseconds overflows past about 9 GB.
+func transferTime(sent int64, bytesPerSecond int) time.Duration {
+    rate := int64(bytesPerSecond)
+
+    return time.Duration(sent / rate) * time.Second + time.Duration(sent % rate) * time.Second / time.Duration(rate)
+}
+
+
+// Block ends the session when traffic from either side matches pattern.
+// Chunks are matched one at a time, so a match spanning two reads goes
+// unnoticed.
+func Block(pattern *regexp.Regexp) Middleware {
+    interceptor := InterceptorFunc(func(sender Sender, data []byte) ([]byte, error) {
+        if pattern.Match(data) {
+            return nil, fmt.Errorf("%w: %s sent %q", ErrBlocked, sender, pattern.Find(data))
+        }
+        return data, nil
+    })
+
+    return func(context.Context) Interceptor { return interceptor }
+}
+
+
+// RewriteFrames reassembles the ch04 frames in both directions and forwards
+// whatever rewrite returns in place of each payload, or drops the frame if
+// it returns nil. Frames keep their version and compression. Bytes that do
+// not form a known frame end the session with ErrCorruptFrame.
+func RewriteFrames(rewrite func(sender Sender, payload Payload) (Payload, error)) Middleware {
+    return func(context.Context) Interceptor {
+        return &frameRewriter{rewrite: rewrite}
+    }
+}
+
+
+type frameRewriter struct {
+    rewrite func(Sender, Payload) (Payload, error)
+    pending [2][]byte
+}
+
+func (rewriter *frameRewriter) Intercept(sender Sender, data []byte) ([]byte, error) {
+    buf := append(rewriter.pending[sender], data...)
+    out := new(bytes.Buffer)
+
+    for {
+        length, ok, err := frameLength(buf)
+        if err != nil {
+            return nil, err
+        }
+        if !ok || len(buf) < length {
+            break
+        }
+
+        err = rewriter.frame(sender, buf[:length], out)
+        if err != nil {
+            return nil, err
+        }
+
+        buf = buf[length:]
+    }
+
+    rewriter.pending[sender] = append([]byte(nil), buf...)
+
+    return out.Bytes(), nil
+}
+
+func (rewriter *frameRewriter) Flush(sender Sender) ([]byte, error) {
+    if len(rewriter.pending[sender]) > 0 {
+        return nil, fmt.Errorf("%w: %s sent a partial frame", ErrCorruptFrame, sender)
+    }
+
+    return nil, nil
+}
+
+func (rewriter *frameRewriter) frame(sender Sender, frame []byte, out *bytes.Buffer) error {
+    payload, err := NewDecoder(bytes.NewReader(frame), DecoderOptions{}).Decode()
+    if err != nil {
+        return err
+    }
+
+    payload, err = rewriter.rewrite(sender, payload)
+    if err != nil || payload == nil {
+        return err
+    }
+
+    var version, payloadType uint8 = 0, frame[0]
+    if frame[0] == FrameMagic {
+        version, payloadType = frame[1], frame[2]
+    }
+
+    if payloadType == FlateBinaryType || payloadType == FlateStringType {
+        payload = &Compressed{Payload: payload}
+    }
+
+    encoder, err := NewEncoder(out, version)
+    if err != nil {
+        return err
+    }
+
+    return encoder.Encode(payload)
+}
+
+
+// frameLength returns the length of the frame at the start of buf once
+// enough of its header arrived.
+func frameLength(buf []byte) (int, bool, error) {
+    if len(buf) == 0 {
+        return 0, false, nil
+    }
+
+    header, trailer, fields := 5, 0, buf
+    if buf[0] == FrameMagic {
+        header, trailer = versionedHeaderSize, crcSize
+    }
+
+    if len(buf) < header {
+        return 0, false, nil
+    }
+
+    if buf[0] == FrameMagic {
+        if buf[1] != FrameVersion1 {
+            return 0, false, fmt.Errorf("%w: %w", ErrCorruptFrame, &VersionError{Version: buf[1]})
+        }
+        if crc32.Checksum(buf[1:7], castagnoli) != binary.BigEndian.Uint32(buf[7:]) {
+            return 0, false, fmt.Errorf("%w: header checksum mismatch", ErrCorruptFrame)
+        }
+        fields = buf[2:]
+    }
+
+    payloadType := fields[0]
+    if payloadType < BinaryType || payloadType > FlateStringType {
+        return 0, false, fmt.Errorf("%w: unknown type %d", ErrCorruptFrame, payloadType)
+    }
+
+    payloadSize := binary.BigEndian.Uint32(fields[1:5])
+    if payloadSize > MaxPayloadSize {
+        return 0, false, &PayloadSizeError{Type: payloadType, Length: payloadSize, Limit: MaxPayloadSize}
+    }
+
+    return header + int(payloadSize) + trailer, true, nil
+}
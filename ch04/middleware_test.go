@@ -0,0 +1,185 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "os"
+    "regexp"
+    "testing"
+    "time"
+
+    "github.com/bgabor666/gnp/internal/testserver"
+)
+
+
+func TestProxyServerRewriteFrames(t *testing.T) {
+    upstream, _ := testserver.Counting(t, func(c net.Conn) { _, _ = io.Copy(c, c) })
+
+    // Do what the server in TestProxy does by hand: answer "ping" with "pong".
+    pong := RewriteFrames(func(sender Sender, payload Payload) (Payload, error) {
+        if sender == SentByServer && payload.String() == "ping" {
+            reply := String("pong")
+            return &reply, nil
+        }
+        return payload, nil
+    })
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    addr, sessions, _ := startProxyServer(t, ctx, ProxyServer{
+        Upstream: upstream.Addr().String(),
+        Middleware: []Middleware{pong},
+    })
+
+    client, err := net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+
+    ping, echo := String("ping"), String("echo")
+
+    for _, version := range []uint8{0, FrameVersion1} {
+        encoder, err := NewEncoder(client, version)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        for _, payload := range []Payload{&ping, Compress(&echo, 0), Compress(&ping, 0)} {
+            err = encoder.Encode(payload)
+            if err != nil {
+                t.Fatal(err)
+            }
+        }
+    }
+
+    _ = client.(*net.TCPConn).CloseWrite()
+
+    decoder := NewDecoder(client, DecoderOptions{})
+
+    var replies []string
+    for {
+        payload, err := decoder.Decode()
+        if err != nil {
+            if err != io.EOF {
+                t.Fatal(err)
+            }
+            break
+        }
+        replies = append(replies, payload.String())
+    }
+
+    expected := "[pong echo pong pong echo pong]"
+    if actual := fmt.Sprint(replies); actual != expected {
+        t.Errorf("expected replies %s; actual %s", expected, actual)
+    }
+
+    if v := decoder.PeerVersion(); v != FrameVersion1 {
+        t.Errorf("expected versioned replies; actual version %d", v)
+    }
+
+    if s := <-sessions; s.err != nil {
+        t.Error(s.err)
+    }
+}
+
+
+func TestProxyServerBlock(t *testing.T) {
+    upstream, _ := testserver.Counting(t, func(c net.Conn) { _, _ = io.Copy(c, c) })
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    addr, sessions, _ := startProxyServer(t, ctx, ProxyServer{
+        Upstream: upstream.Addr().String(),
+        Middleware: []Middleware{Block(regexp.MustCompile(`DROP TABLE`))},
+    })
+
+    client, err := net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+
+    _, err = client.Write([]byte("'; DROP TABLE users; --"))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    reply, _ := io.ReadAll(client)
+    if len(reply) > 0 {
+        t.Errorf("expected no reply; actual %q", reply)
+    }
+
+    if s := <-sessions; !errors.Is(s.err, ErrBlocked) {
+        t.Errorf("expected ErrBlocked; actual: %v", s.err)
+    }
+}
+
+
+func TestRateLimit(t *testing.T) {
+    limiter := RateLimit(1000)(context.Background())
+    chunk := make([]byte, 100)
+
+    start := time.Now()
+    for i := 0; i < 3; i++ {
+        _, err := limiter.Intercept(SentByClient, chunk)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    // 300 bytes at 1000 bytes per second take 300 ms.
+    if elapsed := time.Since(start); elapsed < 250 * time.Millisecond {
+        t.Errorf("expected about 300ms; actual %s", elapsed)
+    }
+}
+
+
+func TestTransferTimeLarge(t *testing.T) {
+    // 20 GB at 100 MB per second, well past where nanoseconds overflow.
+    if actual := transferTime(20_000_000_000, 100_000_000); actual != 200 * time.Second {
+        t.Errorf("expected 200s; actual %s", actual)
+    }
+
+    if actual := transferTime(20_000_000_050, 100); actual != 200_000_000 * time.Second + 500 * time.Millisecond {
+        t.Errorf("expected 200000000.5s; actual %s", actual)
+    }
+}
+
+
+func TestRateLimitCanceled(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    limiter := RateLimit(100)(ctx)
+
+    time.AfterFunc(50 * time.Millisecond, cancel)
+
+    // 1000 bytes at 100 bytes per second would take 10 seconds.
+    start := time.Now()
+    _, err := limiter.Intercept(SentByClient, make([]byte, 1000))
+    if err != context.Canceled {
+        t.Fatalf("expected context.Canceled; actual: %v", err)
+    }
+
+    if elapsed := time.Since(start); elapsed > time.Second {
+        t.Errorf("expected the wait to end with the session; actual %s", elapsed)
+    }
+}
+
+
+func ExampleLog() {
+    monitor := &Monitor{Logger: log.New(os.Stdout, "monitor: ", 0)}
+    interceptor := Log(monitor)(context.Background())
+
+    _, _ = interceptor.Intercept(SentByClient, []byte("ping"))
+    _, _ = interceptor.Intercept(SentByServer, []byte("pong"))
+
+    // Output:
+    // monitor: client: ping
+    // monitor: server: pong
+}
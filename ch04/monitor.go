@@ -0,0 +1,17 @@
+package main
+
+import (
+	"log"
+)
+
+
+// Monitor embeds a log.Logger meant for logging network traffic.
+type Monitor struct {
+    *log.Logger
+}
+
+
+// Write implements the io.Writer interface.
+func (monitor *Monitor) Write(traffic []byte) (int, error)  {
+    return len(traffic), monitor.Output(2, string(traffic))
+}
@@ -7,17 +7,6 @@ import (
 	"os"
 )
 
-// Monitor embeds a log.Logger meant for logging network traffic.
-type Monitor struct {
-    *log.Logger
-}
-
-
-// Write implements the io.Writer interface.
-func (monitor *Monitor) Write(traffic []byte) (int, error)  {
-    return len(traffic), monitor.Output(2, string(traffic))
-}
-
 
 func ExampleMonitor() {
     monitor := &Monitor{Logger: log.New(os.Stdout, "monitor: ", 0)}
@@ -0,0 +1,294 @@
+package main
+
+import (
+    "encoding/binary"
+    "io"
+    "net"
+    "net/netip"
+    "sync"
+)
+
+
+// pcapng blocks and the raw IP link type, from the pcapng specification.
+const (
+    pcapngSectionHeader uint32 = 0x0A0D0D0A
+    pcapngInterfaceDescription uint32 = 0x00000001
+    pcapngEnhancedPacket uint32 = 0x00000006
+    pcapngByteOrderMagic uint32 = 0x1A2B3C4D
+    linkTypeRaw uint16 = 101
+
+    protocolTCP = 6
+    protocolUDP = 17
+
+    // maxTCPSegment is the most data a synthesized TCP segment carries, so
+    // that the segment fits the length field of an IPv4 or IPv6 header.
+    maxTCPSegment = 0xFFFF - 40 - 20
+)
+
+
+type flow struct {
+    source, destination netip.AddrPort
+}
+
+
+// PcapngRecorder writes records as a pcapng capture that Wireshark can open.
+// Each record becomes one raw IP packet with synthesized IPv4 or IPv6 and TCP
+// or UDP headers. TCP sequence and acknowledgment numbers follow the bytes
+// recorded per direction, so stream reassembly works. Addresses that are not
+// IP based, such as Unix sockets, appear as 0.0.0.0:0.
+type PcapngRecorder struct {
+    mu sync.Mutex
+    writer io.Writer
+    sequence map[flow]uint32 // the next sequence number per direction
+}
+
+// NewPcapngRecorder writes the section header and the interface description
+// to writer and returns a recorder appending packets to it.
+func NewPcapngRecorder(writer io.Writer) (*PcapngRecorder, error) {
+    // Section header block: type, length, byte-order magic, version 1.0,
+    // unknown section length, length.
+    header := make([]byte, 0, 28 + 20)
+    header = binary.LittleEndian.AppendUint32(header, pcapngSectionHeader)
+    header = binary.LittleEndian.AppendUint32(header, 28)
+    header = binary.LittleEndian.AppendUint32(header, pcapngByteOrderMagic)
+    header = binary.LittleEndian.AppendUint16(header, 1)
+    header = binary.LittleEndian.AppendUint16(header, 0)
+    header = binary.LittleEndian.AppendUint64(header, ^uint64(0))
+    header = binary.LittleEndian.AppendUint32(header, 28)
+
+    // Interface description block: type, length, link type, reserved,
+    // unlimited snap length, length. Timestamps default to microseconds.
+    header = binary.LittleEndian.AppendUint32(header, pcapngInterfaceDescription)
+    header = binary.LittleEndian.AppendUint32(header, 20)
+    header = binary.LittleEndian.AppendUint16(header, linkTypeRaw)
+    header = binary.LittleEndian.AppendUint16(header, 0)
+    header = binary.LittleEndian.AppendUint32(header, 0)
+    header = binary.LittleEndian.AppendUint32(header, 20)
+
+    _, err := writer.Write(header)
+    if err != nil {
+        return nil, err
+    }
+
+    return &PcapngRecorder{writer: writer, sequence: make(map[flow]uint32)}, nil
+}
+
+func (recorder *PcapngRecorder) Record(record Record) error {
+    recorder.mu.Lock()
+    defer recorder.mu.Unlock()
+
+    source, destination := addrPort(record.Source()), addrPort(record.Destination())
+
+    if record.Local != nil && isUDP(record.Local.Network()) {
+        transport := udpHeader(source, destination, record.Data)
+        return recorder.writePacket(record, protocolUDP, transport, record.Data)
+    }
+
+    forward := flow{source, destination}
+    seq, ok := recorder.sequence[forward]
+    if !ok {
+        seq = 1
+    }
+    ack, ok := recorder.sequence[flow{destination, source}]
+    if !ok {
+        ack = 1
+    }
+
+    // The IP length fields cannot describe larger writes, so they go out as
+    // several segments, as they would on the wire.
+    for data := record.Data; len(data) > 0; {
+        segment := data[:min(len(data), maxTCPSegment)]
+        data = data[len(segment):]
+
+        transport := tcpHeader(source, destination, seq, ack, segment)
+        seq += uint32(len(segment))
+
+        if err := recorder.writePacket(record, protocolTCP, transport, segment); err != nil {
+            recorder.sequence[forward] = seq
+            return err
+        }
+    }
+
+    recorder.sequence[forward] = seq
+
+    return nil
+}
+
+// Closed forgets the sequence numbers of the connection between local and
+// remote, which a TapConn reports when it closes.
+func (recorder *PcapngRecorder) Closed(local, remote net.Addr) {
+    recorder.mu.Lock()
+    defer recorder.mu.Unlock()
+
+    source, destination := addrPort(local), addrPort(remote)
+    delete(recorder.sequence, flow{source, destination})
+    delete(recorder.sequence, flow{destination, source})
+}
+
+// writePacket writes the IP packet carrying the transport header and data as
+// an enhanced packet block.
+func (recorder *PcapngRecorder) writePacket(record Record, protocol uint8, transport, data []byte) error {
+    source, destination := addrPort(record.Source()), addrPort(record.Destination())
+
+    packet := ipHeader(source.Addr(), destination.Addr(), protocol, len(transport) + len(data))
+    packet = append(packet, transport...)
+    packet = append(packet, data...)
+
+    padding := (4 - len(packet) % 4) % 4
+    blockLength := uint32(32 + len(packet) + padding)
+    micros := uint64(record.Time.UnixMicro())
+
+    // Enhanced packet block: type, length, interface 0, timestamp high and
+    // low, captured and original length, padded packet, length.
+    block := make([]byte, 0, blockLength)
+    block = binary.LittleEndian.AppendUint32(block, pcapngEnhancedPacket)
+    block = binary.LittleEndian.AppendUint32(block, blockLength)
+    block = binary.LittleEndian.AppendUint32(block, 0)
+    block = binary.LittleEndian.AppendUint32(block, uint32(micros >> 32))
+    block = binary.LittleEndian.AppendUint32(block, uint32(micros))
+    block = binary.LittleEndian.AppendUint32(block, uint32(len(packet)))
+    block = binary.LittleEndian.AppendUint32(block, uint32(len(packet)))
+    block = append(block, packet...)
+    block = append(block, make([]byte, padding)...)
+    block = binary.LittleEndian.AppendUint32(block, blockLength)
+
+    _, err := recorder.writer.Write(block)
+
+    return err
+}
+
+
+func isUDP(network string) bool {
+    return network == "udp" || network == "udp4" || network == "udp6"
+}
+
+
+func addrPort(addr net.Addr) netip.AddrPort {
+    var (
+        ip net.IP
+        port int
+    )
+
+    switch a := addr.(type) {
+    case *net.TCPAddr:
+        ip, port = a.IP, a.Port
+    case *net.UDPAddr:
+        ip, port = a.IP, a.Port
+    }
+
+    address, ok := netip.AddrFromSlice(ip)
+    if !ok {
+        return netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+    }
+
+    return netip.AddrPortFrom(address.Unmap(), uint16(port))
+}
+
+
+func ipHeader(source, destination netip.Addr, protocol uint8, payloadLength int) []byte {
+    // Mixed families cannot share a header, so fall back to IPv6 for both.
+    if source.Is4() && destination.Is4() {
+        header := make([]byte, 20)
+        header[0] = 0x45 // version 4, 5 words
+        binary.BigEndian.PutUint16(header[2:], uint16(20 + payloadLength))
+        binary.BigEndian.PutUint16(header[6:], 0x4000) // don't fragment
+        header[8] = 64 // TTL
+        header[9] = protocol
+        copy(header[12:16], source.AsSlice())
+        copy(header[16:20], destination.AsSlice())
+        binary.BigEndian.PutUint16(header[10:], ^onesComplementSum(0, header))
+
+        return header
+    }
+
+    header := make([]byte, 40)
+    header[0] = 0x60 // version 6
+    binary.BigEndian.PutUint16(header[4:], uint16(payloadLength))
+    header[6] = protocol
+    header[7] = 64 // hop limit
+    src, dst := source.As16(), destination.As16()
+    copy(header[8:24], src[:])
+    copy(header[24:40], dst[:])
+
+    return header
+}
+
+
+func tcpHeader(source, destination netip.AddrPort, seq, ack uint32, data []byte) []byte {
+    header := make([]byte, 20)
+    binary.BigEndian.PutUint16(header[0:], source.Port())
+    binary.BigEndian.PutUint16(header[2:], destination.Port())
+    binary.BigEndian.PutUint32(header[4:], seq)
+    binary.BigEndian.PutUint32(header[8:], ack)
+    header[12] = 5 << 4 // 5 words
+    header[13] = 0x18 // PSH, ACK
+    binary.BigEndian.PutUint16(header[14:], 0xFFFF) // window
+    binary.BigEndian.PutUint16(header[16:], transportChecksum(source.Addr(), destination.Addr(), protocolTCP, header, data))
+
+    return header
+}
+
+
+func udpHeader(source, destination netip.AddrPort, data []byte) []byte {
+    header := make([]byte, 8)
+    binary.BigEndian.PutUint16(header[0:], source.Port())
+    binary.BigEndian.PutUint16(header[2:], destination.Port())
+    binary.BigEndian.PutUint16(header[4:], uint16(8 + len(data)))
+    binary.BigEndian.PutUint16(header[6:], transportChecksum(source.Addr(), destination.Addr(), protocolUDP, header, data))
+
+    return header
+}
+
+
+// transportChecksum computes the TCP or UDP checksum over the IP pseudo-header,
+// the transport header and the data.
+func transportChecksum(source, destination netip.Addr, protocol uint8, header, data []byte) uint16 {
+    length := uint32(len(header) + len(data))
+
+    var pseudo []byte
+    if source.Is4() && destination.Is4() {
+        pseudo = append(pseudo, source.AsSlice()...)
+        pseudo = append(pseudo, destination.AsSlice()...)
+        pseudo = append(pseudo, 0, protocol)
+        pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(length))
+    } else {
+        src, dst := source.As16(), destination.As16()
+        pseudo = append(pseudo, src[:]...)
+        pseudo = append(pseudo, dst[:]...)
+        pseudo = binary.BigEndian.AppendUint32(pseudo, length)
+        pseudo = append(pseudo, 0, 0, 0, protocol)
+    }
+
+    // The pseudo-header and the headers have even lengths, so only the data
+    // may need padding.
+    sum := onesComplementSum(0, pseudo)
+    sum = onesComplementSum(uint32(sum), header)
+    sum = onesComplementSum(uint32(sum), data)
+
+    checksum := ^sum
+    if checksum == 0 && protocol == protocolUDP {
+        // Zero means "no checksum" for UDP.
+        checksum = 0xFFFF
+    }
+
+    return checksum
+}
+
+
+func onesComplementSum(initial uint32, buf []byte) uint16 {
+    sum := initial
+
+    for i := 0; i + 1 < len(buf); i += 2 {
+        sum += uint32(binary.BigEndian.Uint16(buf[i:]))
+    }
+
+    if len(buf) % 2 == 1 {
+        sum += uint32(buf[len(buf) - 1]) << 8
+    }
+
+    for sum > 0xFFFF {
+        sum = sum >> 16 + sum & 0xFFFF
+    }
+
+    return uint16(sum)
+}
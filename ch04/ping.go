@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"os"
+	"os/signal"
 	"time"
+
+	"github.com/bgabor666/gnp/ch03"
+	echo "github.com/bgabor666/gnp/ch05"
+	"github.com/bgabor666/gnp/neterr"
 )
 
 
@@ -13,12 +20,24 @@ var (
     count = flag.Int("c", 3, "number of pings: <= 0 means forever")
     interval = flag.Duration("i", time.Second, "interval between pings")
     timeout = flag.Duration("W", 5*time.Second, "time to wait for a reply")
+    jsonOutput = flag.Bool("json", false, "print results as JSON lines")
+    csvOutput = flag.Bool("csv", false, "print results as CSV")
+    quiet = flag.Bool("q", false, "only print the summary")
+    targetFile = flag.String("f", "", "read targets from file, one per line")
+    workers = flag.Int("w", 16, "number of targets to ping concurrently")
+    mode = flag.String("m", "tcp", "what to time: tcp (handshake), echo, udp (echo), tlv, tftp or http")
+    size = flag.Int("s", 56, "payload size in bytes for echo and tlv pings")
+    noDelay = flag.Bool("nodelay", true, "disable Nagle's algorithm on kept-open connections")
+    discover = flag.String("discover", "", "also ping the services of this type that answer discovery queries on the LAN, e.g. echo or tftp")
+    breakAfter = flag.Int("breaker", 0, "skip a target for 30s after this many failed dials in a row: 0 means never")
 )
 
 
 func init() {
     flag.Usage = func() {
-        fmt.Printf("Usage: %s [options] host:port\nOptions:\n", os.Args[0])
+        fmt.Printf("Usage: %s [options] host:port ...\n", os.Args[0])
+        fmt.Print("Hosts may be CIDR prefixes and ports may be lists and ranges, e.g. 10.0.0.0/30:22,80-81\n")
+        fmt.Print("Options:\n")
         flag.PrintDefaults()
     }
 }
@@ -27,39 +46,203 @@ func init() {
 func main() {
     flag.Parse()
 
-    if flag.NArg() != 1 {
+    if flag.NArg() == 0 && *targetFile == "" && *discover == "" {
         fmt.Print("host:port is required\n\n")
         flag.Usage()
         os.Exit(1)
     }
 
-    target := flag.Arg(0)
-    fmt.Println("PING", target)
+    targets, err := collectTargets()
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+
+    var reporter pingReporter
+
+    switch {
+    case *jsonOutput && *csvOutput:
+        fmt.Print("-json and -csv are mutually exclusive\n\n")
+        flag.Usage()
+        os.Exit(1)
+    case *jsonOutput:
+        reporter, err = newPingReporter(os.Stdout, "json", *quiet)
+    case *csvOutput:
+        reporter, err = newPingReporter(os.Stdout, "csv", *quiet)
+    case len(targets) > 1:
+        rows := 0
+        if !*quiet {
+            rows = terminalRows(os.Stdout)
+        }
+        reporter = newTableReporter(os.Stdout, rows)
+    default:
+        reporter, err = newPingReporter(os.Stdout, "text", *quiet)
+    }
+
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+
+    for _, target := range targets {
+        reporter.start(target)
+    }
 
-    if *count <= 0 {
+    if *count <= 0 && !*jsonOutput && !*csvOutput {
         fmt.Println("CTRL+C to stop.")
     }
 
-    msg := 0
+    // Stop on CTRL+C but still print the summary.
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+    defer stop()
+
+    failed := ping(ctx, targets, reporter)
+
+    err = reporter.flush()
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        failed = true
+    }
+
+    if failed {
+        os.Exit(1)
+    }
+}
+
+
+func collectTargets() ([]string, error) {
+    var targets []string
+
+    if *targetFile != "" {
+        file, err := os.Open(*targetFile)
+        if err != nil {
+            return nil, err
+        }
+        defer file.Close()
+
+        targets, err = readTargets(file)
+        if err != nil {
+            return nil, err
+        }
+    }
 
-    for (*count <= 0) || (msg < *count) {
-        msg++
-        fmt.Print(msg, " ")
+    for _, spec := range flag.Args() {
+        expanded, err := expandTargets(spec)
+        if err != nil {
+            return nil, err
+        }
 
-        start := time.Now()
-        connection, err := net.DialTimeout("tcp", target, *timeout)
-        duration := time.Since(start)
+        targets = append(targets, expanded...)
+    }
 
+    if *discover != "" {
+        services, err := echo.Browser{}.Browse(context.Background(), *discover)
         if err != nil {
-            fmt.Printf("fail in %s: %v\n", duration, err)
-            if netErr, ok := err.(net.Error); !ok || !netErr.Temporary() {
-                os.Exit(1)
+            return nil, err
+        }
+
+        for _, service := range services {
+            targets = append(targets, service.Addr)
+        }
+    }
+
+    // Probers are kept per target, so each target must be probed by a
+    // single worker at a time.
+    targets = dedupeTargets(targets)
+
+    if len(targets) == 0 {
+        return nil, errors.New("no targets")
+    }
+
+    return targets, nil
+}
+
+
+// ping probes all targets every interval, count times, and reports the
+// summaries. A single target stops at the first error that is not retryable,
+// while sweeps keep going since closed ports are expected. It returns true if
+// pinging stopped on such an error.
+func ping(ctx context.Context, targets []string, reporter pingReporter) bool {
+    stats := make([]pingStats, len(targets))
+    failed := false
+
+    options := proberOptions{timeout: *timeout, size: *size, noDelay: *noDelay}
+    if *breakAfter > 0 {
+        // Probes must not retry, or they would hide the loss.
+        options.breaker = &ch03.RetryDialer{MaxAttempts: 1, FailureThreshold: *breakAfter}
+    }
+
+    // Echo and TLV probes reuse their connections between rounds.
+    options.pool = options.connPool()
+    defer options.pool.Close()
+
+    probers := make(map[string]prober, len(targets))
+    for _, target := range targets {
+        p, err := newProber(*mode, target, options)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            return true
+        }
+
+        probers[target] = p
+        defer p.Close()
+    }
+
+    for round := 1; (*count <= 0) || (round <= *count); round++ {
+        results := make(chan sweepResult)
+
+        go func() {
+            defer close(results)
+            sweep(ctx, targets, *workers, func(target string) (time.Duration, error) {
+                return probers[target].probe()
+            }, results)
+        }()
+
+        for result := range results {
+            stats[result.target].add(result.rtt, result.err)
+            reporter.probe(targets[result.target], round, result.rtt, result.err)
+
+            if len(targets) == 1 && result.err != nil {
+                // An open circuit only means the target is being skipped.
+                if !neterr.Retryable(result.err) && !errors.Is(result.err, ch03.ErrCircuitOpen) {
+                    failed = true
+                }
             }
-        } else {
-            _ = connection.Close()
-            fmt.Println(duration)
         }
 
-        time.Sleep(*interval)
+        if failed || (*count > 0 && round == *count) {
+            break
+        }
+
+        select {
+        case <-ctx.Done():
+        case <-time.After(*interval):
+        }
+
+        if ctx.Err() != nil {
+            break
+        }
+    }
+
+    for i, target := range targets {
+        reporter.summary(target, stats[i].summary())
     }
+
+    return failed
+}
+
+
+// tcpPing times a TCP handshake with target and closes the connection.
+func tcpPing(target string, timeout time.Duration) (time.Duration, error) {
+    start := time.Now()
+    connection, err := net.DialTimeout("tcp", target, timeout)
+    duration := time.Since(start)
+
+    if err != nil {
+        return duration, err
+    }
+
+    _ = connection.Close()
+
+    return duration, nil
 }
@@ -0,0 +1,346 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "time"
+
+    "github.com/bgabor666/gnp/ch03"
+    echo "github.com/bgabor666/gnp/ch05"
+    tftp "github.com/bgabor666/gnp/ch06"
+)
+
+
+// prober measures one round trip to a target. Probers other than the TCP
+// handshake keep their connection open between probes, so they time the
+// service rather than connection setup, and reconnect after a failure. Echo
+// and TLV probers check their connections out of a ch03.ConnPool.
+type prober interface {
+    probe() (time.Duration, error)
+    Close() error
+}
+
+
+type proberOptions struct {
+    timeout time.Duration
+    size int // the payload size of echo and TLV probes
+    noDelay bool // disables Nagle's algorithm on TCP probes
+    breaker *ch03.RetryDialer // if set, skips targets whose circuit is open
+    pool *ch03.ConnPool // where echo and TLV probes keep their connections; nil means a pool of the prober's own
+}
+
+
+// dial connects to target over TCP within the probe timeout.
+func (options proberOptions) dial(ctx context.Context, target string) (net.Conn, error) {
+    ctx, cancel := context.WithTimeout(ctx, options.timeout)
+    defer cancel()
+
+    if options.breaker != nil {
+        return options.breaker.DialContext(ctx, "tcp", target)
+    }
+
+    var dialer net.Dialer
+
+    return dialer.DialContext(ctx, "tcp", target)
+}
+
+
+// connPool returns a pool for stream probes that dials as dial does. A probe
+// needs a single connection per target.
+func (options proberOptions) connPool() *ch03.ConnPool {
+    return &ch03.ConnPool{
+        MaxIdle: 1,
+        Dial: func(ctx context.Context, _, address string) (net.Conn, error) {
+            return options.dial(ctx, address)
+        },
+    }
+}
+
+
+func newProber(mode, target string, options proberOptions) (prober, error) {
+    switch mode {
+    case "tcp":
+        return &handshakeProber{target: target, options: options}, nil
+    case "echo":
+        return newStreamProber(target, options, echoExchange), nil
+    case "tlv":
+        return newStreamProber(target, options, tlvExchange), nil
+    case "udp":
+        return &udpProber{target: target, options: options}, nil
+    case "tftp":
+        return &tftpProber{target: target, timeout: options.timeout}, nil
+    case "http":
+        return newHTTPProber(target, options), nil
+    default:
+        return nil, fmt.Errorf("unknown ping mode %q", mode)
+    }
+}
+
+
+// handshakeProber times the TCP handshake alone.
+type handshakeProber struct {
+    target string
+    options proberOptions
+}
+
+func (p *handshakeProber) probe() (time.Duration, error) {
+    start := time.Now()
+    connection, err := p.options.dial(context.Background(), p.target)
+    duration := time.Since(start)
+
+    if err != nil {
+        return duration, err
+    }
+
+    _ = connection.Close()
+
+    return duration, nil
+}
+
+func (p *handshakeProber) Close() error { return nil }
+
+
+// streamProber times an exchange over a TCP connection it keeps open in a
+// pool between probes.
+type streamProber struct {
+    target string
+    options proberOptions
+    exchange func(connection net.Conn, size int) error
+    pool *ch03.ConnPool
+    ownPool bool // the pool is the prober's to close
+}
+
+func newStreamProber(target string, options proberOptions, exchange func(net.Conn, int) error) *streamProber {
+    p := &streamProber{target: target, options: options, exchange: exchange, pool: options.pool}
+    if p.pool == nil {
+        p.pool, p.ownPool = options.connPool(), true
+    }
+
+    return p
+}
+
+func (p *streamProber) probe() (time.Duration, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), p.options.timeout)
+    connection, err := p.pool.Get(ctx, p.target)
+    cancel()
+    if err != nil {
+        return 0, err
+    }
+    defer connection.Close()
+
+    if tcpConn, ok := connection.NetConn().(*net.TCPConn); ok {
+        _ = tcpConn.SetNoDelay(p.options.noDelay)
+    }
+
+    err = connection.SetDeadline(time.Now().Add(p.options.timeout))
+    if err != nil {
+        return 0, err
+    }
+
+    start := time.Now()
+    err = p.exchange(connection, p.options.size)
+    duration := time.Since(start)
+
+    if err != nil {
+        // The stream may be out of step now, so start over next time.
+        _ = connection.Discard()
+    }
+
+    return duration, err
+}
+
+func (p *streamProber) Close() error {
+    if !p.ownPool {
+        return nil
+    }
+
+    return p.pool.Close()
+}
+
+
+// echoExchange writes size bytes and expects the same bytes back.
+func echoExchange(connection net.Conn, size int) error {
+    msg := bytes.Repeat([]byte("p"), size)
+
+    _, err := connection.Write(msg)
+    if err != nil {
+        return err
+    }
+
+    reply := make([]byte, size)
+    _, err = io.ReadFull(connection, reply)
+    if err != nil {
+        return err
+    }
+
+    if !bytes.Equal(msg, reply) {
+        return errors.New("echo mismatch")
+    }
+
+    return nil
+}
+
+
+// tlvExchange writes a Binary frame of size bytes and waits for any frame in
+// reply.
+func tlvExchange(connection net.Conn, size int) error {
+    msg := Binary(bytes.Repeat([]byte("p"), size))
+
+    _, err := msg.WriteTo(connection)
+    if err != nil {
+        return err
+    }
+
+    _, err = NewDecoder(connection, DecoderOptions{}).Decode()
+
+    return err
+}
+
+
+// udpProber times an echo over UDP, matching the reply to the probe by a
+// nonce.
+type udpProber struct {
+    target string
+    options proberOptions
+    connection *echo.ClientConn
+}
+
+func (p *udpProber) probe() (time.Duration, error) {
+    if p.connection == nil {
+        ctx, cancel := context.WithTimeout(context.Background(), p.options.timeout)
+        connection, err := echo.UDPClient{Attempts: 1, Timeout: p.options.timeout}.Dial(ctx, p.target)
+        cancel()
+        if err != nil {
+            return 0, err
+        }
+
+        p.connection = connection
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), p.options.timeout)
+    defer cancel()
+
+    msg := bytes.Repeat([]byte("p"), p.options.size)
+
+    start := time.Now()
+    reply, err := p.connection.ExchangeNonce(ctx, msg)
+    duration := time.Since(start)
+
+    if err == nil && !bytes.Equal(msg, reply) {
+        err = errors.New("echo mismatch")
+    }
+
+    return duration, err
+}
+
+func (p *udpProber) Close() error {
+    if p.connection == nil {
+        return nil
+    }
+
+    err := p.connection.Close()
+    p.connection = nil
+
+    return err
+}
+
+
+// tftpProber times a read request until the first DATA or ERROR packet.
+type tftpProber struct {
+    target string
+    timeout time.Duration
+}
+
+func (p *tftpProber) probe() (time.Duration, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+    defer cancel()
+
+    // The server answers from a new port, so the socket cannot be connected.
+    connection, err := echo.UDPClient{AnyPort: true, Attempts: 1, Timeout: p.timeout}.Dial(ctx, p.target)
+    if err != nil {
+        return 0, err
+    }
+    defer connection.Close()
+
+    rrq, err := tftp.ReadReq{Filename: "ping", Mode: "octet"}.MarshalBinary()
+    if err != nil {
+        return 0, err
+    }
+
+    var (
+        data tftp.Data
+        errPkt tftp.TFTPError
+    )
+
+    start := time.Now()
+    reply, addr, err := connection.Exchange(ctx, rrq, func(reply []byte) bool {
+        // The server is alive even if it has no such file.
+        return data.UnmarshalBinary(reply) == nil || errPkt.UnmarshalBinary(reply) == nil
+    })
+    duration := time.Since(start)
+    if err != nil {
+        return duration, err
+    }
+
+    if data.UnmarshalBinary(reply) == nil {
+        // Abort the transfer so the server stops retransmitting.
+        abort, _ := tftp.TFTPError{Error: tftp.ErrUnknown, Message: "ping"}.MarshalBinary()
+        _, _ = connection.WriteTo(abort, addr)
+    }
+
+    return duration, nil
+}
+
+func (p *tftpProber) Close() error { return nil }
+
+
+// httpProber times HEAD requests over a kept-alive connection.
+type httpProber struct {
+    url string
+    client *http.Client
+}
+
+func newHTTPProber(target string, options proberOptions) *httpProber {
+    transport := &http.Transport{
+        DialContext: func(ctx context.Context, _, address string) (net.Conn, error) {
+            connection, err := options.dial(ctx, address)
+            if tcpConn, ok := connection.(*net.TCPConn); ok {
+                _ = tcpConn.SetNoDelay(options.noDelay)
+            }
+            return connection, err
+        },
+        MaxIdleConnsPerHost: 1,
+        DisableCompression: true,
+    }
+
+    return &httpProber{
+        url: "http://" + target + "/",
+        client: &http.Client{Transport: transport, Timeout: options.timeout},
+    }
+}
+
+func (p *httpProber) probe() (time.Duration, error) {
+    start := time.Now()
+
+    resp, err := p.client.Head(p.url)
+    duration := time.Since(start)
+    if err != nil {
+        return duration, err
+    }
+
+    // Always close this without exception.
+    _ = resp.Body.Close()
+
+    return duration, nil
+}
+
+func (p *httpProber) Close() error {
+    p.client.CloseIdleConnections()
+
+    return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync/atomic"
+    "syscall"
+    "testing"
+    "time"
+
+    "github.com/bgabor666/gnp/ch03"
+    echo "github.com/bgabor666/gnp/ch05"
+    tftp "github.com/bgabor666/gnp/ch06"
+    "github.com/bgabor666/gnp/internal/testserver"
+)
+
+
+func probeTwice(t *testing.T, mode, target string) {
+    p, err := newProber(mode, target, proberOptions{timeout: time.Second, size: 56, noDelay: true})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer p.Close()
+
+    for i := 0; i < 2; i++ {
+        rtt, err := p.probe()
+        if err != nil {
+            t.Fatalf("%s: %v", mode, err)
+        }
+        t.Logf("%s: %s", mode, rtt)
+    }
+}
+
+
+func TestStreamProbersKeepConnection(t *testing.T) {
+    echo, echoAccepted := testserver.Counting(t, func(c net.Conn) {
+        _, _ = io.Copy(c, c)
+    })
+
+    tlv, tlvAccepted := testserver.Counting(t, func(c net.Conn) {
+        for {
+            payload, err := decode(c)
+            if err != nil {
+                return
+            }
+            _, _ = payload.WriteTo(c)
+        }
+    })
+
+    probeTwice(t, "echo", echo.Addr().String())
+    probeTwice(t, "tlv", tlv.Addr().String())
+
+    for mode, accepted := range map[string]*int32{"echo": echoAccepted, "tlv": tlvAccepted} {
+        if n := atomic.LoadInt32(accepted); n != 1 {
+            t.Errorf("%s: expected 1 connection; actual %d", mode, n)
+        }
+    }
+}
+
+
+func TestUDPProber(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    addr, err := new(echo.UDPServer).ListenAndServe(ctx, "127.0.0.1:")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    probeTwice(t, "udp", addr.String())
+
+    // Nothing listens on the port any more, so the probe is refused.
+    cancel()
+    time.Sleep(10 * time.Millisecond)
+
+    p, err := newProber("udp", addr.String(), proberOptions{timeout: time.Second})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer p.Close()
+
+    if _, err = p.probe(); !errors.Is(err, syscall.ECONNREFUSED) {
+        t.Errorf("expected a refused probe; actual %v", err)
+    }
+}
+
+
+func TestTFTPProber(t *testing.T) {
+    connection, err := net.ListenPacket("udp", "127.0.0.1:")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer connection.Close()
+
+    server := tftp.Server{Payload: []byte(strings.Repeat("x", tftp.BlockSize * 2)), Timeout: 100 * time.Millisecond, Retries: 1}
+    go func() {
+        _ = server.Serve(connection)
+    }()
+
+    probeTwice(t, "tftp", connection.LocalAddr().String())
+}
+
+
+func TestHTTPProber(t *testing.T) {
+    var requests int32
+
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        atomic.AddInt32(&requests, 1)
+        if r.Method != http.MethodHead {
+            t.Errorf("expected HEAD; actual %s", r.Method)
+        }
+    }))
+    defer server.Close()
+
+    probeTwice(t, "http", strings.TrimPrefix(server.URL, "http://"))
+
+    if n := atomic.LoadInt32(&requests); n != 2 {
+        t.Errorf("expected 2 requests; actual %d", n)
+    }
+}
+
+
+func TestProberCircuitBreaker(t *testing.T) {
+    listener, err := net.Listen("tcp", "127.0.0.1:")
+    if err != nil {
+        t.Fatal(err)
+    }
+    _ = listener.Close()
+
+    options := proberOptions{
+        timeout: time.Second,
+        breaker: &ch03.RetryDialer{MaxAttempts: 1, FailureThreshold: 2},
+    }
+
+    handshake, _ := newProber("tcp", listener.Addr().String(), options)
+    for i := 0; i < 2; i++ {
+        if _, err := handshake.probe(); !errors.Is(err, syscall.ECONNREFUSED) {
+            t.Fatalf("%d: expected a refused connection; actual %v", i, err)
+        }
+    }
+
+    // The open circuit covers every prober sharing the breaker.
+    echo, _ := newProber("echo", listener.Addr().String(), options)
+    defer echo.Close()
+
+    for _, p := range []prober{handshake, echo} {
+        if _, err := p.probe(); !errors.Is(err, ch03.ErrCircuitOpen) {
+            t.Errorf("expected %v; actual %v", ch03.ErrCircuitOpen, err)
+        }
+    }
+}
+
+
+func TestUnknownPingMode(t *testing.T) {
+    if _, err := newProber("icmp", "127.0.0.1:7", proberOptions{}); err == nil {
+        t.Error("expected an error")
+    }
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+    "encoding/csv"
+    "encoding/json"
+    "fmt"
+    "io"
+    "strconv"
+    "time"
+
+    "github.com/bgabor666/gnp/neterr"
+)
+
+
+// pingReporter prints the ping tool's results in one output format.
+type pingReporter interface {
+    start(target string)
+    probe(target string, seq int, rtt time.Duration, err error)
+    summary(target string, summary pingSummary)
+    flush() error
+}
+
+
+func newPingReporter(writer io.Writer, format string, quiet bool) (pingReporter, error) {
+    switch format {
+    case "text":
+        return &textReporter{writer: writer, quiet: quiet}, nil
+    case "json":
+        return &jsonReporter{encoder: json.NewEncoder(writer), quiet: quiet}, nil
+    case "csv":
+        return &csvReporter{writer: csv.NewWriter(writer), quiet: quiet}, nil
+    default:
+        return nil, fmt.Errorf("unknown output format %q", format)
+    }
+}
+
+
+// milliseconds renders d as fractional milliseconds for machine-readable output.
+func milliseconds(d time.Duration) float64 {
+    return float64(d) / float64(time.Millisecond)
+}
+
+
+type textReporter struct {
+    writer io.Writer
+    quiet bool
+}
+
+func (reporter *textReporter) start(target string) {
+    fmt.Fprintln(reporter.writer, "PING", target)
+}
+
+func (reporter *textReporter) probe(_ string, seq int, rtt time.Duration, err error) {
+    if reporter.quiet {
+        return
+    }
+
+    if err != nil {
+        fmt.Fprintf(reporter.writer, "%d fail (%s) in %s: %v\n", seq, neterr.Classify(err), rtt, err)
+        return
+    }
+
+    fmt.Fprintln(reporter.writer, seq, rtt)
+}
+
+func (reporter *textReporter) summary(target string, s pingSummary) {
+    fmt.Fprintf(reporter.writer, "--- %s ping statistics ---\n", target)
+    fmt.Fprintf(reporter.writer, "%d sent, %d received, %.1f%% loss\n", s.Sent, s.Received, s.Loss)
+
+    if s.Received > 0 {
+        fmt.Fprintf(reporter.writer, "rtt min/avg/max/stddev = %s/%s/%s/%s\n", s.Min, s.Avg, s.Max, s.StdDev)
+        fmt.Fprintf(reporter.writer, "rtt p50/p90/p99 = %s/%s/%s\n", s.P50, s.P90, s.P99)
+    }
+}
+
+func (reporter *textReporter) flush() error { return nil }
+
+
+type jsonProbe struct {
+    Type string `json:"type"`
+    Target string `json:"target"`
+    Seq int `json:"seq"`
+    RTT float64 `json:"rtt_ms"`
+    Error string `json:"error,omitempty"`
+    Class string `json:"class,omitempty"` // the error's neterr class
+}
+
+type jsonSummary struct {
+    Type string `json:"type"`
+    Target string `json:"target"`
+    Sent int `json:"sent"`
+    Received int `json:"received"`
+    Loss float64 `json:"loss_pct"`
+    Min float64 `json:"min_ms"`
+    Avg float64 `json:"avg_ms"`
+    Max float64 `json:"max_ms"`
+    StdDev float64 `json:"stddev_ms"`
+    P50 float64 `json:"p50_ms"`
+    P90 float64 `json:"p90_ms"`
+    P99 float64 `json:"p99_ms"`
+}
+
+
+// jsonReporter writes one JSON object per line.
+type jsonReporter struct {
+    encoder *json.Encoder
+    quiet bool
+    err error
+}
+
+func (reporter *jsonReporter) start(string) {}
+
+func (reporter *jsonReporter) probe(target string, seq int, rtt time.Duration, err error) {
+    if reporter.quiet {
+        return
+    }
+
+    probe := jsonProbe{Type: "probe", Target: target, Seq: seq, RTT: milliseconds(rtt)}
+    if err != nil {
+        probe.Error = err.Error()
+        probe.Class = neterr.Classify(err).String()
+    }
+
+    reporter.encode(probe)
+}
+
+func (reporter *jsonReporter) summary(target string, s pingSummary) {
+    reporter.encode(jsonSummary{
+        Type: "summary",
+        Target: target,
+        Sent: s.Sent,
+        Received: s.Received,
+        Loss: s.Loss,
+        Min: milliseconds(s.Min),
+        Avg: milliseconds(s.Avg),
+        Max: milliseconds(s.Max),
+        StdDev: milliseconds(s.StdDev),
+        P50: milliseconds(s.P50),
+        P90: milliseconds(s.P90),
+        P99: milliseconds(s.P99),
+    })
+}
+
+func (reporter *jsonReporter) encode(value interface{}) {
+    if reporter.err == nil {
+        reporter.err = reporter.encoder.Encode(value)
+    }
+}
+
+func (reporter *jsonReporter) flush() error { return reporter.err }
+
+
+// csvReporter writes probes and summaries as rows of a single table,
+// distinguished by the type column.
+type csvReporter struct {
+    writer *csv.Writer
+    quiet bool
+    header bool
+}
+
+var csvHeader = []string{
+    "type", "target", "seq", "rtt_ms", "error", "class",
+    "sent", "received", "loss_pct", "min_ms", "avg_ms", "max_ms", "stddev_ms", "p50_ms", "p90_ms", "p99_ms",
+}
+
+func (reporter *csvReporter) start(string) {
+    if !reporter.header {
+        reporter.header = true
+        _ = reporter.writer.Write(csvHeader)
+    }
+}
+
+func (reporter *csvReporter) probe(target string, seq int, rtt time.Duration, err error) {
+    if reporter.quiet {
+        return
+    }
+
+    var message, class string
+    if err != nil {
+        message, class = err.Error(), neterr.Classify(err).String()
+    }
+
+    row := make([]string, len(csvHeader))
+    copy(row, []string{"probe", target, strconv.Itoa(seq), formatMilliseconds(rtt), message, class})
+
+    _ = reporter.writer.Write(row)
+    reporter.writer.Flush()
+}
+
+func (reporter *csvReporter) summary(target string, s pingSummary) {
+    row := []string{"summary", target, "", "", "", ""}
+    row = append(row, strconv.Itoa(s.Sent), strconv.Itoa(s.Received), strconv.FormatFloat(s.Loss, 'f', 1, 64))
+
+    for _, d := range []time.Duration{s.Min, s.Avg, s.Max, s.StdDev, s.P50, s.P90, s.P99} {
+        row = append(row, formatMilliseconds(d))
+    }
+
+    _ = reporter.writer.Write(row)
+}
+
+func (reporter *csvReporter) flush() error {
+    reporter.writer.Flush()
+
+    return reporter.writer.Error()
+}
+
+
+func formatMilliseconds(d time.Duration) string {
+    return strconv.FormatFloat(milliseconds(d), 'f', 3, 64)
+}
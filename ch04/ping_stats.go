@@ -0,0 +1,105 @@
+package main
+
+import (
+    "math"
+    "math/rand/v2"
+    "slices"
+    "time"
+)
+
+
+// rttSamples is how many round-trip times pingStats keeps for percentiles.
+const rttSamples = 1024
+
+
+// pingStats collects the outcome of every ping sent to a target. The count,
+// extremes, mean and deviation cover every ping, while percentiles come from
+// a uniform sample of at most rttSamples round-trip times, so pinging
+// forever takes constant memory.
+type pingStats struct {
+    sent, received int
+    min, max time.Duration
+    mean, squares float64 // running mean and sum of squared deviations, in nanoseconds
+    samples []time.Duration // a reservoir of the successful pings' round-trip times
+    random *rand.Rand
+}
+
+func (stats *pingStats) add(rtt time.Duration, err error) {
+    stats.sent++
+
+    if err != nil {
+        return
+    }
+
+    stats.received++
+
+    if stats.received == 1 || rtt < stats.min {
+        stats.min = rtt
+    }
+    if rtt > stats.max {
+        stats.max = rtt
+    }
+
+    // Welford's online algorithm.
+    delta := float64(rtt) - stats.mean
+    stats.mean += delta / float64(stats.received)
+    stats.squares += delta * (float64(rtt) - stats.mean)
+
+    if len(stats.samples) < rttSamples {
+        stats.samples = append(stats.samples, rtt)
+        return
+    }
+
+    // Keep each round-trip time so far with equal probability.
+    if stats.random == nil {
+        stats.random = rand.New(rand.NewPCG(1, 2))
+    }
+    if i := stats.random.IntN(stats.received); i < rttSamples {
+        stats.samples[i] = rtt
+    }
+}
+
+
+type pingSummary struct {
+    Sent int
+    Received int
+    Loss float64 // percent
+    Min, Avg, Max, StdDev time.Duration
+    P50, P90, P99 time.Duration
+}
+
+func (stats *pingStats) summary() pingSummary {
+    summary := pingSummary{Sent: stats.sent, Received: stats.received}
+
+    if stats.sent > 0 {
+        summary.Loss = 100 * float64(stats.sent - summary.Received) / float64(stats.sent)
+    }
+
+    if summary.Received == 0 {
+        return summary
+    }
+
+    sorted := append([]time.Duration(nil), stats.samples...)
+    slices.Sort(sorted)
+
+    summary.Min = stats.min
+    summary.Max = stats.max
+    summary.Avg = time.Duration(stats.mean)
+    summary.StdDev = time.Duration(math.Sqrt(stats.squares / float64(stats.received)))
+    summary.P50 = percentile(sorted, 50)
+    summary.P90 = percentile(sorted, 90)
+    summary.P99 = percentile(sorted, 99)
+
+    return summary
+}
+
+
+// percentile returns the nearest-rank percentile p of sorted.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+    rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+    if rank < 1 {
+        rank = 1
+    }
+
+    return sorted[rank - 1]
+}
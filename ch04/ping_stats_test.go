@@ -0,0 +1,131 @@
+package main
+
+import (
+    "bytes"
+    "encoding/csv"
+    "encoding/json"
+    "errors"
+    "syscall"
+    "testing"
+    "time"
+)
+
+
+func TestPingSummary(t *testing.T) {
+    var stats pingStats
+
+    for i := 1; i <= 10; i++ {
+        stats.add(time.Duration(i) * time.Millisecond, nil)
+    }
+    stats.add(5 * time.Second, errors.New("i/o timeout"))
+    stats.add(5 * time.Second, errors.New("i/o timeout"))
+
+    actual := stats.summary()
+    expected := pingSummary{
+        Sent: 12,
+        Received: 10,
+        Loss: 100 * 2.0 / 12,
+        Min: time.Millisecond,
+        Avg: 5500 * time.Microsecond,
+        Max: 10 * time.Millisecond,
+        StdDev: 2872281 * time.Nanosecond,
+        P50: 5 * time.Millisecond,
+        P90: 9 * time.Millisecond,
+        P99: 10 * time.Millisecond,
+    }
+
+    if actual != expected {
+        t.Errorf("expected %+v; actual %+v", expected, actual)
+    }
+}
+
+
+func TestPingSummaryBounded(t *testing.T) {
+    var stats pingStats
+
+    // A uniform spread from 1µs to 100ms.
+    for i := 1; i <= 100000; i++ {
+        stats.add(time.Duration(i) * time.Microsecond, nil)
+    }
+
+    if len(stats.samples) != rttSamples {
+        t.Fatalf("expected %d samples kept; actual %d", rttSamples, len(stats.samples))
+    }
+
+    s := stats.summary()
+    if s.Received != 100000 || s.Min != time.Microsecond || s.Max != 100 * time.Millisecond {
+        t.Errorf("expected exact count and extremes; actual %+v", s)
+    }
+
+    if s.P50 < 45 * time.Millisecond || s.P50 > 55 * time.Millisecond {
+        t.Errorf("expected a median near 50ms; actual %s", s.P50)
+    }
+    if s.P90 < 85 * time.Millisecond || s.P90 > 95 * time.Millisecond {
+        t.Errorf("expected a 90th percentile near 90ms; actual %s", s.P90)
+    }
+}
+
+
+func TestPingSummaryAllLost(t *testing.T) {
+    var stats pingStats
+    stats.add(time.Second, errors.New("connection refused"))
+
+    actual := stats.summary()
+    if expected := (pingSummary{Sent: 1, Loss: 100}); actual != expected {
+        t.Errorf("expected %+v; actual %+v", expected, actual)
+    }
+}
+
+
+func TestPingReporters(t *testing.T) {
+    var stats pingStats
+    stats.add(1500 * time.Microsecond, nil)
+    stats.add(time.Second, errors.New("connection refused"))
+
+    for _, format := range []string{"json", "csv"} {
+        out := new(bytes.Buffer)
+        reporter, err := newPingReporter(out, format, false)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        reporter.start("127.0.0.1:80")
+        reporter.probe("127.0.0.1:80", 1, 1500 * time.Microsecond, nil)
+        reporter.probe("127.0.0.1:80", 2, time.Second, syscall.ECONNREFUSED)
+        reporter.summary("127.0.0.1:80", stats.summary())
+
+        err = reporter.flush()
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        switch format {
+        case "json":
+            decoder := json.NewDecoder(out)
+
+            var records []map[string]interface{}
+            for decoder.More() {
+                var record map[string]interface{}
+                err = decoder.Decode(&record)
+                if err != nil {
+                    t.Fatal(err)
+                }
+                records = append(records, record)
+            }
+
+            if len(records) != 3 || records[0]["rtt_ms"] != 1.5 || records[1]["error"] != "connection refused" || records[1]["class"] != "refused" ||
+                records[2]["type"] != "summary" || records[2]["loss_pct"] != 50.0 {
+                t.Errorf("unexpected JSON records: %v", records)
+            }
+        case "csv":
+            rows, err := csv.NewReader(out).ReadAll()
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            if len(rows) != 4 || rows[1][3] != "1.500" || rows[2][5] != "refused" || rows[3][0] != "summary" || rows[3][8] != "50.0" {
+                t.Errorf("unexpected CSV rows: %q", rows)
+            }
+        }
+    }
+}
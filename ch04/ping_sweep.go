@@ -0,0 +1,166 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "io"
+    "sync"
+    "text/tabwriter"
+    "time"
+
+    "github.com/bgabor666/gnp/neterr"
+)
+
+
+type sweepResult struct {
+    target int // index into the swept targets
+    rtt time.Duration
+    err error
+}
+
+
+// sweep probes every target once with at most workers probes in flight and
+// sends each outcome to results. Like the fan-out dialers in ch03, it stops
+// handing out targets once ctx is canceled and returns after all in-flight
+// probes finish.
+func sweep(
+    ctx context.Context,
+    targets []string,
+    workers int,
+    probe func(target string) (time.Duration, error),
+    results chan<- sweepResult,
+) {
+    if workers < 1 {
+        workers = 1
+    }
+
+    jobs := make(chan int)
+    var waitGroup sync.WaitGroup
+
+    for i := 0; i < workers && i < len(targets); i++ {
+        waitGroup.Add(1)
+
+        go func() {
+            defer waitGroup.Done()
+
+            for target := range jobs {
+                rtt, err := probe(targets[target])
+                results <- sweepResult{target: target, rtt: rtt, err: err}
+            }
+        }()
+    }
+
+DISPATCH:
+    for i := range targets {
+        select {
+        case <-ctx.Done():
+            break DISPATCH
+        case jobs <- i:
+        }
+    }
+
+    close(jobs)
+    waitGroup.Wait()
+}
+
+
+// tableReporter shows one row per target and redraws the table in place as
+// results arrive. Without a terminal, in quiet mode, or once the table is too
+// tall for the terminal, it only prints the final table: the cursor cannot
+// move back above the screen to redraw it.
+type tableReporter struct {
+    writer io.Writer
+    rows int // the terminal's height; 0 means there is no terminal
+    targets []string
+    stats map[string]*pingStats
+    last map[string]error
+    lines int // the number of lines drawn last time
+}
+
+func newTableReporter(writer io.Writer, rows int) *tableReporter {
+    return &tableReporter{
+        writer: writer,
+        rows: rows,
+        stats: make(map[string]*pingStats),
+        last: make(map[string]error),
+    }
+}
+
+func (reporter *tableReporter) start(target string) {
+    reporter.targets = append(reporter.targets, target)
+    reporter.stats[target] = new(pingStats)
+}
+
+func (reporter *tableReporter) probe(target string, _ int, rtt time.Duration, err error) {
+    reporter.stats[target].add(rtt, err)
+    reporter.last[target] = err
+
+    if reporter.live() {
+        reporter.draw()
+    }
+}
+
+// live reports whether the table, with its header and a line for the
+// cursor, fits on the terminal.
+func (reporter *tableReporter) live() bool {
+    return len(reporter.targets) + 2 <= reporter.rows
+}
+
+func (reporter *tableReporter) summary(string, pingSummary) {}
+
+func (reporter *tableReporter) flush() error {
+    reporter.draw()
+
+    return nil
+}
+
+func (reporter *tableReporter) draw() {
+    buf := new(bytes.Buffer)
+    table := tabwriter.NewWriter(buf, 0, 0, 2, ' ', 0)
+
+    fmt.Fprintln(table, "TARGET\tSENT\tRECV\tLOSS\tMIN\tAVG\tMAX\tP90\tSTATUS")
+
+    for _, target := range reporter.targets {
+        stats := reporter.stats[target]
+        s := stats.summary()
+
+        status := "-"
+        switch {
+        case s.Sent == 0:
+        case reporter.last[target] == nil:
+            status = "up"
+        case neterr.Classify(reporter.last[target]) == neterr.Unknown:
+            status = "down"
+        default:
+            // Say why, e.g. refused or timeout.
+            status = neterr.Classify(reporter.last[target]).String()
+        }
+
+        rtts := "-\t-\t-\t-"
+        if s.Received > 0 {
+            rtts = fmt.Sprintf("%s\t%s\t%s\t%s", roundRTT(s.Min), roundRTT(s.Avg), roundRTT(s.Max), roundRTT(s.P90))
+        }
+
+        fmt.Fprintf(table, "%s\t%d\t%d\t%.1f%%\t%s\t%s\n", target, s.Sent, s.Received, s.Loss, rtts, status)
+    }
+
+    _ = table.Flush()
+
+    if reporter.lines > 0 {
+        // Move the cursor back to the top of the previous table and clear it.
+        fmt.Fprintf(reporter.writer, "\033[%dA\033[J", reporter.lines)
+    }
+
+    reporter.lines = bytes.Count(buf.Bytes(), []byte("\n"))
+    _, _ = buf.WriteTo(reporter.writer)
+
+    if !reporter.live() {
+        reporter.lines = 0
+    }
+}
+
+
+func roundRTT(d time.Duration) time.Duration {
+    return d.Round(time.Microsecond)
+}
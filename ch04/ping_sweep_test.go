@@ -0,0 +1,168 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "reflect"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+
+func TestExpandTargets(t *testing.T) {
+    for _, c := range []struct {
+        Spec string
+        Expected []string
+    }{
+        {"localhost:http", []string{"localhost:http"}},
+        {"127.0.0.1:22,80-81", []string{"127.0.0.1:22", "127.0.0.1:80", "127.0.0.1:81"}},
+        {"10.0.0.0/31:22", []string{"10.0.0.0:22", "10.0.0.1:22"}},
+        // Host bits are ignored.
+        {"10.0.0.5/30:1", []string{"10.0.0.4:1", "10.0.0.5:1", "10.0.0.6:1", "10.0.0.7:1"}},
+        {"[fd00::/127]:443", []string{"[fd00::]:443", "[fd00::1]:443"}},
+    } {
+        actual, err := expandTargets(c.Spec)
+        if err != nil {
+            t.Errorf("%s: %v", c.Spec, err)
+            continue
+        }
+
+        if !reflect.DeepEqual(c.Expected, actual) {
+            t.Errorf("%s: expected %v; actual %v", c.Spec, c.Expected, actual)
+        }
+    }
+
+    for _, spec := range []string{"localhost", "localhost:80-79", "10.0.0.0/8:1-2", "10.0.0.0/33:1"} {
+        if _, err := expandTargets(spec); err == nil {
+            t.Errorf("%s: expected an error", spec)
+        }
+    }
+}
+
+
+func TestReadTargets(t *testing.T) {
+    actual, err := readTargets(strings.NewReader("# web\n127.0.0.1:80\n\n  127.0.0.1:443-444  \n"))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    expected := []string{"127.0.0.1:80", "127.0.0.1:443", "127.0.0.1:444"}
+    if !reflect.DeepEqual(expected, actual) {
+        t.Errorf("expected %v; actual %v", expected, actual)
+    }
+}
+
+
+func TestDedupeTargets(t *testing.T) {
+    var targets []string
+    for _, spec := range []string{"10.0.0.0/31:80", "10.0.0.1/32:80-81", "10.0.0.0:80"} {
+        expanded, err := expandTargets(spec)
+        if err != nil {
+            t.Fatal(err)
+        }
+        targets = append(targets, expanded...)
+    }
+
+    actual := dedupeTargets(targets)
+    expected := []string{"10.0.0.0:80", "10.0.0.1:80", "10.0.0.1:81"}
+    if !reflect.DeepEqual(expected, actual) {
+        t.Errorf("expected %v; actual %v", expected, actual)
+    }
+}
+
+
+func TestSweepWorkers(t *testing.T) {
+    targets := make([]string, 20)
+    for i := range targets {
+        targets[i] = "target"
+    }
+
+    var inFlight, peak int32
+    probe := func(string) (time.Duration, error) {
+        n := atomic.AddInt32(&inFlight, 1)
+        defer atomic.AddInt32(&inFlight, -1)
+
+        for {
+            p := atomic.LoadInt32(&peak)
+            if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+                break
+            }
+        }
+
+        time.Sleep(10 * time.Millisecond)
+        return time.Millisecond, nil
+    }
+
+    results := make(chan sweepResult)
+    go func() {
+        defer close(results)
+        sweep(context.Background(), targets, 4, probe, results)
+    }()
+
+    seen := make(map[int]bool)
+    for result := range results {
+        seen[result.target] = true
+    }
+
+    if len(seen) != len(targets) {
+        t.Errorf("expected %d results; actual %d", len(targets), len(seen))
+    }
+
+    if peak > 4 {
+        t.Errorf("expected at most 4 concurrent probes; actual %d", peak)
+    }
+}
+
+
+func TestSweepCancel(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    targets := make([]string, 100)
+
+    results := make(chan sweepResult)
+    go func() {
+        defer close(results)
+        sweep(ctx, targets, 2, func(string) (time.Duration, error) {
+            cancel()
+            return 0, nil
+        }, results)
+    }()
+
+    n := 0
+    for range results {
+        n++
+    }
+
+    // Only the probes already handed out finish.
+    if n >= len(targets) {
+        t.Errorf("expected the sweep to stop early; probed %d targets", n)
+    }
+}
+
+
+func TestTableReporterTall(t *testing.T) {
+    targets := []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"}
+
+    for _, rows := range []int{0, 4, 5} {
+        out := new(bytes.Buffer)
+        reporter := newTableReporter(out, rows)
+        for _, target := range targets {
+            reporter.start(target)
+        }
+
+        reporter.probe(targets[0], 1, time.Millisecond, nil)
+
+        // Three targets and a header fit in 5 rows, with one left for the
+        // cursor, so only then is the table drawn before it is complete.
+        if drawn := out.Len() > 0; drawn != (rows == 5) {
+            t.Errorf("%d rows: expected drawn %t; actual %t", rows, rows == 5, drawn)
+        }
+
+        out.Reset()
+        _ = reporter.flush()
+        if lines := strings.Count(out.String(), "\n"); lines != len(targets) + 1 {
+            t.Errorf("%d rows: expected %d lines; actual %d", rows, len(targets) + 1, lines)
+        }
+    }
+}
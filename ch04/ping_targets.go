@@ -0,0 +1,135 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "net"
+    "net/netip"
+    "strconv"
+    "strings"
+)
+
+
+// The most addresses a single target specification may expand to.
+const maxSweepTargets = 1 << 16
+
+
+// expandTargets turns a target specification into host:port addresses. The
+// host may be a CIDR prefix and the port a comma-separated list of ports and
+// ranges, so "10.0.0.0/30:22,80-81" yields 12 addresses.
+func expandTargets(spec string) ([]string, error) {
+    host, portSpec, err := net.SplitHostPort(spec)
+    if err != nil {
+        return nil, err
+    }
+
+    ports, err := parsePorts(portSpec)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %w", spec, err)
+    }
+
+    hosts := []string{host}
+
+    if strings.Contains(host, "/") {
+        prefix, err := netip.ParsePrefix(host)
+        if err != nil {
+            return nil, fmt.Errorf("%s: %w", spec, err)
+        }
+
+        hosts = hosts[:0]
+        for addr := prefix.Masked().Addr(); prefix.Contains(addr); addr = addr.Next() {
+            if len(hosts) * len(ports) >= maxSweepTargets {
+                return nil, fmt.Errorf("%s: more than %d targets", spec, maxSweepTargets)
+            }
+            hosts = append(hosts, addr.String())
+        }
+    }
+
+    if len(hosts) * len(ports) > maxSweepTargets {
+        return nil, fmt.Errorf("%s: more than %d targets", spec, maxSweepTargets)
+    }
+
+    targets := make([]string, 0, len(hosts) * len(ports))
+    for _, h := range hosts {
+        for _, port := range ports {
+            targets = append(targets, net.JoinHostPort(h, port))
+        }
+    }
+
+    return targets, nil
+}
+
+
+func parsePorts(spec string) ([]string, error) {
+    var ports []string
+
+    for _, part := range strings.Split(spec, ",") {
+        low, high, isRange := strings.Cut(part, "-")
+        if !isRange {
+            high = low
+        }
+
+        first, err := strconv.ParseUint(low, 10, 16)
+        if err != nil {
+            // Allow service names such as "http" for single ports.
+            if !isRange && low != "" {
+                ports = append(ports, low)
+                continue
+            }
+            return nil, fmt.Errorf("invalid port %q", part)
+        }
+
+        last, err := strconv.ParseUint(high, 10, 16)
+        if err != nil || last < first {
+            return nil, fmt.Errorf("invalid port range %q", part)
+        }
+
+        for port := first; port <= last; port++ {
+            ports = append(ports, strconv.FormatUint(port, 10))
+        }
+    }
+
+    return ports, nil
+}
+
+
+// readTargets expands every specification in reader, one per line. Blank
+// lines and lines starting with # are skipped.
+func readTargets(reader io.Reader) ([]string, error) {
+    var targets []string
+
+    scanner := bufio.NewScanner(reader)
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+
+        expanded, err := expandTargets(line)
+        if err != nil {
+            return nil, err
+        }
+
+        targets = append(targets, expanded...)
+    }
+
+    return targets, scanner.Err()
+}
+
+
+// dedupeTargets drops repeated targets, such as those of overlapping sweeps,
+// keeping the first of each in order.
+func dedupeTargets(targets []string) []string {
+    seen := make(map[string]bool, len(targets))
+    unique := targets[:0]
+
+    for _, target := range targets {
+        if !seen[target] {
+            seen[target] = true
+            unique = append(unique, target)
+        }
+    }
+
+    return unique
+}
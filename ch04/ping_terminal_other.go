@@ -0,0 +1,12 @@
+//go:build !darwin && !linux
+
+package main
+
+import "os"
+
+
+// terminalRows returns 0 where the terminal's height is unknown, so tables
+// are only printed once they are complete.
+func terminalRows(*os.File) int {
+    return 0
+}
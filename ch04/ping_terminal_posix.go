@@ -0,0 +1,25 @@
+//go:build darwin || linux
+
+package main
+
+import (
+    "os"
+    "syscall"
+    "unsafe"
+)
+
+
+// terminalRows returns the height of the terminal file is attached to, or 0
+// if it is not a terminal.
+func terminalRows(file *os.File) int {
+    var size struct {
+        rows, columns, width, height uint16
+    }
+
+    _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&size)))
+    if errno != 0 {
+        return 0
+    }
+
+    return int(size.rows)
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"io"
+	"context"
 	"net"
 )
 
@@ -18,13 +18,9 @@ func proxyConn(source, destination string) error {
     }
     defer connDestination.Close()
 
-    // connDestination replies to connSource
-    go func() {
-        _, _ = io.Copy(connSource, connDestination)
-    }()
-
-    // connSource messages to connDestination
-    _, err = io.Copy(connDestination, connSource)
+    // connSource messages to connDestination and connDestination replies to
+    // connSource until both sides are done.
+    _, err = ProxyServer{}.Pipe(context.Background(), connSource, connDestination)
 
     return err
 }
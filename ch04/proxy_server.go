@@ -0,0 +1,398 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "io"
+    "log"
+    "net"
+    "sync"
+    "time"
+
+    "github.com/bgabor666/gnp/ch03"
+    "github.com/bgabor666/gnp/neterr"
+)
+
+
+// ErrIdleTimeout is shared with ch03's IdleConn, so idle sessions look the
+// same wherever they time out.
+var ErrIdleTimeout = ch03.ErrIdleTimeout
+
+
+// Transfer holds the number of bytes a proxied session copied per direction.
+type Transfer struct {
+    Upstream int64 // client to upstream
+    Downstream int64 // upstream to client
+}
+
+
+type ProxyServer struct {
+    Upstream string // the address dialed for every client
+    Pool *UpstreamPool // the upstreams to balance clients across, instead of Upstream; Serve runs its health checks
+    DialTimeout time.Duration // the duration to wait for the upstream to accept
+    Retry *ch03.RetryDialer // if set, dials upstreams with retries and circuit breakers; its Base.Timeout replaces DialTimeout
+
+    // Conns, if set, supplies the upstream connections instead of Retry, so
+    // its MaxOpen caps the sessions per upstream, waiting up to DialTimeout
+    // for one to end, and its stats count them. A session carries a whole
+    // stream, so its connection is closed afterward rather than returned.
+    Conns *ch03.ConnPool
+    IdleTimeout time.Duration // the duration without traffic before a session closes; 0 means never
+    MaxLifetime time.Duration // the longest a session may last; 0 means no limit
+    Recorder Recorder // captures the traffic on both sides of every session, if set
+    Middleware []Middleware // the interceptors every session's traffic passes through, in order
+
+    // OnClose, if set, is called with the outcome of every session.
+    OnClose func(client net.Addr, transfer Transfer, err error)
+}
+
+
+func (server ProxyServer) ListenAndServe(ctx context.Context, address string) error {
+    listener, err := net.Listen("tcp", address)
+    if err != nil {
+        return err
+    }
+
+    if server.Pool != nil {
+        log.Printf("Proxying %s to %d upstreams ...\n", listener.Addr(), len(server.Pool.upstreams))
+    } else {
+        log.Printf("Proxying %s to %s ...\n", listener.Addr(), server.Upstream)
+    }
+
+    return server.Serve(ctx, listener)
+}
+
+// Serve accepts clients until ctx is canceled, then closes the listener and
+// every active session, and returns once all sessions are gone. Accept
+// errors other than a closed listener are retried after a backoff.
+func (server ProxyServer) Serve(ctx context.Context, listener net.Listener) error {
+    if listener == nil {
+        return errors.New("nil listener")
+    }
+
+    if server.Upstream == "" && server.Pool == nil {
+        return errors.New("upstream or pool is required")
+    }
+
+    if server.DialTimeout == 0 {
+        server.DialTimeout = 5 * time.Second
+    }
+
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+
+    var waitGroup sync.WaitGroup
+    defer waitGroup.Wait()
+
+    waitGroup.Add(1)
+    go func() {
+        defer waitGroup.Done()
+        <-ctx.Done()
+        _ = listener.Close()
+    }()
+
+    if server.Pool != nil {
+        waitGroup.Add(1)
+        go func() {
+            defer waitGroup.Done()
+            server.Pool.Run(ctx)
+        }()
+    }
+
+    var backoff time.Duration
+
+    for {
+        client, err := listener.Accept()
+        if err != nil {
+            if ctx.Err() != nil {
+                return nil
+            }
+            if errors.Is(err, net.ErrClosed) {
+                return err
+            }
+
+            // Running out of file descriptors, or a client aborting before
+            // it is accepted, passes, so back off and try again as
+            // net/http's Server does.
+            backoff = min(max(2 * backoff, 5 * time.Millisecond), time.Second)
+            log.Printf("accept: %v; retrying in %s", err, backoff)
+
+            if sleep(ctx, backoff) != nil {
+                return nil
+            }
+            continue
+        }
+        backoff = 0
+
+        waitGroup.Add(1)
+        go func() {
+            defer waitGroup.Done()
+            server.handle(ctx, client)
+        }()
+    }
+}
+
+func (server ProxyServer) handle(ctx context.Context, client net.Conn) {
+    defer func() {
+        _ = client.Close()
+    }()
+
+    upstream, done, err := server.dial(ctx, client.RemoteAddr())
+    if err != nil {
+        server.closed(client.RemoteAddr(), Transfer{}, err)
+        return
+    }
+    defer done(nil)
+    defer func() {
+        _ = upstream.Close()
+    }()
+
+    var clientSide, upstreamSide net.Conn = client, upstream
+    if server.MaxLifetime > 0 {
+        clientSide = ch03.IdleTimeout{Lifetime: server.MaxLifetime}.Wrap(client)
+    }
+    if server.Recorder != nil {
+        clientTap, upstreamTap := Tap(clientSide, server.Recorder), Tap(upstream, server.Recorder)
+        // Closing through the taps lets the recorder forget the connections.
+        defer func() {
+            _ = clientTap.Close()
+            _ = upstreamTap.Close()
+        }()
+
+        clientSide, upstreamSide = clientTap, upstreamTap
+    }
+
+    transfer, err := server.Pipe(ctx, clientSide, upstreamSide)
+    if errors.Is(err, ErrInjectedReset) {
+        reset(client)
+        reset(upstream)
+    }
+
+    // Whatever the upstream still has to say belongs to this session.
+    if pooled, ok := upstream.(*ch03.PooledConn); ok {
+        _ = pooled.Discard()
+    }
+
+    server.closed(client.RemoteAddr(), transfer, err)
+}
+
+// dial connects to the upstream for client. With a pool, a dial that fails
+// with a retryable error, or hits an open circuit, moves on to an upstream
+// it has not tried yet, until the pool runs out of them.
+func (server ProxyServer) dial(ctx context.Context, client net.Addr) (net.Conn, func(error), error) {
+    dialer := &net.Dialer{Timeout: server.DialTimeout}
+
+    dial := dialer.DialContext
+    switch {
+    case server.Conns != nil:
+        dial = func(ctx context.Context, _, address string) (net.Conn, error) {
+            ctx, cancel := context.WithTimeout(ctx, server.DialTimeout)
+            defer cancel()
+
+            return server.Conns.Get(ctx, address)
+        }
+    case server.Retry != nil:
+        dial = server.Retry.DialContext
+    }
+
+    if server.Pool == nil {
+        upstream, err := dial(ctx, "tcp", server.Upstream)
+        return upstream, func(error) {}, err
+    }
+
+    var (
+        err error
+        tried []string
+    )
+
+    for {
+        address, done, pickErr := server.Pool.Pick(client, tried...)
+        if pickErr != nil {
+            if err == nil {
+                err = pickErr
+            }
+            // Otherwise report why the last upstream failed rather than that
+            // none are left.
+            return nil, nil, err
+        }
+        tried = append(tried, address)
+
+        var upstream net.Conn
+
+        upstream, err = dial(ctx, "tcp", address)
+        if err == nil {
+            return upstream, done, nil
+        }
+
+        if ctx.Err() != nil {
+            // Shutting down is not the upstream's fault.
+            done(nil)
+            return nil, nil, err
+        }
+
+        done(err)
+
+        // An open circuit is as good a reason to move on as a refused dial.
+        if !neterr.Retryable(err) && !errors.Is(err, ch03.ErrCircuitOpen) {
+            return nil, nil, err
+        }
+    }
+}
+
+func (server ProxyServer) closed(client net.Addr, transfer Transfer, err error) {
+    if server.OnClose != nil {
+        server.OnClose(client, transfer, err)
+    }
+}
+
+// Pipe copies between client and upstream in both directions until both
+// sides finish writing, the session idles out or ctx is canceled. When one
+// side finishes writing, Pipe half-closes the other so it sees EOF while
+// replies keep flowing back. The caller still owns and closes both
+// connections.
+func (server ProxyServer) Pipe(ctx context.Context, client, upstream net.Conn) (Transfer, error) {
+    var (
+        transfer Transfer
+        firstErr error
+        once sync.Once
+        waitGroup sync.WaitGroup
+    )
+
+    session, cancel := context.WithCancel(ctx)
+
+    fail := func(err error) {
+        once.Do(func() { firstErr = err })
+        cancel()
+    }
+
+    // Unblock both directions once the session is canceled or fails.
+    unblocked := make(chan struct{})
+    go func() {
+        defer close(unblocked)
+        <-session.Done()
+        past := time.Unix(1, 0)
+        _ = client.SetDeadline(past)
+        _ = upstream.SetDeadline(past)
+    }()
+
+    touch := func() {
+        if server.IdleTimeout > 0 {
+            deadline := time.Now().Add(server.IdleTimeout)
+            _ = client.SetReadDeadline(deadline)
+            _ = upstream.SetReadDeadline(deadline)
+        }
+    }
+    touch()
+
+    interceptors := make([]Interceptor, 0, len(server.Middleware))
+    for _, middleware := range server.Middleware {
+        interceptors = append(interceptors, middleware(session))
+    }
+
+    waitGroup.Add(2)
+
+    go func() {
+        defer waitGroup.Done()
+        n, err := copyConn(upstream, client, touch, chain{SentByClient, interceptors})
+        transfer.Upstream = n
+        if err != nil {
+            fail(err)
+            return
+        }
+        closeWrite(upstream)
+    }()
+
+    go func() {
+        defer waitGroup.Done()
+        n, err := copyConn(client, upstream, touch, chain{SentByServer, interceptors})
+        transfer.Downstream = n
+        if err != nil {
+            fail(err)
+            return
+        }
+        closeWrite(client)
+    }()
+
+    waitGroup.Wait()
+    cancel()
+    <-unblocked
+
+    err := firstErr
+
+    switch {
+    case ctx.Err() != nil:
+        err = ctx.Err()
+    case errors.Is(err, ch03.ErrLifetimeExceeded):
+        // A timeout too, but not an idle one.
+    case neterr.Classify(err) == neterr.Timeout:
+        // Only the idle deadline times out reads before cancellation.
+        err = ErrIdleTimeout
+    }
+
+    return transfer, err
+}
+
+
+// copyConn copies from source to destination through the interceptor chain
+// until source reaches EOF, calling touch whenever data arrives.
+func copyConn(destination io.Writer, source io.Reader, touch func(), chain chain) (int64, error) {
+    buf := make([]byte, 32 << 10)
+
+    var written int64
+
+    write := func(data []byte) error {
+        w, err := destination.Write(data)
+        written += int64(w)
+
+        return err
+    }
+
+    for {
+        n, err := source.Read(buf)
+        if n > 0 {
+            touch()
+
+            data, iErr := chain.intercept(buf[:n])
+            if iErr != nil {
+                return written, iErr
+            }
+
+            wErr := write(data)
+            if wErr != nil {
+                return written, wErr
+            }
+        }
+
+        if err != nil {
+            if err != io.EOF {
+                return written, err
+            }
+
+            data, fErr := chain.flush()
+            if fErr == nil && len(data) > 0 {
+                fErr = write(data)
+            }
+
+            return written, fErr
+        }
+    }
+}
+
+
+func closeWrite(connection net.Conn) {
+    if halfCloser, ok := connection.(interface{ CloseWrite() error }); ok {
+        _ = halfCloser.CloseWrite()
+    }
+}
+
+
+// reset makes the upcoming Close send a TCP RST instead of a FIN.
+func reset(connection net.Conn) {
+    if wrapper, ok := connection.(interface{ NetConn() net.Conn }); ok {
+        connection = wrapper.NetConn()
+    }
+
+    if tcpConn, ok := connection.(*net.TCPConn); ok {
+        _ = tcpConn.SetLinger(0)
+    }
+}
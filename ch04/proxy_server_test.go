@@ -0,0 +1,382 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "io"
+    "net"
+    "reflect"
+    "sync"
+    "sync/atomic"
+    "syscall"
+    "testing"
+    "time"
+
+    "github.com/bgabor666/gnp/ch03"
+    "github.com/bgabor666/gnp/internal/testserver"
+)
+
+
+type proxySession struct {
+    transfer Transfer
+    err error
+}
+
+
+func startProxyServer(t *testing.T, ctx context.Context, server ProxyServer) (net.Addr, <-chan proxySession, <-chan error) {
+    listener, err := net.Listen("tcp", "127.0.0.1:")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    sessions := make(chan proxySession, 1)
+    server.OnClose = func(_ net.Addr, transfer Transfer, err error) {
+        sessions <- proxySession{transfer, err}
+    }
+
+    served := make(chan error, 1)
+    go func() {
+        served <- server.Serve(ctx, listener)
+    }()
+
+    return listener.Addr(), sessions, served
+}
+
+
+func TestProxyServerHalfClose(t *testing.T) {
+    upstream, _ := testserver.Counting(t, func(c net.Conn) { _, _ = io.Copy(c, c) })
+
+    ctx, cancel := context.WithCancel(context.Background())
+    addr, sessions, served := startProxyServer(t, ctx, ProxyServer{Upstream: upstream.Addr().String()})
+
+    client, err := net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+
+    msg := []byte("Cgo is not Go.")
+    _, err = client.Write(msg)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // The echo must still arrive after the client stops writing.
+    err = client.(*net.TCPConn).CloseWrite()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    reply, err := io.ReadAll(client)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if string(reply) != string(msg) {
+        t.Errorf("expected reply %q; actual %q", msg, reply)
+    }
+
+    s := <-sessions
+    if s.err != nil {
+        t.Error(s.err)
+    }
+
+    expected := Transfer{Upstream: int64(len(msg)), Downstream: int64(len(msg))}
+    if s.transfer != expected {
+        t.Errorf("expected transfer %+v; actual %+v", expected, s.transfer)
+    }
+
+    cancel()
+    if err := <-served; err != nil {
+        t.Error(err)
+    }
+}
+
+
+func TestProxyServerIdleTimeout(t *testing.T) {
+    upstream, _ := testserver.Counting(t, func(c net.Conn) { _, _ = io.Copy(c, c) })
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    addr, sessions, _ := startProxyServer(t, ctx, ProxyServer{
+        Upstream: upstream.Addr().String(),
+        IdleTimeout: 100 * time.Millisecond,
+    })
+
+    client, err := net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+
+    start := time.Now()
+
+    _, err = io.ReadAll(client)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if s := <-sessions; s.err != ErrIdleTimeout {
+        t.Errorf("expected ErrIdleTimeout; actual: %v", s.err)
+    }
+
+    if elapsed := time.Since(start); elapsed > time.Second {
+        t.Errorf("idle session lasted %s", elapsed)
+    }
+}
+
+
+func TestProxyServerCircuitBreaker(t *testing.T) {
+    dead, err := net.Listen("tcp", "127.0.0.1:")
+    if err != nil {
+        t.Fatal(err)
+    }
+    _ = dead.Close()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    addr, sessions, _ := startProxyServer(t, ctx, ProxyServer{
+        Upstream: dead.Addr().String(),
+        Retry: &ch03.RetryDialer{MaxAttempts: 2, BaseDelay: time.Millisecond, FailureThreshold: 2},
+    })
+
+    // The first client's dial is retried once, which opens the circuit, so
+    // the second client is turned away without a dial.
+    for _, expected := range []error{syscall.ECONNREFUSED, ch03.ErrCircuitOpen} {
+        client, err := net.Dial("tcp", addr.String())
+        if err != nil {
+            t.Fatal(err)
+        }
+        _, _ = io.ReadAll(client)
+        _ = client.Close()
+
+        if s := <-sessions; !errors.Is(s.err, expected) {
+            t.Errorf("expected %v; actual %v", expected, s.err)
+        }
+    }
+}
+
+
+func TestProxyServerMaxLifetime(t *testing.T) {
+    upstream, _ := testserver.Counting(t, func(c net.Conn) { _, _ = io.Copy(c, c) })
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    addr, sessions, _ := startProxyServer(t, ctx, ProxyServer{
+        Upstream: upstream.Addr().String(),
+        IdleTimeout: time.Second,
+        MaxLifetime: 150 * time.Millisecond,
+    })
+
+    client, err := net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+
+    // Keep the session busy so only its lifetime can end it.
+    go func() {
+        for {
+            if _, err := client.Write([]byte("ping")); err != nil {
+                return
+            }
+            time.Sleep(20 * time.Millisecond)
+        }
+    }()
+
+    start := time.Now()
+    _, _ = io.Copy(io.Discard, client)
+
+    if s := <-sessions; !errors.Is(s.err, ch03.ErrLifetimeExceeded) {
+        t.Errorf("expected %v; actual %v", ch03.ErrLifetimeExceeded, s.err)
+    }
+
+    if elapsed := time.Since(start); elapsed > time.Second {
+        t.Errorf("session outlived its lifetime: %s", elapsed)
+    }
+}
+
+
+func TestProxyServerShutdown(t *testing.T) {
+    upstream, _ := testserver.Counting(t, func(c net.Conn) { _, _ = io.Copy(c, c) })
+
+    ctx, cancel := context.WithCancel(context.Background())
+    addr, sessions, served := startProxyServer(t, ctx, ProxyServer{Upstream: upstream.Addr().String()})
+
+    client, err := net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+
+    // Make sure the session is established before shutting down.
+    _, err = client.Write([]byte("ping"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, err = client.Read(make([]byte, 4))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    cancel()
+
+    if s := <-sessions; s.err != context.Canceled {
+        t.Errorf("expected context.Canceled; actual: %v", s.err)
+    }
+
+    if err := <-served; err != nil {
+        t.Error(err)
+    }
+}
+
+
+type recordCounter struct {
+    mu sync.Mutex
+    records map[Direction]int
+}
+
+func (counter *recordCounter) Record(record Record) error {
+    counter.mu.Lock()
+    defer counter.mu.Unlock()
+    counter.records[record.Direction] += len(record.Data)
+
+    return nil
+}
+
+
+func TestProxyServerRecorder(t *testing.T) {
+    upstream, _ := testserver.Counting(t, func(c net.Conn) { _, _ = io.Copy(c, c) })
+
+    counter := &recordCounter{records: make(map[Direction]int)}
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    addr, sessions, _ := startProxyServer(t, ctx, ProxyServer{
+        Upstream: upstream.Addr().String(),
+        Recorder: counter,
+    })
+
+    client, err := net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+
+    _, _ = client.Write([]byte("ping"))
+    _ = client.(*net.TCPConn).CloseWrite()
+    _, _ = io.ReadAll(client)
+    <-sessions
+
+    // Both sides of the proxy read and wrote "ping" once.
+    expected := map[Direction]int{Inbound: 8, Outbound: 8}
+    if !reflect.DeepEqual(expected, counter.records) {
+        t.Errorf("expected %v recorded bytes; actual %v", expected, counter.records)
+    }
+}
+
+
+func TestProxyServerConnPool(t *testing.T) {
+    upstream, _ := testserver.Counting(t, func(c net.Conn) { _, _ = io.Copy(c, c) })
+
+    conns := &ch03.ConnPool{MaxOpen: 1}
+    defer conns.Close()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    addr, sessions, _ := startProxyServer(t, ctx, ProxyServer{
+        Upstream: upstream.Addr().String(),
+        Conns: conns,
+        DialTimeout: 50 * time.Millisecond,
+    })
+
+    first, err := net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    msg := []byte("A little copying is better than a little dependency.")
+    if _, err = first.Write(msg); err != nil {
+        t.Fatal(err)
+    }
+    if _, err = io.ReadFull(first, make([]byte, len(msg))); err != nil {
+        t.Fatal(err)
+    }
+
+    // The first session holds the only upstream connection allowed.
+    second, err := net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer second.Close()
+
+    if s := <-sessions; !errors.Is(s.err, context.DeadlineExceeded) {
+        t.Errorf("expected the second session to time out waiting; actual %v", s.err)
+    }
+
+    _ = first.Close()
+    <-sessions
+
+    if stats := conns.Stats(); stats.Dials != 1 || stats.Open != 0 || stats.Idle != 0 {
+        t.Errorf("expected the session's connection closed; actual %+v", stats)
+    }
+}
+
+
+// exhaustedListener fails its first accepts as if out of file descriptors.
+type exhaustedListener struct {
+    net.Listener
+    failures int32
+}
+
+func (l *exhaustedListener) Accept() (net.Conn, error) {
+    if atomic.AddInt32(&l.failures, -1) >= 0 {
+        return nil, &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+    }
+
+    return l.Listener.Accept()
+}
+
+
+func TestProxyServerAcceptRetry(t *testing.T) {
+    upstream, _ := testserver.Counting(t, func(c net.Conn) { _, _ = io.Copy(c, c) })
+
+    listener, err := net.Listen("tcp", "127.0.0.1:")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+
+    served := make(chan error, 1)
+    go func() {
+        server := ProxyServer{Upstream: upstream.Addr().String()}
+        served <- server.Serve(ctx, &exhaustedListener{Listener: listener, failures: 3})
+    }()
+
+    client, err := net.Dial("tcp", listener.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+
+    msg := []byte("Don't panic.")
+    if _, err = client.Write(msg); err != nil {
+        t.Fatal(err)
+    }
+
+    _ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+    if _, err = io.ReadFull(client, make([]byte, len(msg))); err != nil {
+        t.Fatalf("expected the proxy to keep accepting; actual %v", err)
+    }
+
+    cancel()
+    if err := <-served; err != nil {
+        t.Error(err)
+    }
+}
@@ -12,15 +12,26 @@ func proxy(from io.Reader, to io.Writer) error {
     fromWriter, fromIsWriter := from.(io.Writer)
     toReader, toIsreader := to.(io.Reader)
 
+    replied := make(chan struct{})
+
     if toIsreader && fromIsWriter {
         // Send replies since "from" ad "to" implement the necessary interfaces.
         go func() {
+            defer close(replied)
             _, _ = io.Copy(fromWriter, toReader)
         }()
+    } else {
+        close(replied)
     }
 
     _, err := io.Copy(to, from)
 
+    // Let "to" know no more messages are coming so it finishes replying.
+    if halfCloser, ok := to.(interface{ CloseWrite() error }); ok {
+        _ = halfCloser.CloseWrite()
+    }
+    <-replied
+
     return err
 }
 
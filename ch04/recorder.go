@@ -0,0 +1,148 @@
+package main
+
+import (
+    "encoding/hex"
+    "fmt"
+    "io"
+    "net"
+    "sync"
+    "time"
+)
+
+
+type Direction uint8
+
+const (
+    Inbound Direction = iota // read from the remote address
+    Outbound // written to the remote address
+)
+
+func (direction Direction) String() string {
+    if direction == Inbound {
+        return "in"
+    }
+
+    return "out"
+}
+
+
+// Record is a single read or write seen on a connection. Data is only valid
+// for the duration of the Recorder call.
+type Record struct {
+    Time time.Time
+    Direction Direction
+    Local net.Addr
+    Remote net.Addr
+    Data []byte
+}
+
+// Source returns the address the data came from.
+func (record Record) Source() net.Addr {
+    if record.Direction == Inbound {
+        return record.Remote
+    }
+
+    return record.Local
+}
+
+// Destination returns the address the data went to.
+func (record Record) Destination() net.Addr {
+    if record.Direction == Inbound {
+        return record.Local
+    }
+
+    return record.Remote
+}
+
+
+type Recorder interface {
+    Record(record Record) error
+}
+
+// ClosedRecorder is implemented by recorders that keep state per connection.
+// A TapConn calls Closed once its connection closes.
+type ClosedRecorder interface {
+    Recorder
+    Closed(local, remote net.Addr)
+}
+
+
+// TapConn records every successful read and write on the wrapped connection.
+// Recording errors are ignored so a failing capture never breaks traffic.
+type TapConn struct {
+    net.Conn
+    Recorder Recorder
+}
+
+func Tap(connection net.Conn, recorder Recorder) *TapConn {
+    return &TapConn{Conn: connection, Recorder: recorder}
+}
+
+func (tap *TapConn) Read(buf []byte) (int, error) {
+    n, err := tap.Conn.Read(buf)
+    if n > 0 {
+        tap.record(Inbound, buf[:n])
+    }
+
+    return n, err
+}
+
+func (tap *TapConn) Write(buf []byte) (int, error) {
+    n, err := tap.Conn.Write(buf)
+    if n > 0 {
+        tap.record(Outbound, buf[:n])
+    }
+
+    return n, err
+}
+
+func (tap *TapConn) Close() error {
+    err := tap.Conn.Close()
+
+    if closed, ok := tap.Recorder.(ClosedRecorder); ok {
+        closed.Closed(tap.LocalAddr(), tap.RemoteAddr())
+    }
+
+    return err
+}
+
+// CloseWrite half-closes the wrapped connection if it supports it.
+func (tap *TapConn) CloseWrite() error {
+    if halfCloser, ok := tap.Conn.(interface{ CloseWrite() error }); ok {
+        return halfCloser.CloseWrite()
+    }
+
+    return nil
+}
+
+func (tap *TapConn) record(direction Direction, data []byte) {
+    _ = tap.Recorder.Record(Record{
+        Time: time.Now(),
+        Direction: direction,
+        Local: tap.LocalAddr(),
+        Remote: tap.RemoteAddr(),
+        Data: data,
+    })
+}
+
+
+// HexdumpRecorder writes each record as a header line followed by a hexdump.
+type HexdumpRecorder struct {
+    mu sync.Mutex
+    writer io.Writer
+}
+
+func NewHexdumpRecorder(writer io.Writer) *HexdumpRecorder {
+    return &HexdumpRecorder{writer: writer}
+}
+
+func (recorder *HexdumpRecorder) Record(record Record) error {
+    recorder.mu.Lock()
+    defer recorder.mu.Unlock()
+
+    _, err := fmt.Fprintf(recorder.writer, "%s %s %s > %s %d bytes\n%s",
+        record.Time.Format(time.RFC3339Nano), record.Direction,
+        record.Source(), record.Destination(), len(record.Data), hex.Dump(record.Data))
+
+    return err
+}
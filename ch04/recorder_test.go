@@ -0,0 +1,204 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "io"
+    "net"
+    "os"
+    "testing"
+    "time"
+
+    "github.com/bgabor666/gnp/internal/testserver"
+)
+
+
+// pcapngPackets returns the packets of every enhanced packet block in capture.
+func pcapngPackets(t *testing.T, capture []byte) [][]byte {
+    var packets [][]byte
+
+    for len(capture) > 0 {
+        if len(capture) < 12 {
+            t.Fatalf("truncated block: %x", capture)
+        }
+
+        blockType := binary.LittleEndian.Uint32(capture)
+        length := binary.LittleEndian.Uint32(capture[4:])
+        if length % 4 != 0 || int(length) > len(capture) ||
+            binary.LittleEndian.Uint32(capture[length - 4:]) != length {
+            t.Fatalf("malformed block of type %#x and length %d", blockType, length)
+        }
+
+        if blockType == pcapngEnhancedPacket {
+            captured := binary.LittleEndian.Uint32(capture[20:])
+            packets = append(packets, capture[28:28 + captured])
+        }
+
+        capture = capture[length:]
+    }
+
+    return packets
+}
+
+
+func TestPcapngRecorder(t *testing.T) {
+    listener, _ := testserver.Counting(t, func(c net.Conn) { _, _ = io.Copy(c, c) })
+
+    capture := new(bytes.Buffer)
+    recorder, err := NewPcapngRecorder(capture)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    conn, err := net.Dial("tcp", listener.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    client := Tap(conn, recorder)
+    defer client.Close()
+
+    _, err = client.Write([]byte("ping"))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    _, err = io.ReadFull(client, make([]byte, 4))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    packets := pcapngPackets(t, capture.Bytes())
+    if len(packets) != 2 {
+        t.Fatalf("expected 2 packets; actual %d", len(packets))
+    }
+
+    local := conn.LocalAddr().(*net.TCPAddr)
+    server := listener.Addr().(*net.TCPAddr)
+
+    for i, ports := range [][2]int{{local.Port, server.Port}, {server.Port, local.Port}} {
+        packet := packets[i]
+
+        if packet[0] != 0x45 || packet[9] != protocolTCP {
+            t.Fatalf("%d: expected IPv4 TCP packet; actual %x", i, packet[:20])
+        }
+
+        if sum := onesComplementSum(0, packet[:20]); sum != 0xFFFF {
+            t.Errorf("%d: bad IPv4 header checksum", i)
+        }
+
+        tcp := packet[20:]
+        source, destination := binary.BigEndian.Uint16(tcp), binary.BigEndian.Uint16(tcp[2:])
+        if int(source) != ports[0] || int(destination) != ports[1] {
+            t.Errorf("%d: expected ports %v; actual [%d %d]", i, ports, source, destination)
+        }
+
+        if seq := binary.BigEndian.Uint32(tcp[4:]); seq != 1 {
+            t.Errorf("%d: expected sequence number 1; actual %d", i, seq)
+        }
+
+        if payload := string(tcp[20:]); payload != "ping" {
+            t.Errorf("%d: expected payload %q; actual %q", i, "ping", payload)
+        }
+    }
+
+    // The reply acknowledges the 4 bytes sent.
+    if ack := binary.BigEndian.Uint32(packets[1][28:]); ack != 5 {
+        t.Errorf("expected acknowledgment number 5; actual %d", ack)
+    }
+}
+
+
+func TestPcapngRecorderLargeWrite(t *testing.T) {
+    capture := new(bytes.Buffer)
+    recorder, err := NewPcapngRecorder(capture)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1024}
+    remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2048}
+    data := bytes.Repeat([]byte("0123456789"), 15000)
+
+    err = recorder.Record(Record{Direction: Outbound, Local: local, Remote: remote, Data: data})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    packets := pcapngPackets(t, capture.Bytes())
+    if len(packets) != 3 {
+        t.Fatalf("expected 3 segments; actual %d", len(packets))
+    }
+
+    var received []byte
+    seq := uint32(1)
+
+    for i, packet := range packets {
+        if length := binary.BigEndian.Uint16(packet[2:]); int(length) != len(packet) {
+            t.Errorf("%d: expected IPv4 total length %d; actual %d", i, len(packet), length)
+        }
+
+        tcp := packet[20:]
+        if actual := binary.BigEndian.Uint32(tcp[4:]); actual != seq {
+            t.Errorf("%d: expected sequence number %d; actual %d", i, seq, actual)
+        }
+
+        seq += uint32(len(tcp[20:]))
+        received = append(received, tcp[20:]...)
+    }
+
+    if !bytes.Equal(received, data) {
+        t.Error("segments do not add up to the data written")
+    }
+
+    recorder.Closed(local, remote)
+    if len(recorder.sequence) != 0 {
+        t.Errorf("expected closing to forget the flow; actual %v", recorder.sequence)
+    }
+}
+
+
+func TestPcapngRecorderUDP(t *testing.T) {
+    capture := new(bytes.Buffer)
+    recorder, err := NewPcapngRecorder(capture)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = recorder.Record(Record{
+        Time: time.Now(),
+        Direction: Outbound,
+        Local: &net.UDPAddr{IP: net.ParseIP("::1"), Port: 5000},
+        Remote: &net.UDPAddr{IP: net.ParseIP("::1"), Port: 6000},
+        Data: []byte("ping"),
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    packets := pcapngPackets(t, capture.Bytes())
+    if len(packets) != 1 {
+        t.Fatalf("expected 1 packet; actual %d", len(packets))
+    }
+
+    packet := packets[0]
+    if packet[0] >> 4 != 6 || packet[6] != protocolUDP || len(packet) != 40 + 8 + 4 {
+        t.Fatalf("expected IPv6 UDP packet; actual %x", packet)
+    }
+}
+
+
+func ExampleHexdumpRecorder() {
+    recorder := NewHexdumpRecorder(os.Stdout)
+
+    _ = recorder.Record(Record{
+        Time: time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC),
+        Direction: Inbound,
+        Local: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000},
+        Remote: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6000},
+        Data: []byte("Test\n"),
+    })
+
+    // Output:
+    // 2006-01-02T15:04:05Z in 127.0.0.1:6000 > 127.0.0.1:5000 5 bytes
+    // 00000000  54 65 73 74 0a                                    |Test.|
+}
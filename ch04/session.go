@@ -0,0 +1,184 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "sync"
+)
+
+
+// Recorded session structure, repeated for every exchange
+//
+// # 1 byte # 4 bytes # n bytes #
+// ###############################
+// # Sender # Size    # Data    #
+// ###############################
+
+type Sender uint8
+
+const (
+    SentByClient Sender = iota
+    SentByServer
+)
+
+func (sender Sender) String() string {
+    if sender == SentByClient {
+        return "client"
+    }
+
+    return "server"
+}
+
+
+type Exchange struct {
+    Sender Sender
+    Data []byte
+}
+
+
+// ReplayMismatchError reports bytes from the live peer that differ from the
+// recording, or that it sent after the last recorded exchange.
+type ReplayMismatchError struct {
+    Index int // the exchange that did not match; the number of exchanges for trailing bytes
+    Expected []byte
+    Actual []byte
+}
+
+func (e *ReplayMismatchError) Error() string {
+    if e.Expected == nil {
+        return fmt.Sprintf("after exchange %d: unexpected %q", e.Index - 1, e.Actual)
+    }
+
+    return fmt.Sprintf("exchange %d: expected %q; actual %q", e.Index, e.Expected, e.Actual)
+}
+
+
+// SessionRecorder is a Recorder that writes the conversation seen on one
+// tapped connection to a session file. Tapped is the side whose connection
+// carries the tap, so its writes are attributed to it and its reads to the
+// other side.
+type SessionRecorder struct {
+    mu sync.Mutex
+    writer io.Writer
+    tapped Sender
+}
+
+func NewSessionRecorder(writer io.Writer, tapped Sender) *SessionRecorder {
+    return &SessionRecorder{writer: writer, tapped: tapped}
+}
+
+func (recorder *SessionRecorder) Record(record Record) error {
+    recorder.mu.Lock()
+    defer recorder.mu.Unlock()
+
+    sender := recorder.tapped
+    if record.Direction == Inbound {
+        sender ^= 1 // the other side
+    }
+
+    entry := make([]byte, 0, 5 + len(record.Data))
+    entry = append(entry, byte(sender))
+    entry = binary.BigEndian.AppendUint32(entry, uint32(len(record.Data)))
+    entry = append(entry, record.Data...)
+
+    _, err := recorder.writer.Write(entry)
+
+    return err
+}
+
+
+func ReadSession(reader io.Reader) ([]Exchange, error) {
+    var session []Exchange
+
+    for {
+        var header [5]byte
+
+        _, err := io.ReadFull(reader, header[:])
+        if err != nil {
+            if err == io.EOF {
+                return session, nil
+            }
+            return session, err
+        }
+
+        if header[0] > byte(SentByServer) {
+            return session, errors.New("invalid session")
+        }
+
+        size := binary.BigEndian.Uint32(header[1:])
+        if size > MaxPayloadSize {
+            return session, ErrMaxPayloadSize
+        }
+
+        exchange := Exchange{
+            Sender: Sender(header[0]),
+            Data: make([]byte, size),
+        }
+
+        _, err = io.ReadFull(reader, exchange.Data)
+        if err != nil {
+            return session, unexpectedEOF(err)
+        }
+
+        session = append(session, exchange)
+    }
+}
+
+
+// ReplayServer plays the server's part of session on connection. It writes
+// every recorded server exchange and checks that the client sends exactly the
+// recorded client bytes in between. After the last exchange it half-closes
+// connection, if it can, and fails if the client sends anything more before
+// it closes its end.
+func ReplayServer(connection io.ReadWriter, session []Exchange) error {
+    return replay(connection, session, SentByServer)
+}
+
+// ReplayClient plays the client's part of session on connection, checking
+// the server's replies against the recording, and that nothing follows them.
+func ReplayClient(connection io.ReadWriter, session []Exchange) error {
+    return replay(connection, session, SentByClient)
+}
+
+func replay(connection io.ReadWriter, session []Exchange, as Sender) error {
+    for i, exchange := range session {
+        if exchange.Sender == as {
+            _, err := connection.Write(exchange.Data)
+            if err != nil {
+                return err
+            }
+            continue
+        }
+
+        // Reads may split or merge what was recorded, so compare bytes only.
+        actual := make([]byte, len(exchange.Data))
+        n, err := io.ReadFull(connection, actual)
+        if n > 0 && (err != nil || !bytes.Equal(exchange.Data, actual)) {
+            return &ReplayMismatchError{Index: i, Expected: exchange.Data, Actual: actual[:n]}
+        }
+        if err != nil {
+            return err
+        }
+    }
+
+    if halfCloser, ok := connection.(interface{ CloseWrite() error }); ok {
+        _ = halfCloser.CloseWrite()
+    }
+
+    trailing := make([]byte, 512)
+    for {
+        n, err := connection.Read(trailing)
+        if n > 0 {
+            return &ReplayMismatchError{Index: len(session), Actual: trailing[:n]}
+        }
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+    }
+}
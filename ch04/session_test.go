@@ -0,0 +1,192 @@
+package main
+
+import (
+    "bytes"
+    "errors"
+    "io"
+    "net"
+    "testing"
+
+    "github.com/bgabor666/gnp/internal/testserver"
+)
+
+
+// pingHandler replies to "ping" and echoes everything else, like the server
+// in TestProxy.
+func pingHandler(reply string) func(net.Conn) {
+    return func(c net.Conn) {
+        buf := make([]byte, 4)
+        for {
+            _, err := io.ReadFull(c, buf)
+            if err != nil {
+                return
+            }
+
+            if string(buf) == "ping" {
+                _, err = c.Write([]byte(reply))
+            } else {
+                _, err = c.Write(buf)
+            }
+            if err != nil {
+                return
+            }
+        }
+    }
+}
+
+
+// converse runs the client side of the conversation recorded in the tests.
+func converse(conn net.Conn) ([]string, error) {
+    var replies []string
+
+    for _, msg := range []string{"ping", "echo", "ping"} {
+        _, err := conn.Write([]byte(msg))
+        if err != nil {
+            return replies, err
+        }
+
+        buf := make([]byte, 4)
+        _, err = io.ReadFull(conn, buf)
+        if err != nil {
+            return replies, err
+        }
+
+        replies = append(replies, string(buf))
+    }
+
+    return replies, nil
+}
+
+
+func recordSession(t *testing.T, server net.Listener) []Exchange {
+    conn, err := net.Dial("tcp", server.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+
+    recording := new(bytes.Buffer)
+    _, err = converse(Tap(conn, NewSessionRecorder(recording, SentByClient)))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    session, err := ReadSession(recording)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return session
+}
+
+
+func TestReplayServer(t *testing.T) {
+    server, _ := testserver.Counting(t, pingHandler("pong"))
+    session := recordSession(t, server)
+    _ = server.Close()
+
+    if len(session) != 6 {
+        t.Fatalf("expected 6 exchanges; actual %d", len(session))
+    }
+
+    fake, err := net.Listen("tcp", "127.0.0.1:")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer fake.Close()
+
+    replayed := make(chan error, 1)
+    go func() {
+        conn, err := fake.Accept()
+        if err != nil {
+            replayed <- err
+            return
+        }
+        defer conn.Close()
+        replayed <- ReplayServer(conn, session)
+    }()
+
+    conn, err := net.Dial("tcp", fake.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+
+    replies, err := converse(conn)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // The replay lasts until the client is done too.
+    _ = conn.(*net.TCPConn).CloseWrite()
+
+    if err := <-replayed; err != nil {
+        t.Error(err)
+    }
+
+    t.Logf("replayed replies: %q", replies)
+}
+
+
+func TestReplayServerTrailingData(t *testing.T) {
+    server, _ := testserver.Counting(t, pingHandler("pong"))
+    session := recordSession(t, server)
+    _ = server.Close()
+
+    client, fake := net.Pipe()
+    defer client.Close()
+
+    replayed := make(chan error, 1)
+    go func() {
+        defer fake.Close()
+        replayed <- ReplayServer(fake, session)
+    }()
+
+    _, err := converse(client)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // A client that says more than the recording is caught.
+    _, _ = client.Write([]byte("ping"))
+
+    err = <-replayed
+
+    var mismatch *ReplayMismatchError
+    if !errors.As(err, &mismatch) || mismatch.Index != len(session) || string(mismatch.Actual) != "ping" {
+        t.Fatalf("expected trailing %q; actual: %v", "ping", err)
+    }
+}
+
+
+func TestReplayClient(t *testing.T) {
+    server, _ := testserver.Counting(t, pingHandler("pong"))
+    session := recordSession(t, server)
+
+    // The same build passes.
+    conn, err := net.Dial("tcp", server.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+
+    err = ReplayClient(conn, session)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // A build that changed its reply fails on the first ping.
+    regressed, _ := testserver.Counting(t, pingHandler("pang"))
+
+    conn, err = net.Dial("tcp", regressed.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+
+    err = ReplayClient(conn, session)
+
+    var mismatch *ReplayMismatchError
+    if !errors.As(err, &mismatch) || mismatch.Index != 1 {
+        t.Fatalf("expected mismatch at exchange 1; actual: %v", err)
+    }
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -12,6 +11,8 @@ import (
 const (
     BinaryType uint8 = iota + 1
     StringType
+    FlateBinaryType
+    FlateStringType
 
     // 10 MB
     MaxPayloadSize uint32 = 10 << 20
@@ -159,27 +160,5 @@ func (m *String) ReadFrom(reader io.Reader) (int64, error) {
 
 
 func decode(reader io.Reader) (Payload, error) {
-    var payloadType uint8
-    err := binary.Read(reader, binary.BigEndian, &payloadType)
-    if err != nil {
-	return nil, err
-    }
-
-    var payload Payload
-
-    switch payloadType {
-    case BinaryType:
-    	payload = new(Binary)
-    case StringType:
-	payload = new(String)
-    default:
-	return nil, errors.New("unknown type")
-    }
-
-    _, err = payload.ReadFrom(io.MultiReader(bytes.NewReader([]byte{payloadType}), reader))
-    if err != nil {
-	return nil, err
-    }
-
-    return payload, nil
+    return NewDecoder(reader, DecoderOptions{}).Decode()
 }
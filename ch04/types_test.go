@@ -2,10 +2,15 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"net"
 	"reflect"
+	"sync/atomic"
 	"testing"
+
+	"github.com/bgabor666/gnp/ch03"
+	"github.com/bgabor666/gnp/internal/testserver"
 )
 
 func TestPayloads(t *testing.T) {
@@ -58,6 +63,65 @@ func TestPayloads(t *testing.T) {
 }
 
 
+func TestPayloadsOverConnPool(t *testing.T) {
+    binary1 := Binary("Clear is better than clever.")
+    string1 := String("Errors are values.")
+    payloads := []Payload{&binary1, &string1, &binary1, &string1}
+
+    // The server answers every payload with the same payload, and heartbeat
+    // pings with pongs.
+    listener, accepted := testserver.Counting(t, func(c net.Conn) {
+        decoder := NewDecoder(c, DecoderOptions{})
+        for {
+            payload, err := decoder.Decode()
+            if err != nil {
+                return
+            }
+
+            frame := new(bytes.Buffer)
+            _, _ = payload.WriteTo(frame)
+            if seq, n := (ch03.TLVPingFormat{}).ParsePing(frame.Bytes()); n > 0 {
+                frame = bytes.NewBuffer(ch03.TLVPingFormat{}.Pong(seq))
+            }
+
+            if _, err = frame.WriteTo(c); err != nil {
+                return
+            }
+        }
+    })
+
+    pool := &ch03.ConnPool{Check: ch03.TLVPingFormat{}}
+    defer pool.Close()
+
+    // Each call checks out a connection for a single exchange.
+    for _, expected := range payloads {
+        conn, err := pool.Get(context.Background(), listener.Addr().String())
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        if _, err = expected.WriteTo(conn); err != nil {
+            t.Fatal(err)
+        }
+
+        actual, err := decode(conn)
+        if err != nil {
+            t.Fatal(err)
+        }
+        _ = conn.Close()
+
+        if !reflect.DeepEqual(expected, actual) {
+            t.Errorf("value mismatch: %v != %v", expected, actual)
+        }
+    }
+
+    stats := pool.Stats()
+    if n := atomic.LoadInt32(accepted); n != 1 || stats.Reused != int64(len(payloads) - 1) || stats.FailedChecks != 0 {
+        t.Errorf("expected every call on a single checked connection; accepted %d, stats %+v", n, stats)
+    }
+}
+
+
 func TestMaxPayloadSize(t *testing.T) {
     buf := new(bytes.Buffer)
     err := buf.WriteByte(BinaryType)
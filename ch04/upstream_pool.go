@@ -0,0 +1,267 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "hash/fnv"
+    "net"
+    "slices"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+)
+
+
+var ErrNoUpstream = errors.New("no healthy upstream")
+
+
+type Balance uint8
+
+const (
+    RoundRobin Balance = iota
+    LeastConnections
+    ConsistentHash // by client IP, so a client keeps its upstream while it stays healthy
+)
+
+
+// The number of points each upstream owns on the consistent hash ring.
+const ringReplicas = 64
+
+
+type upstream struct {
+    address string
+    active int // proxied sessions in flight
+    failures int // consecutive failed dials
+    down bool // failed its last health check
+    ejectedUntil time.Time
+}
+
+func (u *upstream) available(now time.Time) bool {
+    return !u.down && !now.Before(u.ejectedUntil)
+}
+
+
+type ringPoint struct {
+    hash uint32
+    upstream *upstream
+}
+
+
+// UpstreamPool picks the upstream for each proxied client. Upstreams that
+// fail MaxFailures dials in a row are ejected for EjectDuration, and Run
+// takes upstreams out of rotation while they fail health checks. A
+// ProxyServer runs the health checks while it serves; other users of a pool
+// have to call Run themselves.
+type UpstreamPool struct {
+    Balance Balance
+    MaxFailures int // consecutive dial failures before ejection; 0 means 3
+    EjectDuration time.Duration // how long an ejected upstream sits out; 0 means 30 seconds
+    HealthInterval time.Duration // the time between health checks; 0 means 10 seconds
+    HealthTimeout time.Duration // the time to wait for a health check handshake; 0 means 5 seconds
+
+    mu sync.Mutex
+    upstreams []*upstream
+    ring []ringPoint
+    next int
+}
+
+func NewUpstreamPool(balance Balance, addresses ...string) *UpstreamPool {
+    pool := &UpstreamPool{Balance: balance}
+
+    for _, address := range addresses {
+        u := &upstream{address: address}
+        pool.upstreams = append(pool.upstreams, u)
+
+        for i := 0; i < ringReplicas; i++ {
+            pool.ring = append(pool.ring, ringPoint{hash: hashKey(address + "#" + strconv.Itoa(i)), upstream: u})
+        }
+    }
+
+    sort.Slice(pool.ring, func(i, j int) bool { return pool.ring[i].hash < pool.ring[j].hash })
+
+    return pool
+}
+
+// Pick returns the upstream address for client and a function to call with
+// the outcome of dialing it once the session ends. It passes over the tried
+// addresses, so a caller moving on from a failed dial gets another upstream
+// whatever the balancing.
+func (pool *UpstreamPool) Pick(client net.Addr, tried ...string) (string, func(dialErr error), error) {
+    pool.mu.Lock()
+    defer pool.mu.Unlock()
+
+    var (
+        now = time.Now()
+        picked *upstream
+    )
+
+    available := func(u *upstream) bool {
+        return u.available(now) && !slices.Contains(tried, u.address)
+    }
+
+    switch pool.Balance {
+    case LeastConnections:
+        for _, u := range pool.upstreams {
+            if available(u) && (picked == nil || u.active < picked.active) {
+                picked = u
+            }
+        }
+    case ConsistentHash:
+        if len(pool.ring) == 0 {
+            break
+        }
+
+        key := hashKey(clientIP(client))
+        start := sort.Search(len(pool.ring), func(i int) bool { return pool.ring[i].hash >= key })
+
+        // Walk clockwise past unavailable upstreams.
+        for i := 0; i < len(pool.ring); i++ {
+            if u := pool.ring[(start + i) % len(pool.ring)].upstream; available(u) {
+                picked = u
+                break
+            }
+        }
+    default:
+        for i := 0; i < len(pool.upstreams); i++ {
+            u := pool.upstreams[(pool.next + i) % len(pool.upstreams)]
+            if available(u) {
+                picked = u
+                pool.next = (pool.next + i + 1) % len(pool.upstreams)
+                break
+            }
+        }
+    }
+
+    if picked == nil {
+        return "", nil, ErrNoUpstream
+    }
+
+    picked.active++
+
+    var once sync.Once
+    done := func(dialErr error) {
+        once.Do(func() { pool.release(picked, dialErr) })
+    }
+
+    return picked.address, done, nil
+}
+
+func (pool *UpstreamPool) release(u *upstream, dialErr error) {
+    pool.mu.Lock()
+    defer pool.mu.Unlock()
+
+    u.active--
+
+    if dialErr == nil {
+        u.failures = 0
+        return
+    }
+
+    u.failures++
+
+    maxFailures := pool.MaxFailures
+    if maxFailures <= 0 {
+        maxFailures = 3
+    }
+
+    if u.failures >= maxFailures {
+        ejectDuration := pool.EjectDuration
+        if ejectDuration <= 0 {
+            ejectDuration = 30 * time.Second
+        }
+
+        u.ejectedUntil = time.Now().Add(ejectDuration)
+        u.failures = 0
+    }
+}
+
+// Run health checks every upstream with a TCP ping until ctx is canceled.
+// A passing check also lifts an ejection early.
+func (pool *UpstreamPool) Run(ctx context.Context) {
+    interval := pool.HealthInterval
+    if interval <= 0 {
+        interval = 10 * time.Second
+    }
+
+    timeout := pool.HealthTimeout
+    if timeout <= 0 {
+        timeout = 5 * time.Second
+    }
+
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        pool.check(timeout)
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+func (pool *UpstreamPool) check(timeout time.Duration) {
+    var waitGroup sync.WaitGroup
+
+    for _, u := range pool.upstreams {
+        waitGroup.Add(1)
+
+        go func(u *upstream) {
+            defer waitGroup.Done()
+
+            _, err := tcpPing(u.address, timeout)
+
+            pool.mu.Lock()
+            u.down = err != nil
+            if err == nil {
+                u.failures = 0
+                u.ejectedUntil = time.Time{}
+            }
+            pool.mu.Unlock()
+        }(u)
+    }
+
+    waitGroup.Wait()
+}
+
+// Healthy returns the addresses currently in rotation.
+func (pool *UpstreamPool) Healthy() []string {
+    pool.mu.Lock()
+    defer pool.mu.Unlock()
+
+    var addresses []string
+    now := time.Now()
+
+    for _, u := range pool.upstreams {
+        if u.available(now) {
+            addresses = append(addresses, u.address)
+        }
+    }
+
+    return addresses
+}
+
+
+func hashKey(key string) uint32 {
+    hash := fnv.New32a()
+    _, _ = hash.Write([]byte(key))
+
+    return hash.Sum32()
+}
+
+
+func clientIP(addr net.Addr) string {
+    if addr == nil {
+        return ""
+    }
+
+    host, _, err := net.SplitHostPort(addr.String())
+    if err != nil {
+        return addr.String()
+    }
+
+    return host
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+    "context"
+    "io"
+    "net"
+    "reflect"
+    "testing"
+    "time"
+
+    "github.com/bgabor666/gnp/internal/testserver"
+)
+
+
+func TestUpstreamPoolRoundRobin(t *testing.T) {
+    pool := NewUpstreamPool(RoundRobin, "a:1", "b:1", "c:1")
+
+    var picked []string
+    for i := 0; i < 4; i++ {
+        address, done, err := pool.Pick(nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        done(nil)
+        picked = append(picked, address)
+    }
+
+    expected := []string{"a:1", "b:1", "c:1", "a:1"}
+    if !reflect.DeepEqual(expected, picked) {
+        t.Errorf("expected %v; actual %v", expected, picked)
+    }
+}
+
+
+func TestUpstreamPoolLeastConnections(t *testing.T) {
+    pool := NewUpstreamPool(LeastConnections, "a:1", "b:1")
+
+    first, _, err := pool.Pick(nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // The first session is still in flight, so the other upstream is next.
+    second, done, err := pool.Pick(nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    done(nil)
+
+    if first == second {
+        t.Errorf("expected different upstreams; both were %q", first)
+    }
+}
+
+
+func TestUpstreamPoolConsistentHash(t *testing.T) {
+    pool := NewUpstreamPool(ConsistentHash, "a:1", "b:1", "c:1")
+    client := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 7), Port: 40000}
+
+    expected, done, err := pool.Pick(client)
+    if err != nil {
+        t.Fatal(err)
+    }
+    done(nil)
+
+    // Another connection from the same IP lands on the same upstream.
+    client.Port++
+    actual, done, err := pool.Pick(client)
+    if err != nil {
+        t.Fatal(err)
+    }
+    done(nil)
+
+    if expected != actual {
+        t.Errorf("expected %q; actual %q", expected, actual)
+    }
+}
+
+
+func TestUpstreamPoolPassiveEjection(t *testing.T) {
+    pool := NewUpstreamPool(RoundRobin, "a:1", "b:1")
+    pool.MaxFailures = 2
+    pool.EjectDuration = time.Minute
+
+    for i := 0; i < 4; i++ {
+        address, done, err := pool.Pick(nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        if address == "a:1" {
+            done(&net.OpError{Op: "dial", Err: net.UnknownNetworkError("refused")})
+        } else {
+            done(nil)
+        }
+    }
+
+    if healthy := pool.Healthy(); !reflect.DeepEqual(healthy, []string{"b:1"}) {
+        t.Errorf("expected only b:1 in rotation; actual %v", healthy)
+    }
+}
+
+
+func TestUpstreamPoolHealthCheck(t *testing.T) {
+    live, _ := testserver.Counting(t, func(net.Conn) {})
+
+    // Grab a free port and release it so nothing listens there.
+    dead, err := net.Listen("tcp", "127.0.0.1:")
+    if err != nil {
+        t.Fatal(err)
+    }
+    _ = dead.Close()
+
+    pool := NewUpstreamPool(RoundRobin, live.Addr().String(), dead.Addr().String())
+    pool.HealthTimeout = time.Second
+
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    // A canceled context still runs one round of checks.
+    pool.Run(ctx)
+
+    if healthy := pool.Healthy(); !reflect.DeepEqual(healthy, []string{live.Addr().String()}) {
+        t.Errorf("expected only %s in rotation; actual %v", live.Addr(), healthy)
+    }
+}
+
+
+func TestProxyServerPool(t *testing.T) {
+    upstream, _ := testserver.Counting(t, func(c net.Conn) { _, _ = io.Copy(c, c) })
+
+    dead, err := net.Listen("tcp", "127.0.0.1:")
+    if err != nil {
+        t.Fatal(err)
+    }
+    _ = dead.Close()
+
+    pool := NewUpstreamPool(RoundRobin, dead.Addr().String(), upstream.Addr().String())
+    pool.MaxFailures = 1
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    addr, sessions, _ := startProxyServer(t, ctx, ProxyServer{Pool: pool})
+
+    // The first client's dial to the dead upstream is refused, which ejects
+    // it, and the proxy moves on to the live one. No client notices.
+    for i := 0; i < 3; i++ {
+        client, err := net.Dial("tcp", addr.String())
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        _, _ = client.Write([]byte("ping"))
+        _ = client.(*net.TCPConn).CloseWrite()
+        buf := make([]byte, 4)
+        n, _ := client.Read(buf)
+        _ = client.Close()
+
+        s := <-sessions
+        if s.err != nil {
+            t.Errorf("%d: %v", i, s.err)
+        }
+
+        if string(buf[:n]) != "ping" {
+            t.Errorf("%d: expected reply %q; actual %q", i, "ping", buf[:n])
+        }
+    }
+}
+
+
+func TestProxyServerPoolFailover(t *testing.T) {
+    upstream, _ := testserver.Counting(t, func(c net.Conn) { _, _ = io.Copy(c, c) })
+
+    dead, err := net.Listen("tcp", "127.0.0.1:")
+    if err != nil {
+        t.Fatal(err)
+    }
+    _ = dead.Close()
+
+    for _, balance := range []Balance{LeastConnections, ConsistentHash} {
+        // Dial directly rather than through Serve, whose health checks
+        // would take the dead upstream out of rotation before any client.
+        // MaxFailures keeps it in rotation too, so every client first
+        // picks it under least connections and some do under consistent
+        // hashing.
+        pool := NewUpstreamPool(balance, dead.Addr().String(), upstream.Addr().String())
+        pool.MaxFailures = 100
+        server := ProxyServer{Pool: pool, DialTimeout: time.Second}
+
+        for i := 1; i <= 8; i++ {
+            client := &net.TCPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 1234}
+
+            conn, done, err := server.dial(context.Background(), client)
+            if err != nil {
+                t.Fatalf("balance %d, client %s: %v", balance, client, err)
+            }
+
+            if conn.RemoteAddr().String() != upstream.Addr().String() {
+                t.Errorf("balance %d, client %s: expected %s; actual %s",
+                    balance, client, upstream.Addr(), conn.RemoteAddr())
+            }
+
+            done(nil)
+            _ = conn.Close()
+        }
+    }
+}
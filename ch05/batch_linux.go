@@ -0,0 +1,231 @@
+//go:build linux && (amd64 || arm64)
+
+package echo
+
+import (
+    "net"
+    "syscall"
+    "unsafe"
+)
+
+
+// mmsghdr is the kernel's struct mmsghdr on 64-bit platforms.
+type mmsghdr struct {
+    hdr syscall.Msghdr
+    len uint32
+    _ [4]byte
+}
+
+
+// mmsgConn batches datagrams with recvmmsg and sendmmsg.
+type mmsgConn struct {
+    raw syscall.RawConn
+    inet6 bool // the socket is AF_INET6, so IPv4 peers are written as mapped addresses
+
+    // Reads and writes happen at once, so each has its own headers.
+    reads, writes mmsgHeaders
+}
+
+
+type mmsgHeaders struct {
+    headers []mmsghdr
+    iovecs []syscall.Iovec
+    names []syscall.RawSockaddrAny
+}
+
+
+func newBatchConn(conn *net.UDPConn, size int) batchConn {
+    raw, err := conn.SyscallConn()
+    if err != nil {
+        return nil
+    }
+
+    c := &mmsgConn{raw: raw, reads: newMmsgHeaders(size), writes: newMmsgHeaders(size)}
+
+    var sa syscall.Sockaddr
+    err = raw.Control(func(fd uintptr) {
+        sa, err = syscall.Getsockname(int(fd))
+    })
+    if err != nil {
+        return nil
+    }
+    _, c.inet6 = sa.(*syscall.SockaddrInet6)
+
+    return c
+}
+
+
+func newMmsgHeaders(size int) mmsgHeaders {
+    return mmsgHeaders{
+        headers: make([]mmsghdr, size),
+        iovecs: make([]syscall.Iovec, size),
+        names: make([]syscall.RawSockaddrAny, size),
+    }
+}
+
+
+func (c *mmsgConn) ReadBatch(messages []batchMessage) (int, error) {
+    h := &c.reads
+    if len(messages) > len(h.headers) {
+        messages = messages[:len(h.headers)]
+    }
+
+    for i, m := range messages {
+        h.iovecs[i] = syscall.Iovec{Base: &m.Data[0]}
+        h.iovecs[i].SetLen(len(m.Data))
+        h.headers[i] = mmsghdr{hdr: syscall.Msghdr{
+            Name: (*byte)(unsafe.Pointer(&h.names[i])),
+            Namelen: syscall.SizeofSockaddrAny,
+            Iov: &h.iovecs[i],
+            Iovlen: 1,
+        }}
+    }
+
+    var n int
+    var errno syscall.Errno
+
+    err := c.raw.Read(func(fd uintptr) bool {
+        r, _, e := syscall.Syscall6(syscall.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&h.headers[0])),
+            uintptr(len(messages)), syscall.MSG_DONTWAIT, 0, 0)
+        n, errno = int(r), e
+
+        return errno != syscall.EAGAIN
+    })
+    if err != nil {
+        return 0, err
+    }
+    if errno != 0 {
+        return 0, &net.OpError{Op: "recvmmsg", Net: "udp", Err: errno}
+    }
+
+    for i := 0; i < n; i++ {
+        header := &h.headers[i]
+        messages[i].N = int(header.len)
+        messages[i].Truncated = header.hdr.Flags & syscall.MSG_TRUNC != 0
+        messages[i].Addr = udpAddr(&h.names[i])
+    }
+
+    return n, nil
+}
+
+func (c *mmsgConn) WriteBatch(messages []batchMessage) (int, error) {
+    h := &c.writes
+    if len(messages) > len(h.headers) {
+        messages = messages[:len(h.headers)]
+    }
+
+    for i, m := range messages {
+        namelen, err := c.sockaddr(m.Addr, &h.names[i])
+        if err != nil {
+            if i == 0 {
+                return 0, err
+            }
+            // Send the ones before it, and let the next call fail on it.
+            messages = messages[:i]
+            break
+        }
+
+        h.iovecs[i] = syscall.Iovec{}
+        if len(m.Data) > 0 {
+            h.iovecs[i].Base = &m.Data[0]
+            h.iovecs[i].SetLen(len(m.Data))
+        }
+        h.headers[i] = mmsghdr{hdr: syscall.Msghdr{
+            Name: (*byte)(unsafe.Pointer(&h.names[i])),
+            Namelen: namelen,
+            Iov: &h.iovecs[i],
+            Iovlen: 1,
+        }}
+    }
+
+    var n int
+    var errno syscall.Errno
+
+    err := c.raw.Write(func(fd uintptr) bool {
+        r, _, e := syscall.Syscall6(sysSendmmsg, fd, uintptr(unsafe.Pointer(&h.headers[0])),
+            uintptr(len(messages)), syscall.MSG_DONTWAIT, 0, 0)
+        n, errno = int(r), e
+
+        return errno != syscall.EAGAIN
+    })
+    if err != nil {
+        return 0, err
+    }
+    if errno != 0 {
+        return 0, &net.OpError{Op: "sendmmsg", Net: "udp", Err: errno}
+    }
+
+    return n, nil
+}
+
+// sockaddr encodes addr into sa for the socket's family and returns its length.
+func (c *mmsgConn) sockaddr(addr net.Addr, sa *syscall.RawSockaddrAny) (uint32, error) {
+    udp, ok := addr.(*net.UDPAddr)
+    if !ok {
+        return 0, &net.OpError{Op: "sendmmsg", Net: "udp", Addr: addr, Err: syscall.EAFNOSUPPORT}
+    }
+
+    *sa = syscall.RawSockaddrAny{}
+
+    if ip4 := udp.IP.To4(); ip4 != nil && !c.inet6 {
+        sa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(sa))
+        sa4.Family = syscall.AF_INET
+        putPort(&sa4.Port, udp.Port)
+        copy(sa4.Addr[:], ip4)
+
+        return syscall.SizeofSockaddrInet4, nil
+    }
+
+    ip6 := udp.IP.To16()
+    if ip6 == nil || !c.inet6 {
+        return 0, &net.OpError{Op: "sendmmsg", Net: "udp", Addr: addr, Err: syscall.EAFNOSUPPORT}
+    }
+
+    sa6 := (*syscall.RawSockaddrInet6)(unsafe.Pointer(sa))
+    sa6.Family = syscall.AF_INET6
+    putPort(&sa6.Port, udp.Port)
+    copy(sa6.Addr[:], ip6)
+    if udp.Zone != "" {
+        if ifi, err := net.InterfaceByName(udp.Zone); err == nil {
+            sa6.Scope_id = uint32(ifi.Index)
+        }
+    }
+
+    return syscall.SizeofSockaddrInet6, nil
+}
+
+
+// udpAddr decodes the sender address recvmmsg filled in.
+func udpAddr(sa *syscall.RawSockaddrAny) net.Addr {
+    switch sa.Addr.Family {
+    case syscall.AF_INET:
+        sa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(sa))
+
+        return &net.UDPAddr{IP: net.IP(append([]byte(nil), sa4.Addr[:]...)), Port: port(&sa4.Port)}
+    case syscall.AF_INET6:
+        sa6 := (*syscall.RawSockaddrInet6)(unsafe.Pointer(sa))
+        addr := &net.UDPAddr{IP: net.IP(append([]byte(nil), sa6.Addr[:]...)), Port: port(&sa6.Port)}
+        if sa6.Scope_id != 0 {
+            if ifi, err := net.InterfaceByIndex(int(sa6.Scope_id)); err == nil {
+                addr.Zone = ifi.Name
+            }
+        }
+
+        return addr
+    }
+
+    return nil
+}
+
+// port reads a port in network byte order.
+func port(p *uint16) int {
+    b := (*[2]byte)(unsafe.Pointer(p))
+
+    return int(b[0]) << 8 | int(b[1])
+}
+
+// putPort writes a port in network byte order.
+func putPort(p *uint16, port int) {
+    b := (*[2]byte)(unsafe.Pointer(p))
+    b[0], b[1] = byte(port >> 8), byte(port)
+}
@@ -0,0 +1,5 @@
+package echo
+
+
+// sysSendmmsg is missing from the syscall package on amd64.
+const sysSendmmsg = 307
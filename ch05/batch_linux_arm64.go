@@ -0,0 +1,6 @@
+package echo
+
+import "syscall"
+
+
+const sysSendmmsg = syscall.SYS_SENDMMSG
@@ -0,0 +1,11 @@
+//go:build !linux || !(amd64 || arm64)
+
+package echo
+
+import "net"
+
+
+// newBatchConn returns nil, since batching needs recvmmsg and sendmmsg.
+func newBatchConn(conn *net.UDPConn, size int) batchConn {
+    return nil
+}
@@ -0,0 +1,199 @@
+package echo
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "net"
+    "os"
+    "time"
+)
+
+
+// DiscoveryGroup is the multicast group and port services are discovered on.
+const DiscoveryGroup = "239.255.77.77:7777"
+
+
+// Service is a service a Responder announces.
+type Service struct {
+    Type string `json:"type"` // such as echo or tftp
+    Name string `json:"name"` // tells apart services of the same type
+    Addr string `json:"addr"` // where it listens; without a host, on the responder's address
+}
+
+
+// discoveryMessage is a query for services of a type, where the empty type
+// means all, or the answer to one.
+type discoveryMessage struct {
+    Query *string `json:"query,omitempty"`
+    Services []Service `json:"services,omitempty"`
+}
+
+
+// Responder answers discovery queries for its services.
+type Responder struct {
+    Group string // the group, or port, queries arrive on; empty means DiscoveryGroup
+    Multicast MulticastConfig
+    Services []Service
+}
+
+
+// ListenAndServe joins the discovery group and answers queries until ctx is
+// done. It returns once the responder is listening.
+func (r Responder) ListenAndServe(ctx context.Context) error {
+    group := r.Group
+    if group == "" {
+        group = DiscoveryGroup
+    }
+
+    conn, err := r.Multicast.Listen(ctx, group)
+    if err != nil {
+        return err
+    }
+
+    server := &UDPServer{Handler: r.answer, Workers: 1, MaxDatagramSize: 1024}
+    go func() { _ = server.Serve(ctx, conn) }()
+
+    return nil
+}
+
+// answer replies to the querier with the matching services, if any.
+func (r Responder) answer(d Datagram) []byte {
+    var query discoveryMessage
+    if d.Truncated || json.Unmarshal(d.Data, &query) != nil || query.Query == nil {
+        return nil
+    }
+
+    var answer discoveryMessage
+    for _, service := range r.Services {
+        if *query.Query == "" || *query.Query == service.Type {
+            answer.Services = append(answer.Services, service)
+        }
+    }
+
+    if len(answer.Services) == 0 {
+        return nil
+    }
+
+    reply, err := json.Marshal(answer)
+    if err != nil {
+        return nil
+    }
+
+    return reply
+}
+
+
+// Browser finds services by querying for them.
+type Browser struct {
+    // Group is where queries go; empty means DiscoveryGroup. A broadcast
+    // address with the group's port, along with Multicast.Broadcast, queries
+    // responders by broadcast instead.
+    Group string
+    Multicast MulticastConfig
+    Timeout time.Duration // how long to collect answers; 0 means 1 second
+}
+
+
+// Browse returns the services of serviceType, or of all types if it is empty,
+// that answered before the timeout. It asks twice, in case a datagram was
+// lost. If ctx is done first, or reading fails, it returns the services
+// found so far along with the error.
+func (b Browser) Browse(ctx context.Context, serviceType string) ([]Service, error) {
+    group := b.Group
+    if group == "" {
+        group = DiscoveryGroup
+    }
+
+    gaddr, err := net.ResolveUDPAddr("udp", group)
+    if err != nil {
+        return nil, err
+    }
+
+    network := "udp4"
+    if gaddr.IP.To4() == nil {
+        network = "udp6"
+    }
+
+    conn, err := net.ListenUDP(network, nil)
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+
+    if err = b.Multicast.Apply(conn); err != nil {
+        return nil, err
+    }
+
+    query, err := json.Marshal(discoveryMessage{Query: &serviceType})
+    if err != nil {
+        return nil, err
+    }
+
+    timeout := b.Timeout
+    if timeout <= 0 {
+        timeout = time.Second
+    }
+
+    search, cancel := context.WithTimeout(ctx, timeout)
+    defer cancel()
+
+    _ = conn.SetReadDeadline(time.Now().Add(timeout))
+    stop := context.AfterFunc(search, func() {
+        _ = conn.SetReadDeadline(time.Now())
+    })
+    defer stop()
+
+    if _, err = conn.WriteTo(query, gaddr); err != nil {
+        return nil, err
+    }
+    again := time.AfterFunc(timeout / 2, func() { _, _ = conn.WriteTo(query, gaddr) })
+    defer again.Stop()
+
+    var services []Service
+    seen := make(map[Service]bool)
+    buf := make([]byte, MaxUDPPayload)
+
+    for {
+        n, from, err := conn.ReadFromUDP(buf)
+        if err != nil {
+            if !errors.Is(err, os.ErrDeadlineExceeded) {
+                return services, err
+            }
+
+            // The timeout ends the search, unlike ctx.
+            return services, ctx.Err()
+        }
+
+        var answer discoveryMessage
+        if json.Unmarshal(buf[:n], &answer) != nil {
+            continue
+        }
+
+        for _, service := range answer.Services {
+            service.Addr = resolveServiceAddr(service.Addr, from.IP)
+
+            if serviceType != "" && service.Type != serviceType || seen[service] {
+                continue
+            }
+            seen[service] = true
+            services = append(services, service)
+        }
+    }
+}
+
+
+// resolveServiceAddr fills in the responder's IP for services listening on
+// all addresses.
+func resolveServiceAddr(addr string, responder net.IP) string {
+    host, port, err := net.SplitHostPort(addr)
+    if err != nil {
+        return addr
+    }
+
+    if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+        return net.JoinHostPort(responder.String(), port)
+    }
+
+    return addr
+}
@@ -0,0 +1,171 @@
+package echo
+
+import (
+    "context"
+    "fmt"
+    "net"
+    "syscall"
+)
+
+
+// MulticastConfig configures sockets that send to, or listen on, multicast
+// groups and broadcast addresses.
+type MulticastConfig struct {
+    // Interfaces to join groups on, the first of which also sends multicast
+    // datagrams; none means the system's choice.
+    Interfaces []*net.Interface
+    TTL int // the hops multicast datagrams may travel; 0 means 1, the local network
+    NoLoopback bool // keeps multicast datagrams from listeners on this host, which get them by default
+    Broadcast bool // allows sending to broadcast addresses
+}
+
+
+// Listen binds to the port of group and joins the group on the configured
+// interfaces. Other sockets may bind to the same port, though each receives
+// only the groups it joined. Since the socket is bound to all addresses, it
+// receives broadcasts to the port as well. Listen applies the configuration
+// for sending too.
+func (config MulticastConfig) Listen(ctx context.Context, group string) (*net.UDPConn, error) {
+    gaddr, err := net.ResolveUDPAddr("udp", group)
+    if err != nil {
+        return nil, err
+    }
+
+    network, wildcard := "udp4", net.IPv4zero
+    if gaddr.IP.To4() == nil {
+        network, wildcard = "udp6", net.IPv6unspecified
+    }
+
+    listener := net.ListenConfig{
+        Control: func(network, _ string, raw syscall.RawConn) error {
+            var err error
+
+            controlErr := raw.Control(func(fd uintptr) {
+                err = setReuse(fd)
+                if err == nil {
+                    err = setOwnGroups(fd, network == "udp6")
+                }
+            })
+            if controlErr != nil {
+                return controlErr
+            }
+
+            return err
+        },
+    }
+
+    packetConn, err := listener.ListenPacket(ctx, network, (&net.UDPAddr{IP: wildcard, Port: gaddr.Port}).String())
+    if err != nil {
+        return nil, fmt.Errorf("binding to %s %s: %w", network, group, err)
+    }
+    conn := packetConn.(*net.UDPConn)
+
+    interfaces := config.Interfaces
+    if len(interfaces) == 0 {
+        interfaces = []*net.Interface{nil}
+    }
+
+    for _, ifi := range interfaces {
+        if err = JoinGroup(conn, ifi, gaddr.IP); err != nil {
+            _ = conn.Close()
+            return nil, err
+        }
+    }
+
+    if err = config.Apply(conn); err != nil {
+        _ = conn.Close()
+        return nil, err
+    }
+
+    return conn, nil
+}
+
+// Apply sets the TTL, loopback, sending interface and broadcast permission
+// on conn.
+func (config MulticastConfig) Apply(conn *net.UDPConn) error {
+    var ifi *net.Interface
+    if len(config.Interfaces) > 0 {
+        ifi = config.Interfaces[0]
+    }
+
+    ttl := config.TTL
+    if ttl <= 0 {
+        ttl = 1
+    }
+
+    return control(conn, "set multicast options", func(fd uintptr, ipv6 bool) error {
+        err := setMulticastOptions(fd, ipv6, ifi, ttl, !config.NoLoopback)
+        if err != nil {
+            return err
+        }
+
+        return setBroadcast(fd, config.Broadcast)
+    })
+}
+
+
+// JoinGroup makes conn receive datagrams sent to group on ifi, or on the
+// interface the system chooses if ifi is nil.
+func JoinGroup(conn *net.UDPConn, ifi *net.Interface, group net.IP) error {
+    return control(conn, "join " + group.String(), func(fd uintptr, ipv6 bool) error {
+        return setMembership(fd, ipv6, ifi, group, true)
+    })
+}
+
+// LeaveGroup undoes JoinGroup.
+func LeaveGroup(conn *net.UDPConn, ifi *net.Interface, group net.IP) error {
+    return control(conn, "leave " + group.String(), func(fd uintptr, ipv6 bool) error {
+        return setMembership(fd, ipv6, ifi, group, false)
+    })
+}
+
+
+// control runs f on the socket of conn, telling it whether the socket is
+// IPv6.
+func control(conn *net.UDPConn, op string, f func(fd uintptr, ipv6 bool) error) error {
+    raw, err := conn.SyscallConn()
+    if err != nil {
+        return err
+    }
+
+    laddr, _ := conn.LocalAddr().(*net.UDPAddr)
+    ipv6 := laddr != nil && laddr.IP.To4() == nil
+
+    var fErr error
+    err = raw.Control(func(fd uintptr) { fErr = f(fd, ipv6) })
+    if err == nil {
+        err = fErr
+    }
+    if err != nil {
+        return fmt.Errorf("%s: %w", op, err)
+    }
+
+    return nil
+}
+
+
+// interfaceIPv4 returns the first IPv4 address of ifi, which IPv4 socket
+// options use to name interfaces, or the unspecified address if ifi is nil.
+func interfaceIPv4(ifi *net.Interface) ([4]byte, error) {
+    var ip [4]byte
+
+    if ifi == nil {
+        return ip, nil
+    }
+
+    addrs, err := ifi.Addrs()
+    if err != nil {
+        return ip, err
+    }
+
+    for _, addr := range addrs {
+        if ipNet, ok := addr.(*net.IPNet); ok {
+            if ip4 := ipNet.IP.To4(); ip4 != nil {
+                copy(ip[:], ip4)
+                return ip, nil
+            }
+        }
+    }
+
+    return ip, fmt.Errorf("%s has no IPv4 address", ifi.Name)
+}
@@ -0,0 +1,20 @@
+package echo
+
+import "syscall"
+
+
+// setReuse lets several sockets bind to the same multicast port.
+func setReuse(fd uintptr) error {
+    err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+    if err != nil {
+        return err
+    }
+
+    return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEPORT, 1)
+}
+
+// setOwnGroups does nothing, since sockets only receive datagrams for the
+// groups they joined.
+func setOwnGroups(fd uintptr, ipv6 bool) error {
+    return nil
+}
@@ -0,0 +1,30 @@
+package echo
+
+import "syscall"
+
+
+// setReuse lets several sockets bind to the same multicast port, which Linux
+// allows UDP sockets with SO_REUSEADDR.
+func setReuse(fd uintptr) error {
+    return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+}
+
+
+// IP_MULTICAST_ALL and IPV6_MULTICAST_ALL, which the syscall package lacks on
+// some architectures.
+const (
+    ipMulticastAll = 0x31
+    ipv6MulticastAll = 0x1d
+)
+
+
+// setOwnGroups makes the socket receive datagrams only for the groups it
+// joined itself, rather than for any group a socket on the host joined,
+// which is what other systems do.
+func setOwnGroups(fd uintptr, ipv6 bool) error {
+    if ipv6 {
+        return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6MulticastAll, 0)
+    }
+
+    return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, ipMulticastAll, 0)
+}
@@ -0,0 +1,29 @@
+//go:build !darwin && !linux
+
+package echo
+
+import (
+    "errors"
+    "net"
+)
+
+
+func setReuse(fd uintptr) error {
+    return errors.ErrUnsupported
+}
+
+func setMembership(fd uintptr, ipv6 bool, ifi *net.Interface, group net.IP, join bool) error {
+    return errors.ErrUnsupported
+}
+
+func setMulticastOptions(fd uintptr, ipv6 bool, ifi *net.Interface, ttl int, loopback bool) error {
+    return errors.ErrUnsupported
+}
+
+func setBroadcast(fd uintptr, broadcast bool) error {
+    return errors.ErrUnsupported
+}
+
+func setOwnGroups(fd uintptr, ipv6 bool) error {
+    return errors.ErrUnsupported
+}
@@ -0,0 +1,93 @@
+//go:build darwin || linux
+
+package echo
+
+import (
+    "net"
+    "syscall"
+)
+
+
+func setMembership(fd uintptr, ipv6 bool, ifi *net.Interface, group net.IP, join bool) error {
+    if ipv6 {
+        mreq := &syscall.IPv6Mreq{}
+        copy(mreq.Multiaddr[:], group.To16())
+        if ifi != nil {
+            mreq.Interface = uint32(ifi.Index)
+        }
+
+        opt := syscall.IPV6_JOIN_GROUP
+        if !join {
+            opt = syscall.IPV6_LEAVE_GROUP
+        }
+
+        return syscall.SetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IPV6, opt, mreq)
+    }
+
+    ip, err := interfaceIPv4(ifi)
+    if err != nil {
+        return err
+    }
+
+    mreq := &syscall.IPMreq{Interface: ip}
+    copy(mreq.Multiaddr[:], group.To4())
+
+    opt := syscall.IP_ADD_MEMBERSHIP
+    if !join {
+        opt = syscall.IP_DROP_MEMBERSHIP
+    }
+
+    return syscall.SetsockoptIPMreq(int(fd), syscall.IPPROTO_IP, opt, mreq)
+}
+
+func setMulticastOptions(fd uintptr, ipv6 bool, ifi *net.Interface, ttl int, loopback bool) error {
+    loop := 0
+    if loopback {
+        loop = 1
+    }
+
+    if ipv6 {
+        if ifi != nil {
+            err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, ifi.Index)
+            if err != nil {
+                return err
+            }
+        }
+
+        err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, ttl)
+        if err != nil {
+            return err
+        }
+
+        return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_LOOP, loop)
+    }
+
+    if ifi != nil {
+        ip, err := interfaceIPv4(ifi)
+        if err != nil {
+            return err
+        }
+
+        err = syscall.SetsockoptInet4Addr(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, ip)
+        if err != nil {
+            return err
+        }
+    }
+
+    // Both take a byte on every platform, but only Linux takes an int too.
+    err := syscall.SetsockoptByte(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, byte(ttl))
+    if err != nil {
+        return err
+    }
+
+    return syscall.SetsockoptByte(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP, byte(loop))
+}
+
+func setBroadcast(fd uintptr, broadcast bool) error {
+    on := 0
+    if broadcast {
+        on = 1
+    }
+
+    return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, on)
+}
@@ -0,0 +1,179 @@
+package echo
+
+import (
+    "context"
+    "errors"
+    "net"
+    "strconv"
+    "testing"
+    "time"
+)
+
+
+// loopbackMulticast returns the loopback interface and a multicast group on a
+// free port, skipping the test if the loopback interface cannot join groups.
+func loopbackMulticast(t *testing.T) (*net.Interface, string) {
+    interfaces, err := net.Interfaces()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var lo *net.Interface
+    for i := range interfaces {
+        if interfaces[i].Flags & net.FlagLoopback != 0 {
+            lo = &interfaces[i]
+            break
+        }
+    }
+    if lo == nil {
+        t.Skip("no loopback interface")
+    }
+
+    free, err := net.ListenPacket("udp4", "127.0.0.1:")
+    if err != nil {
+        t.Fatal(err)
+    }
+    port := free.LocalAddr().(*net.UDPAddr).Port
+    _ = free.Close()
+
+    group := net.JoinHostPort("239.255.77.77", strconv.Itoa(port))
+
+    probe, err := MulticastConfig{Interfaces: []*net.Interface{lo}}.Listen(context.Background(), group)
+    if err != nil {
+        t.Skip(err)
+    }
+    _ = probe.Close()
+
+    return lo, group
+}
+
+
+// receive returns the next datagram on conn, or nil if none arrives soon.
+func receive(conn *net.UDPConn) []byte {
+    _ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+
+    buf := make([]byte, 1024)
+    n, _, err := conn.ReadFrom(buf)
+    if err != nil {
+        return nil
+    }
+
+    return buf[:n]
+}
+
+
+func TestMulticastGroup(t *testing.T) {
+    lo, group := loopbackMulticast(t)
+    config := MulticastConfig{Interfaces: []*net.Interface{lo}}
+
+    // Two listeners share the group's port.
+    var listeners []*net.UDPConn
+    for i := 0; i < 2; i++ {
+        conn, err := config.Listen(context.Background(), group)
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer conn.Close()
+
+        listeners = append(listeners, conn)
+    }
+
+    sender, err := net.ListenUDP("udp4", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer sender.Close()
+
+    gaddr, _ := net.ResolveUDPAddr("udp4", group)
+
+    send := func(msg string) {
+        if _, err := sender.WriteTo([]byte(msg), gaddr); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    if err = config.Apply(sender); err != nil {
+        t.Fatal(err)
+    }
+    send("hello")
+
+    for i, conn := range listeners {
+        if msg := receive(conn); string(msg) != "hello" {
+            t.Errorf("listener %d: expected %q; actual %q", i, "hello", msg)
+        }
+    }
+
+    // The first listener leaves the group.
+    if err = LeaveGroup(listeners[0], lo, gaddr.IP); err != nil {
+        t.Fatal(err)
+    }
+    send("still there?")
+
+    if msg := receive(listeners[0]); msg != nil {
+        t.Errorf("expected nothing after leaving; actual %q", msg)
+    }
+    if msg := receive(listeners[1]); string(msg) != "still there?" {
+        t.Errorf("expected %q; actual %q", "still there?", msg)
+    }
+}
+
+
+func TestDiscovery(t *testing.T) {
+    lo, group := loopbackMulticast(t)
+    config := MulticastConfig{Interfaces: []*net.Interface{lo}}
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    responders := []Responder{
+        {Services: []Service{{Type: "echo", Name: "first", Addr: ":7"}}},
+        {Services: []Service{{Type: "echo", Name: "second", Addr: "127.0.0.1:1007"}, {Type: "tftp", Name: "files", Addr: "127.0.0.1:69"}}},
+    }
+    for _, r := range responders {
+        r.Group, r.Multicast = group, config
+        if err := r.ListenAndServe(ctx); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    browser := Browser{Group: group, Multicast: config, Timeout: 200 * time.Millisecond}
+
+    services, err := browser.Browse(ctx, "echo")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    found := make(map[string]string)
+    for _, s := range services {
+        found[s.Name] = s.Addr
+    }
+
+    // The first responder's address stands in for the unspecified host.
+    if len(services) != 2 || found["first"] != "127.0.0.1:7" || found["second"] != "127.0.0.1:1007" {
+        t.Errorf("expected both echo services; actual %+v", services)
+    }
+
+    if services, err = browser.Browse(ctx, ""); err != nil || len(services) != 3 {
+        t.Errorf("expected all 3 services; actual %+v, %v", services, err)
+    }
+
+    // Broadcast queries reach the responders too.
+    _, port, _ := net.SplitHostPort(group)
+    broadcaster := Browser{
+        Group: net.JoinHostPort("127.255.255.255", port),
+        Multicast: MulticastConfig{Broadcast: true},
+        Timeout: 200 * time.Millisecond,
+    }
+
+    if services, err = broadcaster.Browse(ctx, "tftp"); err != nil || len(services) != 1 {
+        t.Errorf("expected the tftp service; actual %+v, %v", services, err)
+    }
+
+    // Canceling a search is not the same as running out of time.
+    canceled, cancelBrowse := context.WithCancel(ctx)
+    cancelBrowse()
+
+    if _, err = browser.Browse(canceled, "echo"); !errors.Is(err, context.Canceled) {
+        t.Errorf("expected %v; actual %v", context.Canceled, err)
+    }
+}
@@ -0,0 +1,725 @@
+package echo
+
+import (
+    "context"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "sync"
+    "time"
+)
+
+
+// The kinds of reliable stream packets. Every packet starts with a header of
+// its kind, its sequence number, and the sender's acknowledgment: the next
+// sequence number it expects, a bitmap of the 64 after that it already
+// received, and how many more bytes it has room to buffer.
+const (
+    reliableData byte = iota + 1
+    reliableAck
+    reliableFin
+    reliableProbe // asks for an acknowledgment, to learn whether the peer has room again
+)
+
+const (
+    reliableHeaderSize = 21 // kind, sequence number, acknowledgment, selective acknowledgments, receive window
+    maxReliableWindow = 64 // as many as the selective acknowledgment bitmap covers
+)
+
+
+// Reliable configures streams that carry bytes over UDP in order and without
+// loss. Like TFTP, a stream sends each segment until the peer acknowledges
+// it, but it keeps a window of segments in flight, and the peer acknowledges
+// those that arrived out of order so only the lost ones go again. Like TCP,
+// each end advertises how many bytes it has room to buffer for Read, and the
+// other stops sending once they are spoken for.
+type Reliable struct {
+    Window int // segments in flight; 0 means 32, and more than 64 means 64
+    MaxSegment int // payload bytes per datagram; 0 means 1200
+    ReadBuffer int // bytes received but not yet read that the stream holds; 0 means 64 segments
+    Timeout time.Duration // the retransmission timeout until the round trip time is known; 0 means 200ms
+    Retries int // the times to retransmit a segment before the stream fails; 0 means 10
+}
+
+
+// Stream is a net.Conn over a packet connection, exchanging reliable stream
+// packets with a single peer. Closing it waits until the peer acknowledged
+// everything written, then closes the packet connection. Either end can stop
+// writing first, with CloseWrite or Close: the other's Read returns io.EOF
+// after the data that came before, while its writes still go through.
+type Stream struct {
+    config Reliable
+    conn net.PacketConn
+    peer net.Addr
+
+    mu sync.Mutex
+    changed chan struct{} // closed, and replaced, whenever the state changes
+    done chan struct{} // closed along with the stream
+
+    // sending
+    nextSeq uint32
+    sendBase uint32 // the first sequence number the peer has yet to acknowledge
+    inFlight map[uint32]*segment
+    rto, srtt, rttvar time.Duration
+    peerWindow uint32 // the bytes the peer last said it had room for
+    probed time.Time // when the last window probe went out
+
+    // receiving
+    expected uint32 // the next sequence number to deliver
+    pending map[uint32]*segment // arrived out of order
+    readBuf []byte
+    advertised uint32 // the receive window last sent to the peer
+    peerClosed bool
+
+    readDeadline, writeDeadline time.Time
+    err error // why the stream failed
+    writeClosed, closing, closed bool
+
+    sent, retransmits, received, duplicates int64
+}
+
+
+// StreamStats are a Stream's counters.
+type StreamStats struct {
+    Sent int64 // segments, not counting retransmissions
+    Retransmits int64
+    Received int64 // segments, including duplicates
+    Duplicates int64
+    RTO time.Duration // the current retransmission timeout
+}
+
+
+type segment struct {
+    kind byte
+    seq uint32
+    payload []byte
+    sent time.Time
+    retries int
+}
+
+
+// Dial returns a stream to the peer at address over a new UDP socket.
+func (r Reliable) Dial(address string) (*Stream, error) {
+    peer, err := net.ResolveUDPAddr("udp", address)
+    if err != nil {
+        return nil, err
+    }
+
+    conn, err := net.ListenPacket("udp", "")
+    if err != nil {
+        return nil, err
+    }
+
+    return r.NewStream(conn, peer), nil
+}
+
+// Accept waits for the first packet that opens a stream on conn, and returns
+// the stream to its sender. Packets from anyone else are ignored from then on.
+func (r Reliable) Accept(ctx context.Context, conn net.PacketConn) (*Stream, error) {
+    stop := context.AfterFunc(ctx, func() {
+        _ = conn.SetReadDeadline(time.Now())
+    })
+
+    buf := make([]byte, MaxUDPPayload)
+
+    for {
+        n, addr, err := conn.ReadFrom(buf)
+        if err != nil {
+            stop()
+            if ctx.Err() != nil {
+                return nil, ctx.Err()
+            }
+
+            return nil, err
+        }
+
+        if n < reliableHeaderSize || (buf[0] != reliableData && buf[0] != reliableFin) {
+            continue
+        }
+
+        stop()
+        _ = conn.SetReadDeadline(time.Time{})
+
+        s := r.stream(conn, addr)
+        s.handle(buf[:n])
+        s.start()
+
+        return s, nil
+    }
+}
+
+// NewStream returns a stream to peer over conn. The stream reads from conn
+// from now on, and closes it when it closes.
+func (r Reliable) NewStream(conn net.PacketConn, peer net.Addr) *Stream {
+    s := r.stream(conn, peer)
+    s.start()
+
+    return s
+}
+
+
+func (r Reliable) stream(conn net.PacketConn, peer net.Addr) *Stream {
+    if r.Window <= 0 {
+        r.Window = 32
+    }
+    if r.Window > maxReliableWindow {
+        r.Window = maxReliableWindow
+    }
+    if r.MaxSegment <= 0 {
+        r.MaxSegment = 1200
+    }
+    if r.Timeout <= 0 {
+        r.Timeout = 200 * time.Millisecond
+    }
+    if r.Retries <= 0 {
+        r.Retries = 10
+    }
+    if r.ReadBuffer <= 0 {
+        r.ReadBuffer = 64 * r.MaxSegment
+    }
+
+    return &Stream{
+        config: r,
+        conn: conn,
+        peer: peer,
+        changed: make(chan struct{}),
+        done: make(chan struct{}),
+        nextSeq: 1,
+        sendBase: 1,
+        inFlight: make(map[uint32]*segment),
+        rto: r.Timeout,
+        // Until the peer says otherwise, assume it has as much room as this
+        // end does.
+        peerWindow: uint32(r.ReadBuffer),
+        expected: 1,
+        pending: make(map[uint32]*segment),
+    }
+}
+
+
+func (s *Stream) Read(b []byte) (int, error) {
+    s.mu.Lock()
+
+    for {
+        switch {
+        case len(s.readBuf) > 0:
+            n := copy(b, s.readBuf)
+            s.readBuf = s.readBuf[n:]
+            if len(s.readBuf) == 0 {
+                s.readBuf = nil
+            }
+
+            // Tell a peer that ran out of room that there is some again.
+            var update []byte
+            if threshold := uint32(min(s.config.MaxSegment, s.config.ReadBuffer / 2)); s.advertised < threshold && s.window() >= threshold {
+                update = s.packet(reliableAck, 0, nil)
+            }
+            s.mu.Unlock()
+
+            if update != nil {
+                _, _ = s.conn.WriteTo(update, s.peer)
+            }
+
+            return n, nil
+        case s.peerClosed:
+            s.mu.Unlock()
+            return 0, io.EOF
+        case s.closing:
+            s.mu.Unlock()
+            return 0, net.ErrClosed
+        case s.err != nil:
+            s.mu.Unlock()
+            return 0, s.err
+        }
+
+        if err := s.wait(s.readDeadline); err != nil {
+            s.mu.Unlock()
+            return 0, err
+        }
+    }
+}
+
+// Write splits b into segments and queues them, blocking while the window is
+// full or the peer has no room for them. It returns once the segments are
+// sent, not acknowledged.
+func (s *Stream) Write(b []byte) (int, error) {
+    written := 0
+
+    for len(b) > 0 {
+        size := min(len(b), s.config.MaxSegment)
+
+        if err := s.send(reliableData, b[:size]); err != nil {
+            return written, err
+        }
+
+        written += size
+        b = b[size:]
+    }
+
+    return written, nil
+}
+
+// CloseWrite sends the end of the stream, after the data written before it,
+// and returns without waiting for the peer to acknowledge it. The stream
+// keeps reading until the peer closes its end too.
+func (s *Stream) CloseWrite() error {
+    s.mu.Lock()
+    if s.writeClosed || s.closing {
+        s.mu.Unlock()
+        return net.ErrClosed
+    }
+    s.writeClosed = true
+    s.signal()
+    s.mu.Unlock()
+
+    return s.send(reliableFin, nil)
+}
+
+// Close sends the end of the stream, unless CloseWrite did, and waits for the
+// peer to acknowledge it along with the rest. It returns an error if the
+// peer never did. The packet connection closes a few retransmission timeouts
+// later, so the stream can still acknowledge the peer's end.
+func (s *Stream) Close() error {
+    s.mu.Lock()
+    if s.closing {
+        s.mu.Unlock()
+        return net.ErrClosed
+    }
+    s.closing = true
+    sendFin := !s.writeClosed
+    s.writeClosed = true
+    s.signal()
+    s.mu.Unlock()
+
+    var err error
+    if sendFin {
+        err = s.send(reliableFin, nil)
+    }
+
+    // The peer closing its end does not mean it has what this end wrote. Once
+    // only the end of the stream is left, though, a peer that closed may be
+    // gone already, so its acknowledgment is worth a linger at most.
+    lingerFor := 3 * max(s.rto, s.config.Timeout)
+    var finDeadline time.Time
+
+    s.mu.Lock()
+    for err == nil && s.err == nil && len(s.inFlight) > 0 {
+        if s.peerClosed && s.finLeft() {
+            if finDeadline.IsZero() {
+                finDeadline = time.Now().Add(lingerFor)
+            }
+            if s.wait(finDeadline) != nil {
+                break
+            }
+            continue
+        }
+
+        _ = s.wait(time.Time{})
+    }
+    if err == nil {
+        err = s.err
+    }
+    s.closed = true
+    close(s.done)
+    s.signal()
+    s.mu.Unlock()
+
+    if err != nil {
+        _ = s.conn.Close()
+        return err
+    }
+
+    // Linger to acknowledge the peer's end if it comes soon, or again if the
+    // first acknowledgment was lost, as TCP does in TIME-WAIT.
+    time.AfterFunc(lingerFor, func() { _ = s.conn.Close() })
+
+    return nil
+}
+
+// finLeft reports whether the end of the stream is all that is in flight.
+// The caller must hold s.mu.
+func (s *Stream) finLeft() bool {
+    for _, seg := range s.inFlight {
+        if seg.kind != reliableFin {
+            return false
+        }
+    }
+
+    return true
+}
+
+// Stats returns the stream's counters.
+func (s *Stream) Stats() StreamStats {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return StreamStats{
+        Sent: s.sent,
+        Retransmits: s.retransmits,
+        Received: s.received,
+        Duplicates: s.duplicates,
+        RTO: s.rto,
+    }
+}
+
+func (s *Stream) LocalAddr() net.Addr {
+    return s.conn.LocalAddr()
+}
+
+func (s *Stream) RemoteAddr() net.Addr {
+    return s.peer
+}
+
+func (s *Stream) SetDeadline(t time.Time) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.readDeadline, s.writeDeadline = t, t
+    s.signal()
+
+    return nil
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.readDeadline = t
+    s.signal()
+
+    return nil
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.writeDeadline = t
+    s.signal()
+
+    return nil
+}
+
+
+func (s *Stream) start() {
+    go s.receive()
+    go s.retransmit()
+}
+
+// send queues a segment once the window has room for it, and the peer has
+// room for its payload.
+func (s *Stream) send(kind byte, payload []byte) error {
+    s.mu.Lock()
+
+    for {
+        switch {
+        case s.closed, s.closing && kind == reliableData:
+            s.mu.Unlock()
+            return net.ErrClosed
+        case s.writeClosed && kind == reliableData:
+            s.mu.Unlock()
+            return io.ErrClosedPipe
+        case s.err != nil:
+            s.mu.Unlock()
+            return s.err
+        }
+
+        if s.nextSeq < s.sendBase + uint32(s.config.Window) && s.peerHasRoom(len(payload)) {
+            break
+        }
+
+        if err := s.wait(s.writeDeadline); err != nil {
+            s.mu.Unlock()
+            return err
+        }
+    }
+
+    seg := &segment{kind: kind, seq: s.nextSeq, payload: append([]byte(nil), payload...), sent: time.Now()}
+    s.nextSeq++
+    s.inFlight[seg.seq] = seg
+    s.sent++
+
+    packet := s.packet(seg.kind, seg.seq, seg.payload)
+    s.mu.Unlock()
+
+    // A lost datagram is retransmitted like any other.
+    _, _ = s.conn.WriteTo(packet, s.peer)
+
+    return nil
+}
+
+// receive handles the peer's packets until the packet connection closes.
+func (s *Stream) receive() {
+    buf := make([]byte, MaxUDPPayload)
+
+    for {
+        n, addr, err := s.conn.ReadFrom(buf)
+        if err != nil {
+            s.mu.Lock()
+            s.fail(err)
+            s.mu.Unlock()
+            return
+        }
+
+        if addr.String() != s.peer.String() {
+            continue
+        }
+
+        s.handle(buf[:n])
+    }
+}
+
+// handle processes a packet from the peer and acknowledges any segment in it.
+func (s *Stream) handle(p []byte) {
+    if len(p) < reliableHeaderSize {
+        return
+    }
+
+    kind := p[0]
+    seq := binary.BigEndian.Uint32(p[1:5])
+    ack := binary.BigEndian.Uint32(p[5:9])
+    sack := binary.BigEndian.Uint64(p[9:17])
+    window := binary.BigEndian.Uint32(p[17:21])
+
+    s.mu.Lock()
+
+    s.acknowledge(ack, sack)
+    s.peerWindow = window
+
+    var reply []byte
+    switch kind {
+    case reliableData, reliableFin:
+        s.accept(&segment{kind: kind, seq: seq, payload: append([]byte(nil), p[reliableHeaderSize:]...)})
+        reply = s.packet(reliableAck, 0, nil)
+    case reliableProbe:
+        reply = s.packet(reliableAck, 0, nil)
+    }
+
+    s.signal()
+    s.mu.Unlock()
+
+    if reply != nil {
+        _, _ = s.conn.WriteTo(reply, s.peer)
+    }
+}
+
+// acknowledge drops the segments the peer received from those in flight. The
+// caller must hold s.mu.
+func (s *Stream) acknowledge(ack uint32, sack uint64) {
+    now := time.Now()
+
+    for seq, seg := range s.inFlight {
+        received := seq < ack || (seq > ack && seq - ack - 1 < 64 && sack & (1 << (seq - ack - 1)) != 0)
+        if !received {
+            continue
+        }
+
+        // Karn's algorithm: a retransmitted segment's round trip is ambiguous.
+        if seg.retries == 0 {
+            s.sample(now.Sub(seg.sent))
+        }
+        delete(s.inFlight, seq)
+    }
+
+    if ack > s.sendBase {
+        s.sendBase = ack
+    }
+}
+
+// peerHasRoom reports whether the peer can buffer size more bytes on top of
+// those in flight. With nothing in flight, any room will do, so a peer with
+// less room than a segment still gets one. The caller must hold s.mu.
+func (s *Stream) peerHasRoom(size int) bool {
+    if size == 0 {
+        return true
+    }
+
+    var unacknowledged int
+    for _, seg := range s.inFlight {
+        unacknowledged += len(seg.payload)
+    }
+
+    if unacknowledged == 0 {
+        return s.peerWindow > 0
+    }
+
+    return unacknowledged + size <= int(s.peerWindow)
+}
+
+// window returns the bytes this end has room to buffer. The caller must
+// hold s.mu.
+func (s *Stream) window() uint32 {
+    used := len(s.readBuf)
+    for _, seg := range s.pending {
+        used += len(seg.payload)
+    }
+
+    return uint32(max(s.config.ReadBuffer - used, 0))
+}
+
+// sample updates the retransmission timeout with a round trip time, as TCP
+// does (RFC 6298). The caller must hold s.mu.
+func (s *Stream) sample(rtt time.Duration) {
+    if s.srtt == 0 {
+        s.srtt, s.rttvar = rtt, rtt / 2
+    } else {
+        delta := s.srtt - rtt
+        if delta < 0 {
+            delta = -delta
+        }
+        s.rttvar = (3 * s.rttvar + delta) / 4
+        s.srtt = (7 * s.srtt + rtt) / 8
+    }
+
+    s.rto = max(s.srtt + 4 * s.rttvar, time.Millisecond)
+}
+
+// accept delivers a segment if it is next, and holds on to it if it arrived
+// early. The caller must hold s.mu.
+func (s *Stream) accept(seg *segment) {
+    s.received++
+
+    switch {
+    case seg.seq < s.expected || s.pending[seg.seq] != nil:
+        s.duplicates++
+    case seg.seq == s.expected:
+        s.deliver(seg)
+
+        for next := s.pending[s.expected]; next != nil; next = s.pending[s.expected] {
+            delete(s.pending, next.seq)
+            s.deliver(next)
+        }
+    case seg.seq < s.expected + maxReliableWindow + 1:
+        s.pending[seg.seq] = seg
+    }
+}
+
+// deliver hands the next segment to Read. The caller must hold s.mu.
+func (s *Stream) deliver(seg *segment) {
+    s.expected++
+
+    if seg.kind == reliableFin {
+        s.peerClosed = true
+        return
+    }
+
+    s.readBuf = append(s.readBuf, seg.payload...)
+}
+
+// retransmit sends the segments again whose timeouts ran out, doubling the
+// timeout each time, and fails the stream once one runs out of retries. While
+// the peer has no room and nothing is in flight, it probes the peer every
+// timeout, in case the acknowledgment that opened its window was lost.
+func (s *Stream) retransmit() {
+    ticker := time.NewTicker(max(s.config.Timeout / 4, time.Millisecond))
+    defer ticker.Stop()
+
+    for {
+        var now time.Time
+
+        select {
+        case <-s.done:
+            return
+        case now = <-ticker.C:
+        }
+
+        var packets [][]byte
+
+        s.mu.Lock()
+        for _, seg := range s.inFlight {
+            if now.Sub(seg.sent) < s.rto << min(seg.retries, 6) {
+                continue
+            }
+
+            if seg.retries >= s.config.Retries {
+                s.fail(fmt.Errorf("%w: segment %d unacknowledged after %d retries", ErrNoReply, seg.seq, seg.retries))
+                break
+            }
+
+            seg.retries++
+            seg.sent = now
+            s.retransmits++
+            packets = append(packets, s.packet(seg.kind, seg.seq, seg.payload))
+        }
+        if s.peerWindow == 0 && len(s.inFlight) == 0 && now.Sub(s.probed) >= s.rto {
+            s.probed = now
+            packets = append(packets, s.packet(reliableProbe, 0, nil))
+        }
+        failed := s.err != nil
+        s.mu.Unlock()
+
+        for _, packet := range packets {
+            _, _ = s.conn.WriteTo(packet, s.peer)
+        }
+
+        if failed {
+            return
+        }
+    }
+}
+
+// fail records why the stream stopped working, unless it closed anyway. The
+// caller must hold s.mu.
+func (s *Stream) fail(err error) {
+    if s.err == nil && !s.closed {
+        s.err = err
+        s.signal()
+    }
+}
+
+// packet encodes a packet carrying the current acknowledgment and receive
+// window. The caller must hold s.mu.
+func (s *Stream) packet(kind byte, seq uint32, payload []byte) []byte {
+    var sack uint64
+    for seq := range s.pending {
+        sack |= 1 << (seq - s.expected - 1)
+    }
+
+    s.advertised = s.window()
+
+    p := make([]byte, reliableHeaderSize, reliableHeaderSize + len(payload))
+    p[0] = kind
+    binary.BigEndian.PutUint32(p[1:5], seq)
+    binary.BigEndian.PutUint32(p[5:9], s.expected)
+    binary.BigEndian.PutUint64(p[9:17], sack)
+    binary.BigEndian.PutUint32(p[17:21], s.advertised)
+
+    return append(p, payload...)
+}
+
+// wait releases s.mu until the state changes or deadline passes. The caller
+// must hold s.mu.
+func (s *Stream) wait(deadline time.Time) error {
+    var timeout <-chan time.Time
+
+    if !deadline.IsZero() {
+        d := time.Until(deadline)
+        if d <= 0 {
+            return os.ErrDeadlineExceeded
+        }
+
+        timer := time.NewTimer(d)
+        defer timer.Stop()
+        timeout = timer.C
+    }
+
+    changed := s.changed
+    s.mu.Unlock()
+    defer s.mu.Lock()
+
+    select {
+    case <-changed:
+        return nil
+    case <-timeout:
+        return os.ErrDeadlineExceeded
+    }
+}
+
+// signal wakes everyone waiting for the state to change. The caller must
+// hold s.mu.
+func (s *Stream) signal() {
+    close(s.changed)
+    s.changed = make(chan struct{})
+}
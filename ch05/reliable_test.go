@@ -0,0 +1,278 @@
+package echo
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "io"
+    "math/rand/v2"
+    "net"
+    "os"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+
+// lossyConn drops every nth datagram it writes.
+type lossyConn struct {
+    net.PacketConn
+    n int64
+    writes int64
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+    if atomic.AddInt64(&c.writes, 1) % c.n == 0 {
+        return len(b), nil
+    }
+
+    return c.PacketConn.WriteTo(b, addr)
+}
+
+
+// streamPair returns a stream dialed over conns that drop every nth datagram,
+// and the stream its peer accepted. Zero means no loss.
+func streamPair(t *testing.T, config Reliable, n int64) (*Stream, *Stream) {
+    listen := func() net.PacketConn {
+        conn, err := net.ListenPacket("udp", "127.0.0.1:")
+        if err != nil {
+            t.Fatal(err)
+        }
+        if n > 0 {
+            return &lossyConn{PacketConn: conn, n: n}
+        }
+        return conn
+    }
+
+    serverConn, clientConn := listen(), listen()
+
+    client := config.NewStream(clientConn, serverConn.LocalAddr())
+    t.Cleanup(func() { _ = client.Close() })
+
+    // The first segment opens the stream.
+    if _, err := client.Write([]byte("hi")); err != nil {
+        t.Fatal(err)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+    defer cancel()
+
+    server, err := config.Accept(ctx, serverConn)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { _ = server.Close() })
+
+    buf := make([]byte, 2)
+    if _, err = io.ReadFull(server, buf); err != nil || string(buf) != "hi" {
+        t.Fatalf("expected %q; actual %q, %v", "hi", buf, err)
+    }
+
+    return client, server
+}
+
+
+func TestStreamLoss(t *testing.T) {
+    client, server := streamPair(t, Reliable{Timeout: 20 * time.Millisecond, MaxSegment: 500}, 4)
+
+    payload := make([]byte, 200 << 10)
+    for i := range payload {
+        payload[i] = byte(rand.IntN(256))
+    }
+
+    // Write in chunks of all sizes, then close to send the end of the stream.
+    go func() {
+        for b := payload; len(b) > 0; {
+            n := min(len(b), 1 + rand.IntN(3000))
+            if _, err := client.Write(b[:n]); err != nil {
+                t.Error(err)
+                return
+            }
+            b = b[n:]
+        }
+
+        if err := client.Close(); err != nil {
+            t.Error(err)
+        }
+    }()
+
+    received, err := io.ReadAll(server)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if !bytes.Equal(received, payload) {
+        t.Fatalf("expected %d bytes in order; received %d", len(payload), len(received))
+    }
+
+    if stats := client.Stats(); stats.Retransmits == 0 {
+        t.Errorf("expected retransmissions of the lost segments; actual %+v", stats)
+    }
+}
+
+
+func TestStreamHalfClose(t *testing.T) {
+    client, server := streamPair(t, Reliable{Timeout: 20 * time.Millisecond, MaxSegment: 500}, 5)
+
+    reply := make([]byte, 50 << 10)
+    for i := range reply {
+        reply[i] = byte(rand.IntN(256))
+    }
+
+    // The server answers once the request ends, and closes right away.
+    go func() {
+        if _, err := io.ReadAll(server); err != nil {
+            t.Error(err)
+            return
+        }
+
+        if _, err := server.Write(reply); err != nil {
+            t.Error(err)
+            return
+        }
+
+        if err := server.Close(); err != nil {
+            t.Error(err)
+        }
+    }()
+
+    if _, err := client.Write([]byte("request")); err != nil {
+        t.Fatal(err)
+    }
+    if err := client.CloseWrite(); err != nil {
+        t.Fatal(err)
+    }
+
+    if _, err := client.Write([]byte("more")); !errors.Is(err, io.ErrClosedPipe) {
+        t.Errorf("expected writing after CloseWrite to fail; actual %v", err)
+    }
+
+    // Closing must not drop the reply segments the server lost.
+    received, err := io.ReadAll(client)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if !bytes.Equal(received, reply) {
+        t.Fatalf("expected the %d byte reply; received %d bytes", len(reply), len(received))
+    }
+}
+
+
+func TestStreamFlowControl(t *testing.T) {
+    config := Reliable{MaxSegment: 500, ReadBuffer: 4000}
+    client, server := streamPair(t, config, 0)
+
+    payload := bytes.Repeat([]byte("flow"), 10 << 10)
+
+    // The server does not read, so the client stalls once its buffer fills.
+    _ = client.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+    n, err := client.Write(payload)
+    if !errors.Is(err, os.ErrDeadlineExceeded) {
+        t.Fatalf("expected the write to stall; wrote %d bytes: %v", n, err)
+    }
+
+    server.mu.Lock()
+    buffered := len(server.readBuf)
+    server.mu.Unlock()
+
+    if buffered > config.ReadBuffer + config.MaxSegment {
+        t.Errorf("expected at most %d bytes buffered; actual %d", config.ReadBuffer + config.MaxSegment, buffered)
+    }
+
+    // Reading makes room for the rest.
+    _ = client.SetWriteDeadline(time.Time{})
+    go func() {
+        if _, err := client.Write(payload[n:]); err != nil {
+            t.Error(err)
+        }
+        _ = client.CloseWrite()
+    }()
+
+    received, err := io.ReadAll(server)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if !bytes.Equal(received, payload) {
+        t.Fatalf("expected %d bytes in order; received %d", len(payload), len(received))
+    }
+}
+
+
+func TestStreamDeadline(t *testing.T) {
+    _, server := streamPair(t, Reliable{}, 0)
+
+    _ = server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+    _, err := server.Read(make([]byte, 1))
+    if !errors.Is(err, os.ErrDeadlineExceeded) {
+        t.Fatalf("expected a timeout; actual %v", err)
+    }
+
+    var netErr net.Error
+    if !errors.As(err, &netErr) || !netErr.Timeout() {
+        t.Errorf("expected a net.Error timeout; actual %v", err)
+    }
+}
+
+
+func TestStreamPeerGone(t *testing.T) {
+    client, server := streamPair(t, Reliable{Timeout: 10 * time.Millisecond, Retries: 3}, 0)
+
+    // The peer's socket goes away without closing the stream.
+    _ = server.conn.Close()
+
+    if _, err := client.Write([]byte("anyone?")); err != nil {
+        t.Fatal(err)
+    }
+
+    if err := client.Close(); !errors.Is(err, ErrNoReply) {
+        t.Fatalf("expected %v; actual %v", ErrNoReply, err)
+    }
+}
+
+
+func TestStreamOverUDP(t *testing.T) {
+    large := bytes.Repeat([]byte("Clear is better than clever. "), 1000)
+    small := []byte("Errors are values.")
+
+    serverConnection, err := net.ListenPacket("udp", "127.0.0.1:")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    client, err := Reliable{}.Dial(serverConnection.LocalAddr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    go func() {
+        defer client.Close()
+
+        for _, message := range [][]byte{large, small} {
+            if _, err := client.Write(message); err != nil {
+                t.Error(err)
+                return
+            }
+        }
+    }()
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+    defer cancel()
+
+    server, err := Reliable{}.Accept(ctx, serverConnection)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer server.Close()
+
+    received, err := io.ReadAll(server)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if expected := append(append([]byte(nil), large...), small...); !bytes.Equal(received, expected) {
+        t.Errorf("expected %d bytes in order; received %d", len(expected), len(received))
+    }
+}
@@ -0,0 +1,434 @@
+package echo
+
+import (
+    "fmt"
+    "net"
+    "os"
+    "sync"
+    "time"
+
+    "github.com/bgabor666/gnp/ch03"
+)
+
+
+// Sessions configures listeners that split the datagrams arriving on a
+// packet connection into a session per sender.
+type Sessions struct {
+    IdleTimeout time.Duration // sessions without traffic for this long expire; 0 means 30 seconds
+    Backlog int // new sessions waiting for Accept; 0 means 16, and senders beyond it are ignored
+    QueueSize int // datagrams waiting per session; 0 means 32, and more are dropped
+    MaxDatagramSize int // longer datagrams are truncated; 0 means MaxUDPPayload
+}
+
+
+// SessionListener is a net.Listener over a packet connection. The first
+// datagram from a new address opens a Session for it, which Accept returns,
+// and the address's later datagrams go to that session until it closes or
+// expires.
+type SessionListener struct {
+    config Sessions
+    conn net.PacketConn
+
+    mu sync.Mutex
+    sessions map[string]*Session
+    err error // why the listener stopped
+
+    accept chan *Session
+    done chan struct{}
+    once sync.Once
+}
+
+
+// Session is a net.Conn to a single peer of a SessionListener. Each Read
+// returns one datagram, truncated to fit, and each Write sends one.
+type Session struct {
+    listener *SessionListener
+    key string
+    peer net.Addr
+    queue chan []byte
+
+    mu sync.Mutex
+    changed chan struct{} // closed, and replaced, whenever a deadline changes
+    readDeadline, writeDeadline time.Time
+    active time.Time // the last datagram in either direction
+    err error // why the session closed
+
+    done chan struct{}
+    once sync.Once
+}
+
+
+// ListenPacket listens on address and returns a SessionListener on it.
+func (config Sessions) ListenPacket(network, address string) (*SessionListener, error) {
+    conn, err := net.ListenPacket(network, address)
+    if err != nil {
+        return nil, fmt.Errorf("binding to %s %s: %w", network, address, err)
+    }
+
+    return config.Listen(conn), nil
+}
+
+// Listen returns a SessionListener reading from conn. Closing the listener
+// closes conn.
+func (config Sessions) Listen(conn net.PacketConn) *SessionListener {
+    if config.IdleTimeout <= 0 {
+        config.IdleTimeout = 30 * time.Second
+    }
+    if config.Backlog <= 0 {
+        config.Backlog = 16
+    }
+    if config.QueueSize <= 0 {
+        config.QueueSize = 32
+    }
+    if config.MaxDatagramSize <= 0 {
+        config.MaxDatagramSize = MaxUDPPayload
+    }
+
+    l := &SessionListener{
+        config: config,
+        conn: conn,
+        sessions: make(map[string]*Session),
+        accept: make(chan *Session, config.Backlog),
+        done: make(chan struct{}),
+    }
+
+    go l.receive()
+    go l.expire()
+
+    return l
+}
+
+
+// Accept returns the next new session.
+func (l *SessionListener) Accept() (net.Conn, error) {
+    s, err := l.AcceptSession()
+    if err != nil {
+        return nil, err
+    }
+
+    return s, nil
+}
+
+// AcceptSession is Accept returning a *Session.
+func (l *SessionListener) AcceptSession() (*Session, error) {
+    select {
+    case s := <-l.accept:
+        return s, nil
+    case <-l.done:
+    }
+
+    // Sessions that arrived before the listener stopped are still handed out.
+    select {
+    case s := <-l.accept:
+        return s, nil
+    default:
+    }
+
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    return nil, l.err
+}
+
+// Close closes the packet connection, and with it every session.
+func (l *SessionListener) Close() error {
+    err := l.conn.Close()
+    l.stop(net.ErrClosed)
+
+    return err
+}
+
+func (l *SessionListener) Addr() net.Addr {
+    return l.conn.LocalAddr()
+}
+
+// Len returns the number of open sessions.
+func (l *SessionListener) Len() int {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    return len(l.sessions)
+}
+
+
+// receive hands datagrams to the sessions of their senders until the packet
+// connection fails.
+func (l *SessionListener) receive() {
+    buf := make([]byte, l.config.MaxDatagramSize)
+
+    for {
+        n, addr, err := l.conn.ReadFrom(buf)
+        if err != nil {
+            l.stop(err)
+            return
+        }
+
+        // Nothing can go back to an unbound unixgram socket.
+        if addr == nil {
+            continue
+        }
+
+        s := l.session(addr)
+        if s == nil {
+            continue
+        }
+
+        s.touch()
+
+        select {
+        case s.queue <- append([]byte(nil), buf[:n]...):
+        default:
+            // The session is behind, so the datagram is lost, as it would be
+            // if the socket's buffer were full.
+        }
+    }
+}
+
+// session returns the session of addr, opening one if there is room in the
+// backlog.
+func (l *SessionListener) session(addr net.Addr) *Session {
+    key := addr.String()
+
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    if s := l.sessions[key]; s != nil {
+        return s
+    }
+
+    s := &Session{
+        listener: l,
+        key: key,
+        peer: addr,
+        queue: make(chan []byte, l.config.QueueSize),
+        changed: make(chan struct{}),
+        active: time.Now(),
+        done: make(chan struct{}),
+    }
+
+    select {
+    case l.accept <- s:
+    default:
+        return nil
+    }
+    l.sessions[key] = s
+
+    return s
+}
+
+// expire closes the sessions that idled past the timeout.
+func (l *SessionListener) expire() {
+    ticker := time.NewTicker(max(l.config.IdleTimeout / 4, time.Millisecond))
+    defer ticker.Stop()
+
+    for {
+        var now time.Time
+
+        select {
+        case <-l.done:
+            return
+        case now = <-ticker.C:
+        }
+
+        var idle []*Session
+
+        l.mu.Lock()
+        for _, s := range l.sessions {
+            s.mu.Lock()
+            if now.Sub(s.active) >= l.config.IdleTimeout {
+                idle = append(idle, s)
+            }
+            s.mu.Unlock()
+        }
+        l.mu.Unlock()
+
+        for _, s := range idle {
+            s.close(fmt.Errorf("%w: %w", ch03.ErrIdleTimeout, os.ErrDeadlineExceeded))
+        }
+    }
+}
+
+// stop ends the listener and its sessions with err.
+func (l *SessionListener) stop(err error) {
+    l.once.Do(func() {
+        l.mu.Lock()
+        l.err = err
+        sessions := make([]*Session, 0, len(l.sessions))
+        for _, s := range l.sessions {
+            sessions = append(sessions, s)
+        }
+        l.mu.Unlock()
+
+        close(l.done)
+
+        for _, s := range sessions {
+            s.close(net.ErrClosed)
+        }
+    })
+}
+
+func (l *SessionListener) remove(s *Session) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    if l.sessions[s.key] == s {
+        delete(l.sessions, s.key)
+    }
+}
+
+
+// Read returns the next datagram from the peer. Once the session expired, it
+// returns an error wrapping ch03.ErrIdleTimeout.
+func (s *Session) Read(b []byte) (int, error) {
+    for {
+        // Datagrams that arrived before the session closed are still read.
+        select {
+        case datagram := <-s.queue:
+            return copy(b, datagram), nil
+        default:
+        }
+
+        s.mu.Lock()
+        deadline, changed := s.readDeadline, s.changed
+        s.mu.Unlock()
+
+        var timer *time.Timer
+        var timeout <-chan time.Time
+        if !deadline.IsZero() {
+            d := time.Until(deadline)
+            if d <= 0 {
+                return 0, os.ErrDeadlineExceeded
+            }
+
+            timer = time.NewTimer(d)
+            timeout = timer.C
+        }
+
+        n, again, err := s.wait(b, timeout, changed)
+        if timer != nil {
+            timer.Stop()
+        }
+        if !again {
+            return n, err
+        }
+    }
+}
+
+// wait reads the next datagram once it arrives, and reports whether to wait
+// again because a deadline changed.
+func (s *Session) wait(b []byte, timeout <-chan time.Time, changed <-chan struct{}) (int, bool, error) {
+    select {
+    case datagram := <-s.queue:
+        return copy(b, datagram), false, nil
+    case <-s.done:
+        select {
+        case datagram := <-s.queue:
+            return copy(b, datagram), false, nil
+        default:
+        }
+
+        return 0, false, s.closeErr()
+    case <-timeout:
+        return 0, false, os.ErrDeadlineExceeded
+    case <-changed:
+        return 0, true, nil
+    }
+}
+
+// Write sends b to the peer in a single datagram. The packet connection is
+// shared, so the write deadline only keeps Write from starting late.
+func (s *Session) Write(b []byte) (int, error) {
+    select {
+    case <-s.done:
+        return 0, s.closeErr()
+    default:
+    }
+
+    s.mu.Lock()
+    deadline := s.writeDeadline
+    s.mu.Unlock()
+
+    if !deadline.IsZero() && !time.Now().Before(deadline) {
+        return 0, os.ErrDeadlineExceeded
+    }
+
+    s.touch()
+
+    return s.listener.conn.WriteTo(b, s.peer)
+}
+
+// Close ends the session. A later datagram from the peer opens a new one.
+func (s *Session) Close() error {
+    s.close(net.ErrClosed)
+
+    return nil
+}
+
+func (s *Session) LocalAddr() net.Addr {
+    return s.listener.conn.LocalAddr()
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+    return s.peer
+}
+
+func (s *Session) SetDeadline(t time.Time) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.readDeadline, s.writeDeadline = t, t
+    s.signal()
+
+    return nil
+}
+
+func (s *Session) SetReadDeadline(t time.Time) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.readDeadline = t
+    s.signal()
+
+    return nil
+}
+
+func (s *Session) SetWriteDeadline(t time.Time) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.writeDeadline = t
+
+    return nil
+}
+
+
+func (s *Session) touch() {
+    s.mu.Lock()
+    s.active = time.Now()
+    s.mu.Unlock()
+}
+
+func (s *Session) close(err error) {
+    s.once.Do(func() {
+        s.mu.Lock()
+        s.err = err
+        s.mu.Unlock()
+
+        s.listener.remove(s)
+        close(s.done)
+    })
+}
+
+func (s *Session) closeErr() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return s.err
+}
+
+// signal wakes a Read waiting for the old deadline. The caller must hold
+// s.mu.
+func (s *Session) signal() {
+    close(s.changed)
+    s.changed = make(chan struct{})
+}
@@ -0,0 +1,195 @@
+package echo
+
+import (
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "testing"
+    "time"
+
+    "github.com/bgabor666/gnp/ch03"
+)
+
+
+// countingSessions replies to each datagram with how many the session has
+// seen so far, which only works if each peer keeps its session.
+func countingSessions(listener *SessionListener) {
+    go func() {
+        for {
+            session, err := listener.Accept()
+            if err != nil {
+                return
+            }
+
+            go func(c net.Conn) {
+                defer c.Close()
+
+                buf := make([]byte, 1024)
+                for count := 1; ; count++ {
+                    n, err := c.Read(buf)
+                    if err != nil {
+                        return
+                    }
+
+                    if _, err = fmt.Fprintf(c, "%s %d", buf[:n], count); err != nil {
+                        return
+                    }
+                }
+            }(session)
+        }
+    }()
+}
+
+
+func sessionExchange(t *testing.T, client net.Conn, msg string) string {
+    if _, err := client.Write([]byte(msg)); err != nil {
+        t.Fatal(err)
+    }
+
+    _ = client.SetReadDeadline(time.Now().Add(time.Second))
+
+    buf := make([]byte, 1024)
+    n, err := client.Read(buf)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return string(buf[:n])
+}
+
+
+func TestSessionsDemultiplex(t *testing.T) {
+    listener, err := Sessions{}.ListenPacket("udp", "127.0.0.1:")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer listener.Close()
+
+    countingSessions(listener)
+
+    var clients []net.Conn
+    for i := 0; i < 3; i++ {
+        client, err := net.Dial("udp", listener.Addr().String())
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer client.Close()
+
+        clients = append(clients, client)
+    }
+
+    for round := 1; round <= 3; round++ {
+        for i, client := range clients {
+            msg := fmt.Sprintf("client %d", i)
+            if expected, actual := fmt.Sprintf("%s %d", msg, round), sessionExchange(t, client, msg); actual != expected {
+                t.Errorf("expected %q; actual %q", expected, actual)
+            }
+        }
+    }
+
+    if n := listener.Len(); n != 3 {
+        t.Errorf("expected 3 sessions; actual %d", n)
+    }
+}
+
+
+func TestSessionsIdleExpiry(t *testing.T) {
+    listener, err := Sessions{IdleTimeout: 50 * time.Millisecond}.ListenPacket("udp", "127.0.0.1:")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer listener.Close()
+
+    client, err := net.Dial("udp", listener.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+
+    if _, err = client.Write([]byte("hello")); err != nil {
+        t.Fatal(err)
+    }
+
+    session, err := listener.AcceptSession()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if session.RemoteAddr().String() != client.LocalAddr().String() {
+        t.Errorf("expected a session with %s; actual %s", client.LocalAddr(), session.RemoteAddr())
+    }
+
+    buf := make([]byte, 1024)
+    if n, err := session.Read(buf); err != nil || string(buf[:n]) != "hello" {
+        t.Fatalf("expected %q; actual %q, %v", "hello", buf[:n], err)
+    }
+
+    // The caller's deadline passes without closing the session.
+    _ = session.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+    if _, err = session.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, ch03.ErrIdleTimeout) {
+        t.Fatalf("expected the read deadline to pass; actual %v", err)
+    }
+    _ = session.SetReadDeadline(time.Time{})
+
+    // Then the session idles until it expires.
+    begin := time.Now()
+    if _, err = session.Read(buf); !errors.Is(err, ch03.ErrIdleTimeout) {
+        t.Fatalf("expected the session to expire; actual %v", err)
+    }
+
+    if elapsed := time.Since(begin); elapsed > time.Second {
+        t.Errorf("expected the session to expire after 50ms; took %s", elapsed)
+    }
+
+    if n := listener.Len(); n != 0 {
+        t.Errorf("expected no sessions; actual %d", n)
+    }
+
+    // The next datagram opens a new session.
+    if _, err = client.Write([]byte("again")); err != nil {
+        t.Fatal(err)
+    }
+
+    if next, err := listener.AcceptSession(); err != nil || next == session {
+        t.Errorf("expected a new session; actual %v", err)
+    }
+}
+
+
+func TestSessionsClose(t *testing.T) {
+    listener, err := Sessions{}.ListenPacket("udp", "127.0.0.1:")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    client, err := net.Dial("udp", listener.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+
+    if _, err = client.Write([]byte("hello")); err != nil {
+        t.Fatal(err)
+    }
+
+    session, err := listener.Accept()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    buf := make([]byte, 1024)
+    if _, err = session.Read(buf); err != nil {
+        t.Fatal(err)
+    }
+
+    _ = listener.Close()
+
+    if _, err = session.Read(buf); !errors.Is(err, net.ErrClosed) {
+        t.Errorf("expected the session to close with the listener; actual %v", err)
+    }
+
+    if _, err = listener.Accept(); !errors.Is(err, net.ErrClosed) {
+        t.Errorf("expected Accept to fail; actual %v", err)
+    }
+}
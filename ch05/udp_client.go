@@ -0,0 +1,235 @@
+package echo
+
+import (
+    "context"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "math/rand/v2"
+    "net"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/bgabor666/gnp/neterr"
+)
+
+
+var ErrNoReply = errors.New("no reply")
+
+
+// nonceSize is the length of the nonce ExchangeNonce prefixes to requests.
+const nonceSize = 8
+
+
+// UDPClient configures request and reply exchanges with a UDP server.
+type UDPClient struct {
+    Timeout time.Duration // how long to wait for each reply; 0 means 1 second
+    Attempts int // how many times to send a request; 0 means 3
+    MaxReplySize int // longer replies are truncated; 0 means MaxUDPPayload
+
+    // AnyPort accepts replies from any port of the server's address, for
+    // protocols like TFTP whose servers answer from a new port. The socket
+    // then cannot be connected, so the client filters replies itself and
+    // does not learn of ICMP errors.
+    AnyPort bool
+}
+
+
+// ClientConn exchanges datagrams with a single UDP server. Replies from
+// anyone else are ignored, and so are replies the exchange does not match,
+// such as late answers to earlier attempts.
+type ClientConn struct {
+    client UDPClient
+    conn *net.UDPConn
+    server *net.UDPAddr
+    connected bool
+
+    mu sync.Mutex // one exchange at a time
+    buf []byte
+    ignored int64
+}
+
+
+// Dial returns a ClientConn to the server at address. Unless AnyPort is set,
+// its socket is connected, so the kernel drops datagrams from other senders
+// and reports the server's ICMP port unreachable messages as refused
+// connections.
+func (client UDPClient) Dial(ctx context.Context, address string) (*ClientConn, error) {
+    size := client.MaxReplySize
+    if size <= 0 {
+        size = MaxUDPPayload
+    }
+
+    c := &ClientConn{client: client, connected: !client.AnyPort, buf: make([]byte, size)}
+
+    if client.AnyPort {
+        server, err := net.ResolveUDPAddr("udp", address)
+        if err != nil {
+            return nil, err
+        }
+
+        conn, err := net.ListenUDP("udp", nil)
+        if err != nil {
+            return nil, err
+        }
+
+        c.conn, c.server = conn, server
+
+        return c, nil
+    }
+
+    var dialer net.Dialer
+
+    conn, err := dialer.DialContext(ctx, "udp", address)
+    if err != nil {
+        return nil, err
+    }
+
+    c.conn = conn.(*net.UDPConn)
+    c.server = conn.RemoteAddr().(*net.UDPAddr)
+
+    return c, nil
+}
+
+
+// Exchange sends request until match accepts a reply, or the attempts run
+// out, and returns the reply along with the address it came from. It gives
+// up at once if the server's port is unreachable, returning an error that
+// wraps syscall.ECONNREFUSED, and otherwise returns an error wrapping
+// ErrNoReply as well as the last timeout.
+func (c *ClientConn) Exchange(ctx context.Context, request []byte, match func(reply []byte) bool) ([]byte, net.Addr, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    attempts := c.client.Attempts
+    if attempts <= 0 {
+        attempts = 3
+    }
+
+    var err error
+
+    for attempt := 0; attempt < attempts; attempt++ {
+        var reply []byte
+        var from net.Addr
+
+        reply, from, err = c.attempt(ctx, request, match)
+        if err == nil {
+            return reply, from, nil
+        }
+
+        if ctx.Err() != nil {
+            return nil, nil, ctx.Err()
+        }
+
+        // A closed port has answered already, so it is not worth another
+        // attempt, unlike a timeout or an unreachable host.
+        if !neterr.Retryable(err) || neterr.Classify(err) == neterr.Refused {
+            return nil, nil, err
+        }
+    }
+
+    return nil, nil, fmt.Errorf("%w from %s after %d attempts: %w", ErrNoReply, c.server, attempts, err)
+}
+
+// ExchangeNonce sends payload behind a random nonce and returns the payload
+// of the reply that starts with the same nonce, as an echo server's would.
+func (c *ClientConn) ExchangeNonce(ctx context.Context, payload []byte) ([]byte, error) {
+    request := make([]byte, nonceSize, nonceSize + len(payload))
+    binary.BigEndian.PutUint64(request, rand.Uint64())
+    request = append(request, payload...)
+
+    reply, _, err := c.Exchange(ctx, request, func(reply []byte) bool {
+        return len(reply) >= nonceSize && string(reply[:nonceSize]) == string(request[:nonceSize])
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    return reply[nonceSize:], nil
+}
+
+// Ignored returns how many datagrams the connection has ignored, because
+// they came from someone other than the server or no exchange matched them.
+func (c *ClientConn) Ignored() int64 {
+    return atomic.LoadInt64(&c.ignored)
+}
+
+// WriteTo sends b to addr outside of any exchange, such as to the port a
+// server answered from. Connected ClientConns can only write to the server
+// through Exchange.
+func (c *ClientConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+    return c.conn.WriteTo(b, addr)
+}
+
+// LocalAddr returns the client's address.
+func (c *ClientConn) LocalAddr() net.Addr {
+    return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the server's address.
+func (c *ClientConn) RemoteAddr() net.Addr {
+    return c.server
+}
+
+func (c *ClientConn) Close() error {
+    return c.conn.Close()
+}
+
+
+// attempt sends request once and waits for a matching reply until the
+// timeout or ctx is done.
+func (c *ClientConn) attempt(ctx context.Context, request []byte, match func([]byte) bool) ([]byte, net.Addr, error) {
+    timeout := c.client.Timeout
+    if timeout <= 0 {
+        timeout = time.Second
+    }
+
+    deadline := time.Now().Add(timeout)
+    if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+        deadline = d
+    }
+    _ = c.conn.SetReadDeadline(deadline)
+
+    stop := context.AfterFunc(ctx, func() {
+        _ = c.conn.SetReadDeadline(time.Now())
+    })
+    defer stop()
+
+    var err error
+    if c.connected {
+        _, err = c.conn.Write(request)
+    } else {
+        _, err = c.conn.WriteTo(request, c.server)
+    }
+    if err != nil {
+        return nil, nil, err
+    }
+
+    for {
+        var n int
+        var from net.Addr = c.server
+
+        if c.connected {
+            n, err = c.conn.Read(c.buf)
+        } else {
+            var addr *net.UDPAddr
+            n, addr, err = c.conn.ReadFromUDP(c.buf)
+            if err == nil && !addr.IP.Equal(c.server.IP) {
+                atomic.AddInt64(&c.ignored, 1)
+                continue
+            }
+            from = addr
+        }
+        if err != nil {
+            return nil, nil, err
+        }
+
+        if !match(c.buf[:n]) {
+            atomic.AddInt64(&c.ignored, 1)
+            continue
+        }
+
+        return append([]byte(nil), c.buf[:n]...), from, nil
+    }
+}
@@ -0,0 +1,190 @@
+package echo
+
+import (
+    "context"
+    "errors"
+    "net"
+    "os"
+    "syscall"
+    "testing"
+    "time"
+
+    "github.com/bgabor666/gnp/neterr"
+)
+
+
+// packetServer runs handle for every datagram a new loopback socket receives.
+func packetServer(t *testing.T, handle func(conn net.PacketConn, request []byte, addr net.Addr)) net.PacketConn {
+    conn, err := net.ListenPacket("udp", "127.0.0.1:")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { _ = conn.Close() })
+
+    go func() {
+        buf := make([]byte, 1024)
+        for {
+            n, addr, err := conn.ReadFrom(buf)
+            if err != nil {
+                return
+            }
+            handle(conn, buf[:n], addr)
+        }
+    }()
+
+    return conn
+}
+
+
+func TestClientConnNonce(t *testing.T) {
+    // A stale reply, with another nonce, arrives ahead of the real one.
+    server := packetServer(t, func(conn net.PacketConn, request []byte, addr net.Addr) {
+        stale := append([]byte("........"), request[nonceSize:]...)
+        _, _ = conn.WriteTo(stale, addr)
+        _, _ = conn.WriteTo(request, addr)
+    })
+
+    client, err := UDPClient{}.Dial(context.Background(), server.LocalAddr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+
+    reply, err := client.ExchangeNonce(context.Background(), []byte("ping"))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if string(reply) != "ping" {
+        t.Errorf("expected %q; actual %q", "ping", reply)
+    }
+
+    if n := client.Ignored(); n != 1 {
+        t.Errorf("expected the stale reply to be ignored; ignored %d", n)
+    }
+}
+
+
+func TestClientConnRetries(t *testing.T) {
+    // The server loses the first request.
+    requests := 0
+    server := packetServer(t, func(conn net.PacketConn, request []byte, addr net.Addr) {
+        requests++
+        if requests > 1 {
+            _, _ = conn.WriteTo(request, addr)
+        }
+    })
+
+    client, err := UDPClient{Timeout: 50 * time.Millisecond}.Dial(context.Background(), server.LocalAddr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+
+    if _, err = client.ExchangeNonce(context.Background(), []byte("ping")); err != nil {
+        t.Fatal(err)
+    }
+
+    // Without a reply, the attempts run out.
+    silent := packetServer(t, func(net.PacketConn, []byte, net.Addr) {})
+
+    client, err = UDPClient{Timeout: 20 * time.Millisecond, Attempts: 2}.Dial(context.Background(), silent.LocalAddr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+
+    _, err = client.ExchangeNonce(context.Background(), []byte("ping"))
+    if !errors.Is(err, ErrNoReply) || !errors.Is(err, os.ErrDeadlineExceeded) {
+        t.Fatalf("expected no reply; actual %v", err)
+    }
+}
+
+
+func TestClientConnRefused(t *testing.T) {
+    closed, err := net.ListenPacket("udp", "127.0.0.1:")
+    if err != nil {
+        t.Fatal(err)
+    }
+    _ = closed.Close()
+
+    client, err := UDPClient{Timeout: time.Second}.Dial(context.Background(), closed.LocalAddr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+
+    begin := time.Now()
+    _, err = client.ExchangeNonce(context.Background(), []byte("ping"))
+    if !errors.Is(err, syscall.ECONNREFUSED) || neterr.Classify(err) != neterr.Refused {
+        t.Fatalf("expected a refused connection; actual %v", err)
+    }
+
+    if elapsed := time.Since(begin); elapsed > 500 * time.Millisecond {
+        t.Errorf("expected to give up without waiting for a reply; took %s", elapsed)
+    }
+}
+
+
+func TestClientConnAnyPort(t *testing.T) {
+    // The server answers from a new socket, as a TFTP server does, while an
+    // interloper on another address gets in first.
+    server := packetServer(t, func(conn net.PacketConn, request []byte, addr net.Addr) {
+        interloper, err := net.ListenPacket("udp", "127.0.0.2:")
+        if err == nil {
+            _, _ = interloper.WriteTo(request, addr)
+            _ = interloper.Close()
+        }
+
+        handler, err := net.ListenPacket("udp", "127.0.0.1:")
+        if err != nil {
+            return
+        }
+        _, _ = handler.WriteTo(request, addr)
+        _ = handler.Close()
+    })
+
+    client, err := UDPClient{AnyPort: true}.Dial(context.Background(), server.LocalAddr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+
+    request := []byte("hello")
+    reply, from, err := client.Exchange(context.Background(), request, func(reply []byte) bool {
+        return string(reply) == "hello"
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if string(reply) != "hello" {
+        t.Errorf("expected %q; actual %q", "hello", reply)
+    }
+
+    if from.String() == server.LocalAddr().String() {
+        t.Errorf("expected the reply from a new port; actual %s", from)
+    }
+
+    if n := client.Ignored(); n != 1 {
+        t.Errorf("expected the interloper to be ignored; ignored %d", n)
+    }
+}
+
+
+func TestClientConnCancel(t *testing.T) {
+    silent := packetServer(t, func(net.PacketConn, []byte, net.Addr) {})
+
+    client, err := UDPClient{Timeout: time.Hour}.Dial(context.Background(), silent.LocalAddr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    time.AfterFunc(50 * time.Millisecond, cancel)
+
+    if _, err = client.ExchangeNonce(ctx, []byte("ping")); !errors.Is(err, context.Canceled) {
+        t.Fatalf("expected the exchange to be canceled; actual %v", err)
+    }
+}
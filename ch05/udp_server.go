@@ -0,0 +1,331 @@
+package echo
+
+import (
+    "context"
+    "fmt"
+    "net"
+    "runtime"
+    "sync"
+    "sync/atomic"
+)
+
+
+// MaxUDPPayload is the largest payload a UDP datagram over IPv4 can carry.
+const MaxUDPPayload = 65507
+
+
+// Datagram is a single datagram a UDPServer received.
+type Datagram struct {
+    Data []byte // only valid until the Handler returns
+    Addr net.Addr
+    Truncated bool // the datagram was longer than MaxDatagramSize, and Data holds its start
+}
+
+
+// Handler answers a datagram. A nil reply sends nothing back. The reply may
+// alias the datagram's Data.
+type Handler func(Datagram) []byte
+
+
+// Echo replies with the datagram itself, dropping truncated ones rather than
+// sending back part of them.
+func Echo(d Datagram) []byte {
+    if d.Truncated {
+        return nil
+    }
+
+    return d.Data
+}
+
+
+// UDPServer reads datagrams off a packet connection and hands them to a pool
+// of workers, which send back whatever the Handler replies.
+type UDPServer struct {
+    Handler Handler // nil means Echo
+    MaxDatagramSize int // longer datagrams are truncated; 0 means MaxUDPPayload
+    Workers int // datagrams handled at once; 0 means runtime.NumCPU()
+
+    // Batch, if more than 1, is how many datagrams to receive, and replies
+    // to send, per system call where the platform supports it (recvmmsg and
+    // sendmmsg on Linux). Elsewhere, and on connections other than
+    // *net.UDPConn, it has no effect.
+    Batch int
+
+    buffers sync.Pool
+    received, sent, truncated, errors int64
+}
+
+
+// UDPStats are a UDPServer's counters.
+type UDPStats struct {
+    Received int64
+    Sent int64
+    Truncated int64 // datagrams longer than MaxDatagramSize
+    Errors int64 // replies that failed to send
+}
+
+
+// packet is a datagram, or a reply, along with the pooled buffer it lives in.
+type packet struct {
+    buf *[]byte
+    data []byte
+    addr net.Addr
+    truncated bool
+}
+
+
+// ListenAndServe binds to addr and serves datagrams on it until ctx is done.
+// It returns once the server is listening, with its address.
+func (s *UDPServer) ListenAndServe(ctx context.Context, addr string) (net.Addr, error) {
+    conn, err := net.ListenPacket("udp", addr)
+    if err != nil {
+        return nil, fmt.Errorf("binding to udp %s: %w", addr, err)
+    }
+
+    go func() { _ = s.Serve(ctx, conn) }()
+
+    return conn.LocalAddr(), nil
+}
+
+// Serve handles datagrams arriving on conn until ctx is done, or reading
+// fails, and then closes conn.
+func (s *UDPServer) Serve(ctx context.Context, conn net.PacketConn) error {
+    stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+    defer stop()
+    defer conn.Close()
+
+    workers := s.Workers
+    if workers <= 0 {
+        workers = runtime.NumCPU()
+    }
+
+    handler := s.Handler
+    if handler == nil {
+        handler = Echo
+    }
+
+    var batch batchConn
+    if s.Batch > 1 {
+        if udp, ok := conn.(*net.UDPConn); ok {
+            batch = newBatchConn(udp, s.Batch)
+        }
+    }
+
+    var send func(packet)
+    var replies chan packet
+    sending := new(sync.WaitGroup)
+
+    if batch != nil {
+        replies = make(chan packet, s.Batch)
+        send = func(reply packet) { replies <- reply }
+
+        sending.Add(1)
+        go func() {
+            defer sending.Done()
+            s.writeBatches(batch, replies)
+        }()
+    } else {
+        send = func(reply packet) {
+            if _, err := conn.WriteTo(reply.data, reply.addr); err != nil {
+                atomic.AddInt64(&s.errors, 1)
+            } else {
+                atomic.AddInt64(&s.sent, 1)
+            }
+            s.buffers.Put(reply.buf)
+        }
+    }
+
+    jobs := make(chan packet, workers)
+    handling := new(sync.WaitGroup)
+
+    for i := 0; i < workers; i++ {
+        handling.Add(1)
+        go func() {
+            defer handling.Done()
+
+            for p := range jobs {
+                reply := handler(Datagram{Data: p.data, Addr: p.addr, Truncated: p.truncated})
+                if reply == nil {
+                    s.buffers.Put(p.buf)
+                    continue
+                }
+
+                send(packet{buf: p.buf, data: reply, addr: p.addr})
+            }
+        }()
+    }
+
+    var err error
+    if batch != nil {
+        err = s.readBatches(batch, jobs)
+    } else {
+        err = s.read(conn, jobs)
+    }
+
+    close(jobs)
+    handling.Wait()
+
+    if replies != nil {
+        close(replies)
+        sending.Wait()
+    }
+
+    if ctx.Err() != nil {
+        return nil
+    }
+
+    return err
+}
+
+// Stats returns the server's counters.
+func (s *UDPServer) Stats() UDPStats {
+    return UDPStats{
+        Received: atomic.LoadInt64(&s.received),
+        Sent: atomic.LoadInt64(&s.sent),
+        Truncated: atomic.LoadInt64(&s.truncated),
+        Errors: atomic.LoadInt64(&s.errors),
+    }
+}
+
+
+func (s *UDPServer) maxSize() int {
+    if s.MaxDatagramSize <= 0 {
+        return MaxUDPPayload
+    }
+
+    return s.MaxDatagramSize
+}
+
+// buffer returns a pooled buffer one byte longer than the largest datagram,
+// so a datagram that fills it must have been truncated.
+func (s *UDPServer) buffer() *[]byte {
+    if buf, ok := s.buffers.Get().(*[]byte); ok {
+        return buf
+    }
+
+    buf := make([]byte, s.maxSize() + 1)
+
+    return &buf
+}
+
+// packet wraps the n bytes read into buf as a packet, counting it.
+func (s *UDPServer) packet(buf *[]byte, n int, addr net.Addr, truncated bool) packet {
+    atomic.AddInt64(&s.received, 1)
+
+    if max := s.maxSize(); n > max {
+        n = max
+        truncated = true
+    }
+    if truncated {
+        atomic.AddInt64(&s.truncated, 1)
+    }
+
+    return packet{buf: buf, data: (*buf)[:n], addr: addr, truncated: truncated}
+}
+
+func (s *UDPServer) read(conn net.PacketConn, jobs chan<- packet) error {
+    for {
+        buf := s.buffer()
+
+        n, addr, err := conn.ReadFrom(*buf)
+        if err != nil {
+            s.buffers.Put(buf)
+            return err
+        }
+
+        jobs <- s.packet(buf, n, addr, false)
+    }
+}
+
+func (s *UDPServer) readBatches(conn batchConn, jobs chan<- packet) error {
+    bufs := make([]*[]byte, s.Batch)
+    messages := make([]batchMessage, s.Batch)
+
+    for {
+        for i := range bufs {
+            if bufs[i] == nil {
+                bufs[i] = s.buffer()
+            }
+            messages[i] = batchMessage{Data: *bufs[i]}
+        }
+
+        n, err := conn.ReadBatch(messages)
+        if err != nil {
+            for _, buf := range bufs {
+                if buf != nil {
+                    s.buffers.Put(buf)
+                }
+            }
+            return err
+        }
+
+        for i := 0; i < n; i++ {
+            m := messages[i]
+            jobs <- s.packet(bufs[i], m.N, m.Addr, m.Truncated)
+            bufs[i] = nil
+        }
+    }
+}
+
+// writeBatches sends the replies as they come, along with any others already
+// waiting, in as few system calls as it can.
+func (s *UDPServer) writeBatches(conn batchConn, replies <-chan packet) {
+    pending := make([]packet, 0, s.Batch)
+    messages := make([]batchMessage, 0, s.Batch)
+
+    for reply := range replies {
+        pending = append(pending[:0], reply)
+
+    gather:
+        for len(pending) < cap(pending) {
+            select {
+            case reply, ok := <-replies:
+                if !ok {
+                    break gather
+                }
+                pending = append(pending, reply)
+            default:
+                break gather
+            }
+        }
+
+        messages = messages[:0]
+        for _, p := range pending {
+            messages = append(messages, batchMessage{Data: p.data, Addr: p.addr})
+        }
+
+        for len(messages) > 0 {
+            n, err := conn.WriteBatch(messages)
+            if err != nil {
+                // Skip the reply that failed and carry on with the rest.
+                atomic.AddInt64(&s.errors, 1)
+                n = 1
+            } else {
+                atomic.AddInt64(&s.sent, int64(n))
+            }
+            messages = messages[n:]
+        }
+
+        for _, p := range pending {
+            s.buffers.Put(p.buf)
+        }
+    }
+}
+
+
+// batchMessage is one datagram of a batched read or write.
+type batchMessage struct {
+    Data []byte
+    Addr net.Addr
+    N int // the bytes read into Data
+    Truncated bool
+}
+
+
+// batchConn reads and writes several datagrams per system call. ReadBatch
+// blocks until at least one datagram arrives and returns how many did.
+// WriteBatch returns how many of the messages it sent.
+type batchConn interface {
+    ReadBatch(messages []batchMessage) (int, error)
+    WriteBatch(messages []batchMessage) (int, error)
+}
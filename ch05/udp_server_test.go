@@ -0,0 +1,132 @@
+package echo
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "net"
+    "sync"
+    "testing"
+    "time"
+)
+
+
+// exchange sends msg to addr from a new client and returns the reply, or nil
+// if none arrives in time.
+func exchange(t *testing.T, addr net.Addr, msg []byte) []byte {
+    client, err := net.ListenPacket("udp", "127.0.0.1:")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+
+    if _, err = client.WriteTo(msg, addr); err != nil {
+        t.Fatal(err)
+    }
+
+    _ = client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+
+    buf := make([]byte, MaxUDPPayload + 1)
+    n, _, err := client.ReadFrom(buf)
+    if err != nil {
+        return nil
+    }
+
+    return buf[:n]
+}
+
+
+func TestUDPServerLargeDatagrams(t *testing.T) {
+    for _, batch := range []int{0, 8} {
+        t.Run(fmt.Sprintf("batch %d", batch), func(t *testing.T) {
+            ctx, cancel := context.WithCancel(context.Background())
+            defer cancel()
+
+            server := &UDPServer{Batch: batch}
+            addr, err := server.ListenAndServe(ctx, "127.0.0.1:")
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            for _, size := range []int{1, 1024, 1025, 9000, MaxUDPPayload} {
+                msg := bytes.Repeat([]byte{byte(size)}, size)
+                if reply := exchange(t, addr, msg); !bytes.Equal(reply, msg) {
+                    t.Errorf("%d bytes: expected the datagram back; actual %d bytes", size, len(reply))
+                }
+            }
+        })
+    }
+}
+
+
+func TestUDPServerTruncation(t *testing.T) {
+    for _, batch := range []int{0, 8} {
+        t.Run(fmt.Sprintf("batch %d", batch), func(t *testing.T) {
+            ctx, cancel := context.WithCancel(context.Background())
+            defer cancel()
+
+            server := &UDPServer{MaxDatagramSize: 100, Batch: batch}
+            addr, err := server.ListenAndServe(ctx, "127.0.0.1:")
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            if reply := exchange(t, addr, make([]byte, 101)); reply != nil {
+                t.Errorf("expected the truncated datagram to go unanswered; actual %d bytes", len(reply))
+            }
+
+            if reply := exchange(t, addr, make([]byte, 100)); len(reply) != 100 {
+                t.Errorf("expected 100 bytes back; actual %d", len(reply))
+            }
+
+            if stats := server.Stats(); stats.Received != 2 || stats.Truncated != 1 || stats.Sent != 1 {
+                t.Errorf("expected 2 received, 1 truncated and 1 sent; actual %+v", stats)
+            }
+        })
+    }
+}
+
+
+func TestUDPServerConcurrency(t *testing.T) {
+    for _, batch := range []int{0, 8} {
+        t.Run(fmt.Sprintf("batch %d", batch), func(t *testing.T) {
+            ctx, cancel := context.WithCancel(context.Background())
+            defer cancel()
+
+            // Each datagram takes a while to handle, so a single worker would
+            // answer the last client long after the first.
+            server := &UDPServer{
+                Workers: 10,
+                Batch: batch,
+                Handler: func(d Datagram) []byte {
+                    time.Sleep(50 * time.Millisecond)
+                    return append([]byte("re: "), d.Data...)
+                },
+            }
+            addr, err := server.ListenAndServe(ctx, "127.0.0.1:")
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            begin := time.Now()
+            wg := new(sync.WaitGroup)
+
+            for i := 0; i < 10; i++ {
+                wg.Add(1)
+                go func(i int) {
+                    defer wg.Done()
+
+                    msg := fmt.Sprintf("client %d", i)
+                    if reply := exchange(t, addr, []byte(msg)); string(reply) != "re: " + msg {
+                        t.Errorf("expected %q; actual %q", "re: " + msg, reply)
+                    }
+                }(i)
+            }
+            wg.Wait()
+
+            if elapsed := time.Since(begin); elapsed > 150 * time.Millisecond {
+                t.Errorf("expected the datagrams to be handled at once; took %s", elapsed)
+            }
+        })
+    }
+}
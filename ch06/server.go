@@ -2,10 +2,13 @@ package tftp
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"log"
 	"net"
 	"time"
+
+	echo "github.com/bgabor666/gnp/ch05"
 )
 
 
@@ -70,7 +73,13 @@ func (server Server) Serve(connection net.PacketConn) error {
 func (server Server) handle(clientAddr string, rrq ReadReq) {
     log.Printf("[%s] requested file: %s", clientAddr, rrq.Filename)
 
-    connection, err := net.Dial("udp", clientAddr)
+    client := echo.UDPClient{
+	Timeout: server.Timeout,
+	Attempts: int(server.Retries),
+	MaxReplySize: DatagramSize,
+    }
+
+    connection, err := client.Dial(context.Background(), clientAddr)
     if err != nil {
 	log.Printf("[%s] dial: %v", clientAddr, err)
 	return
@@ -83,55 +92,35 @@ func (server Server) handle(clientAddr string, rrq ReadReq) {
 	ackPkt Ack
 	errPkt TFTPError
 	dataPkt = Data{Payload: bytes.NewReader(server.Payload)}
-	buf = make([]byte, DatagramSize)
     )
 
-NEXTPACKET:
     for n := DatagramSize; n == DatagramSize; {
 	data, err := dataPkt.MarshalBinary()
 	if err != nil {
 	    log.Printf("[%s] preparing data packet: %v", clientAddr, err)
 	    return
 	}
+	n = len(data)
 
-    RETRY:
-	for i := server.Retries; i > 0; i-- {
-	    // send the data packet
-	    n, err = connection.Write(data)
-	    if err != nil {
-		log.Printf("[%s] write: %v", clientAddr, err)
-		return
-	    }
-
-	    // wait for the client's ACK packet
-	    _ = connection.SetReadDeadline(time.Now().Add(server.Timeout))
-
-	    _, err = connection.Read(buf)
-	    if err != nil {
-		if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
-		    continue RETRY
-		}
-
-		log.Printf("[%s] waiting for ACK: %v", clientAddr, err)
-		return
+	// send the data packet until the client acknowledges it or gives up
+	reply, _, err := connection.Exchange(context.Background(), data, func(reply []byte) bool {
+	    if ackPkt.UnmarshalBinary(reply) == nil {
+		return uint16(ackPkt) == dataPkt.Block
 	    }
 
-	    switch {
-	    case ackPkt.UnmarshalBinary(buf) == nil:
-	        if uint16(ackPkt) == dataPkt.Block {
-		    // received ACK, send next data packet
-		    continue NEXTPACKET
-		}
-	    case errPkt.UnmarshalBinary(buf) == nil:
-		log.Printf("[%s] received error: %v", clientAddr, errPkt.Message)
-		return
-	    default:
-		log.Printf("[%s] bad packet", clientAddr)
-	    }
+	    return errPkt.UnmarshalBinary(reply) == nil
+	})
+	switch {
+	case errors.Is(err, echo.ErrNoReply):
+	    log.Printf("[%s] exhausted retries", clientAddr)
+	    return
+	case err != nil:
+	    log.Printf("[%s] waiting for ACK: %v", clientAddr, err)
+	    return
+	case errPkt.UnmarshalBinary(reply) == nil:
+	    log.Printf("[%s] received error: %v", clientAddr, errPkt.Message)
+	    return
 	}
-
-	log.Printf("[%s] exhausted retries", clientAddr)
-	return
     }
 
     log.Printf("[%s] sent %d blocks", clientAddr, dataPkt.Block)
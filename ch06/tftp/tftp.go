@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"io/ioutil"
 	"log"
 
+	echo "github.com/bgabor666/gnp/ch05"
 	tftp "github.com/bgabor666/gnp/ch06"
 )
 
@@ -12,6 +14,7 @@ import (
 var (
     address = flag.String("a", "127.0.0.1:69", "listen address")
     payload = flag.String("p", "payload.svg", "file to serve to clients")
+    announce = flag.String("announce", "", "answer service discovery queries on the LAN under this name")
 )
 
 
@@ -23,6 +26,15 @@ func main() {
 	log.Fatal(err)
     }
 
+    if *announce != "" {
+	responder := echo.Responder{Services: []echo.Service{{Type: "tftp", Name: *announce, Addr: *address}}}
+
+	err = responder.ListenAndServe(context.Background())
+	if err != nil {
+	    log.Fatal(err)
+	}
+    }
+
     server := tftp.Server{Payload: payload}
 
     log.Fatal(server.ListenAndServe(*address))
@@ -4,14 +4,24 @@ import (
 	"context"
 	"net"
 	"os"
+	"time"
+
+	"github.com/bgabor666/gnp/ch03"
+	ch05 "github.com/bgabor666/gnp/ch05"
 )
 
 
-func streamingEchoServer(ctx context.Context, network string, addr string) (net.Addr, error) {
-    server, err := net.Listen(network, addr)
+// Clients that neither send nor take their echo for this long are dropped.
+const idleTimeout = time.Minute
+
+
+// streamingEchoServer echoes to unix or unixpacket clients the policy lets in.
+func streamingEchoServer(ctx context.Context, network string, addr string, policy PeerPolicy) (net.Addr, error) {
+    listener, err := net.Listen(network, addr)
     if err != nil {
 	return nil, err
     }
+    server := policy.Listener(listener)
 
     go func() {
         go func() {
@@ -20,10 +30,11 @@ func streamingEchoServer(ctx context.Context, network string, addr string) (net.
         }()
 
 	for {
-	    connection, err := server.Accept()
+	    conn, err := server.Accept()
 	    if err != nil {
 		return
 	    }
+	    connection := ch03.IdleTimeout{Read: idleTimeout, Write: idleTimeout}.Wrap(conn)
 
 	    go func() {
 	        defer func()  {
@@ -51,7 +62,7 @@ func streamingEchoServer(ctx context.Context, network string, addr string) (net.
 
 
 func datagramEchoServer(ctx context.Context, network string, addr string) (net.Addr, error) {
-    server, err := net.ListenPacket(network, addr)
+    server, err := ch05.Sessions{IdleTimeout: idleTimeout}.ListenPacket(network, addr)
     if err != nil {
 	return nil, err
     }
@@ -65,20 +76,35 @@ func datagramEchoServer(ctx context.Context, network string, addr string) (net.A
 	    }
         }()
 
-	buf := make([]byte, 1024)
-
+	// Each client gets its own session, so a client that cannot take
+	// its echo no longer stops the server.
 	for {
-	    n, clientAddr, err := server.ReadFrom(buf)
+	    session, err := server.Accept()
 	    if err != nil {
 		return
 	    }
 
-	    _, err = server.WriteTo(buf[:n], clientAddr)
-	    if err != nil {
-		return
-	    }
+	    go func() {
+	        defer func()  {
+	            _ = session.Close()
+                }()
+
+		buf := make([]byte, 1024)
+
+		for {
+		    n, err := session.Read(buf)
+		    if err != nil {
+			return
+		    }
+
+		    _, err = session.Write(buf[:n])
+		    if err != nil {
+			return
+		    }
+		}
+	    }()
 	}
     }()
 
-    return server.LocalAddr(), nil
+    return server.Addr(), nil
 }
@@ -25,7 +25,7 @@ func TestEchoServerUnix(t *testing.T) {
 
     ctx, cancel := context.WithCancel(context.Background())
     socket := filepath.Join(dir, fmt.Sprintf("%d.sock", os.Getpid()))
-    rAddr, err := streamingEchoServer(ctx, "unix", socket)
+    rAddr, err := streamingEchoServer(ctx, "unix", socket, PeerPolicy{})
     if err != nil {
 	t.Fatal(err)
     }
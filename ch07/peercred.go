@@ -0,0 +1,98 @@
+package echo
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+)
+
+
+var ErrPeerRejected = errors.New("peer rejected")
+
+
+// PeerCred identifies the process at the other end of a unix socket, as it
+// was when it connected.
+type PeerCred struct {
+    PID int32
+    UID uint32
+    GID uint32
+}
+
+
+// PeerCredentials returns the credentials of the peer of a unix or
+// unixpacket connection, looking through wrappers that have a NetConn
+// method. Only Linux supports it.
+func PeerCredentials(conn net.Conn) (PeerCred, error) {
+    for {
+	switch c := conn.(type) {
+	case *net.UnixConn:
+	    return peerCred(c)
+	case interface{ NetConn() net.Conn }:
+	    conn = c.NetConn()
+	default:
+	    return PeerCred{}, fmt.Errorf("peer credentials of %T: %w", conn, errors.ErrUnsupported)
+	}
+    }
+}
+
+
+// PeerPolicy lets in the peers whose user or group is listed. Without either
+// list, it lets in everyone.
+type PeerPolicy struct {
+    UIDs []uint32
+    GIDs []uint32
+    OnReject func(conn net.Conn, cred PeerCred, err error) // called before closing a rejected connection
+}
+
+
+// Allow reports whether cred may connect.
+func (policy PeerPolicy) Allow(cred PeerCred) bool {
+    if len(policy.UIDs) == 0 && len(policy.GIDs) == 0 {
+	return true
+    }
+
+    return slices.Contains(policy.UIDs, cred.UID) || slices.Contains(policy.GIDs, cred.GID)
+}
+
+// Listener returns a listener whose Accept closes the connections the policy
+// rejects, and those whose credentials it cannot read unless the policy lets
+// in everyone, and waits for the next one.
+func (policy PeerPolicy) Listener(listener net.Listener) net.Listener {
+    return &peerListener{Listener: listener, policy: policy}
+}
+
+
+type peerListener struct {
+    net.Listener
+    policy PeerPolicy
+}
+
+func (l *peerListener) Accept() (net.Conn, error) {
+    for {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+	    return nil, err
+	}
+
+	if len(l.policy.UIDs) == 0 && len(l.policy.GIDs) == 0 {
+	    return conn, nil
+	}
+
+	cred, err := PeerCredentials(conn)
+	if err == nil && l.policy.Allow(cred) {
+	    return conn, nil
+	}
+
+	if err == nil {
+	    err = fmt.Errorf("%w: uid %d, gid %d", ErrPeerRejected, cred.UID, cred.GID)
+	} else {
+	    err = fmt.Errorf("%w: %w", ErrPeerRejected, err)
+	}
+
+	if l.policy.OnReject != nil {
+	    l.policy.OnReject(conn, cred, err)
+	}
+	_ = conn.Close()
+    }
+}
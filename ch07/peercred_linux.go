@@ -0,0 +1,29 @@
+package echo
+
+import (
+	"net"
+	"syscall"
+)
+
+
+func peerCred(conn *net.UnixConn) (PeerCred, error) {
+    raw, err := conn.SyscallConn()
+    if err != nil {
+	return PeerCred{}, err
+    }
+
+    var ucred *syscall.Ucred
+    var credErr error
+
+    err = raw.Control(func(fd uintptr) {
+	ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+    })
+    if err == nil {
+	err = credErr
+    }
+    if err != nil {
+	return PeerCred{}, &net.OpError{Op: "getsockopt", Net: conn.LocalAddr().Network(), Addr: conn.RemoteAddr(), Err: err}
+    }
+
+    return PeerCred{PID: ucred.Pid, UID: ucred.Uid, GID: ucred.Gid}, nil
+}
@@ -0,0 +1,128 @@
+package echo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bgabor666/gnp/ch03"
+)
+
+
+func TestPeerCredentials(t *testing.T) {
+    for _, network := range []string{"unix", "unixpacket"} {
+	t.Run(network, func(t *testing.T) {
+	    socket := filepath.Join(t.TempDir(), fmt.Sprintf("%d.sock", os.Getpid()))
+
+	    listener, err := net.Listen(network, socket)
+	    if err != nil {
+		t.Fatal(err)
+	    }
+	    defer listener.Close()
+
+	    go func() {
+		conn, err := net.Dial(network, socket)
+		if err == nil {
+		    defer conn.Close()
+		    _, _ = conn.Read(make([]byte, 1))
+		}
+	    }()
+
+	    conn, err := listener.Accept()
+	    if err != nil {
+		t.Fatal(err)
+	    }
+	    defer conn.Close()
+
+	    // The credentials are found through the wrapper.
+	    cred, err := PeerCredentials(ch03.IdleTimeout{Read: time.Second}.Wrap(conn))
+	    if err != nil {
+		t.Fatal(err)
+	    }
+
+	    expected := PeerCred{PID: int32(os.Getpid()), UID: uint32(os.Getuid()), GID: uint32(os.Getgid())}
+	    if cred != expected {
+		t.Errorf("expected %+v; actual %+v", expected, cred)
+	    }
+	})
+    }
+
+    client, server := net.Pipe()
+    defer client.Close()
+    defer server.Close()
+
+    if _, err := PeerCredentials(server); !errors.Is(err, errors.ErrUnsupported) {
+	t.Errorf("expected no credentials for a pipe; actual %v", err)
+    }
+}
+
+
+func TestPeerPolicy(t *testing.T) {
+    uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+
+    for name, c := range map[string]struct {
+	policy PeerPolicy
+	allowed bool
+    }{
+	"everyone": {PeerPolicy{}, true},
+	"user": {PeerPolicy{UIDs: []uint32{uid + 1, uid}}, true},
+	"group": {PeerPolicy{UIDs: []uint32{uid + 1}, GIDs: []uint32{gid}}, true},
+	"others": {PeerPolicy{UIDs: []uint32{uid + 1}, GIDs: []uint32{gid + 1}}, false},
+    } {
+	t.Run(name, func(t *testing.T) {
+	    ctx, cancel := context.WithCancel(context.Background())
+	    defer cancel()
+
+	    rejected := make(chan error, 1)
+	    c.policy.OnReject = func(_ net.Conn, _ PeerCred, err error) { rejected <- err }
+
+	    socket := filepath.Join(t.TempDir(), fmt.Sprintf("%d.sock", os.Getpid()))
+	    rAddr, err := streamingEchoServer(ctx, "unixpacket", socket, c.policy)
+	    if err != nil {
+		t.Fatal(err)
+	    }
+
+	    connection, err := net.Dial("unixpacket", rAddr.String())
+	    if err != nil {
+		t.Fatal(err)
+	    }
+	    defer connection.Close()
+
+	    _ = connection.SetDeadline(time.Now().Add(time.Second))
+
+	    if _, err = connection.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	    }
+
+	    buf := make([]byte, 1024)
+	    n, err := connection.Read(buf)
+
+	    if c.allowed {
+		if err != nil || string(buf[:n]) != "ping" {
+		    t.Errorf("expected the echo; actual %q, %v", buf[:n], err)
+		}
+		return
+	    }
+
+	    // The server closes the connection with the ping unread, so the
+	    // client sees a reset rather than EOF.
+	    if err == nil {
+		t.Errorf("expected the connection to close; read %q", buf[:n])
+	    }
+
+	    select {
+	    case err = <-rejected:
+		if !errors.Is(err, ErrPeerRejected) {
+		    t.Errorf("expected %v; actual %v", ErrPeerRejected, err)
+		}
+	    case <-time.After(time.Second):
+		t.Error("expected the peer to be rejected")
+	    }
+	})
+    }
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package echo
+
+import (
+	"errors"
+	"net"
+)
+
+
+func peerCred(conn *net.UnixConn) (PeerCred, error) {
+    return PeerCred{}, errors.ErrUnsupported
+}
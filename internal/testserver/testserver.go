@@ -0,0 +1,42 @@
+// Package testserver runs the throwaway TCP servers the tests in this
+// repository talk to.
+package testserver
+
+import (
+    "net"
+    "sync/atomic"
+    "testing"
+)
+
+
+// Counting listens on a loopback port and runs handle for every connection
+// it accepts, closing the connection once handle returns. It counts the
+// connections in the returned counter and stops listening when t ends.
+func Counting(t testing.TB, handle func(net.Conn)) (net.Listener, *int32) {
+    t.Helper()
+
+    listener, err := net.Listen("tcp", "127.0.0.1:")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { _ = listener.Close() })
+
+    accepted := new(int32)
+
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            atomic.AddInt32(accepted, 1)
+
+            go func(c net.Conn) {
+                defer c.Close()
+                handle(c)
+            }(conn)
+        }
+    }()
+
+    return listener, accepted
+}
@@ -0,0 +1,132 @@
+// Package neterr sorts dial and I/O errors into a few classes so the tools in
+// this repository agree on which failures are worth retrying. It replaces
+// net.Error's deprecated Temporary method.
+package neterr
+
+import (
+    "context"
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "net"
+    "os"
+    "syscall"
+)
+
+
+type Class uint8
+
+const (
+    Unknown Class = iota
+    Timeout // a deadline or timeout elapsed
+    Refused // nothing listens at the address
+    Unreachable // no route to the host or network
+    DNS // the name did not resolve
+    Reset // the peer reset or aborted the connection
+    TLS // the handshake or certificate verification failed
+    Closed // the connection was closed locally or the operation canceled
+)
+
+func (class Class) String() string {
+    switch class {
+    case Timeout:
+        return "timeout"
+    case Refused:
+        return "refused"
+    case Unreachable:
+        return "unreachable"
+    case DNS:
+        return "dns"
+    case Reset:
+        return "reset"
+    case TLS:
+        return "tls"
+    case Closed:
+        return "closed"
+    default:
+        return "unknown"
+    }
+}
+
+
+// Classify returns the class of err, or Unknown if err is nil or fits none.
+func Classify(err error) Class {
+    if err == nil {
+        return Unknown
+    }
+
+    // DNS errors come first since they also report timeouts.
+    var dnsErr *net.DNSError
+    if errors.As(err, &dnsErr) {
+        return DNS
+    }
+
+    if isTLS(err) {
+        return TLS
+    }
+
+    switch {
+    case errors.Is(err, syscall.ECONNREFUSED):
+        return Refused
+    case errors.Is(err, syscall.ECONNRESET),
+        errors.Is(err, syscall.ECONNABORTED),
+        errors.Is(err, syscall.EPIPE):
+        return Reset
+    case errors.Is(err, syscall.EHOSTUNREACH),
+        errors.Is(err, syscall.ENETUNREACH),
+        errors.Is(err, syscall.EHOSTDOWN),
+        errors.Is(err, syscall.ENETDOWN):
+        return Unreachable
+    case errors.Is(err, syscall.ETIMEDOUT),
+        errors.Is(err, os.ErrDeadlineExceeded),
+        errors.Is(err, context.DeadlineExceeded):
+        return Timeout
+    case errors.Is(err, net.ErrClosed),
+        errors.Is(err, context.Canceled):
+        return Closed
+    }
+
+    var netErr net.Error
+    if errors.As(err, &netErr) && netErr.Timeout() {
+        return Timeout
+    }
+
+    return Unknown
+}
+
+
+func isTLS(err error) bool {
+    var (
+        recordErr tls.RecordHeaderError
+        alertErr tls.AlertError
+        verifyErr *tls.CertificateVerificationError
+        authorityErr x509.UnknownAuthorityError
+        hostnameErr x509.HostnameError
+        invalidErr x509.CertificateInvalidError
+    )
+
+    return errors.As(err, &recordErr) ||
+        errors.As(err, &alertErr) ||
+        errors.As(err, &verifyErr) ||
+        errors.As(err, &authorityErr) ||
+        errors.As(err, &hostnameErr) ||
+        errors.As(err, &invalidErr)
+}
+
+
+// Retryable reports whether trying the same operation again may succeed.
+// Timeouts, refused and reset connections and unreachable hosts are
+// retryable, since services restart and routes flap. So are DNS failures the
+// resolver marks as temporary. Unknown errors, TLS failures and closed
+// connections are not.
+func Retryable(err error) bool {
+    switch Classify(err) {
+    case Timeout, Refused, Unreachable, Reset:
+        return true
+    case DNS:
+        var dnsErr *net.DNSError
+        return errors.As(err, &dnsErr) && (dnsErr.IsTemporary || dnsErr.IsTimeout)
+    default:
+        return false
+    }
+}
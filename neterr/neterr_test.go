@@ -0,0 +1,64 @@
+package neterr
+
+import (
+    "context"
+    "crypto/x509"
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "syscall"
+    "testing"
+    "time"
+)
+
+
+func TestClassify(t *testing.T) {
+    opErr := func(err error) error {
+        return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", err)}
+    }
+
+    for i, c := range []struct {
+        Err error
+        Expected Class
+        Retryable bool
+    }{
+        {nil, Unknown, false},
+        {errors.New("boom"), Unknown, false},
+        {opErr(syscall.ECONNREFUSED), Refused, true},
+        {opErr(syscall.ECONNRESET), Reset, true},
+        {fmt.Errorf("write: %w", syscall.EPIPE), Reset, true},
+        {opErr(syscall.EHOSTUNREACH), Unreachable, true},
+        {opErr(syscall.ENETUNREACH), Unreachable, true},
+        {opErr(syscall.ETIMEDOUT), Timeout, true},
+        {&net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}, Timeout, true},
+        {context.DeadlineExceeded, Timeout, true},
+        {&net.DNSError{Err: "no such host", Name: "invalid.", IsNotFound: true}, DNS, false},
+        {&net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true}, DNS, true},
+        {fmt.Errorf("handshake: %w", x509.UnknownAuthorityError{}), TLS, false},
+        {net.ErrClosed, Closed, false},
+        {context.Canceled, Closed, false},
+    } {
+        if actual := Classify(c.Err); actual != c.Expected {
+            t.Errorf("%d: expected class %s; actual %s", i, c.Expected, actual)
+        }
+
+        if actual := Retryable(c.Err); actual != c.Retryable {
+            t.Errorf("%d: expected retryable %t; actual %t", i, c.Retryable, actual)
+        }
+    }
+}
+
+
+func TestClassifyDial(t *testing.T) {
+    listener, err := net.Listen("tcp", "127.0.0.1:")
+    if err != nil {
+        t.Fatal(err)
+    }
+    _ = listener.Close()
+
+    _, err = net.DialTimeout("tcp", listener.Addr().String(), time.Second)
+    if class := Classify(err); class != Refused {
+        t.Errorf("expected class %s; actual %s (%v)", Refused, class, err)
+    }
+}